@@ -0,0 +1,246 @@
+// Command ratelimit_sim replays a JSONL request log through the L7 rate
+// limit settings of one or more config files and reports who would have
+// been limited, so limits can be tuned before they are enforced.
+//
+//	go run ./cmd/ratelimit_sim -log access.jsonl -settings 'settings/*.json'
+//
+// Each log line is a JSON object with the request's time (RFC 3339 or Unix
+// seconds), client IP, method, host, path and, optionally, headers:
+//
+//	{"time":"2024-05-01T12:00:00.250Z","ip":"203.0.113.7","method":"GET","host":"shop.example.com","path":"/search","headers":{"X-Api-Key":"k1"}}
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"aegisedge/filter"
+)
+
+// settings is the part of a config file the simulator uses.
+type settings struct {
+	L7RateLimit       float64                  `json:"l7_rate_limit"`
+	L7BurstLimit      int                      `json:"l7_burst_limit"`
+	L7RateLimitKey    string                   `json:"l7_rate_limit_key"`
+	RateLimitPolicies []filter.RateLimitPolicy `json:"rate_limit_policies"`
+	RateLimitJWT      filter.JWTConfig         `json:"rate_limit_jwt"`
+	Whitelist         []string                 `json:"whitelist"`
+}
+
+// logEntry is one recorded request. Common alternative field names are
+// accepted so existing access logs can be replayed as they are.
+type logEntry struct {
+	Time      any               `json:"time"`
+	TS        any               `json:"ts"`
+	Timestamp any               `json:"timestamp"`
+	IP        string            `json:"ip"`
+	ClientIP  string            `json:"client_ip"`
+	Remote    string            `json:"remote_addr"`
+	Method    string            `json:"method"`
+	Host      string            `json:"host"`
+	Path      string            `json:"path"`
+	URI       string            `json:"uri"`
+	UserAgent string            `json:"user_agent"`
+	Headers   map[string]string `json:"headers"`
+}
+
+type replayed struct {
+	at  time.Time
+	req *http.Request
+}
+
+func main() {
+	logPath := flag.String("log", "", "JSONL request log to replay")
+	pattern := flag.String("settings", "settings/*.json", "Config files whose rate limits to simulate (glob)")
+	top := flag.Int("top", 10, "Offenders to list per config")
+	asJSON := flag.Bool("json", false, "Print the reports as JSON")
+	flag.Parse()
+
+	if *logPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: ratelimit_sim -log requests.jsonl [-settings 'settings/*.json'] [-top 10] [-json]")
+		os.Exit(2)
+	}
+	files, err := filepath.Glob(*pattern)
+	if err != nil || len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "no settings files match %q\n", *pattern)
+		os.Exit(1)
+	}
+	sort.Strings(files)
+
+	requests, skipped, err := loadLog(*logPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading %s: %v\n", *logPath, err)
+		os.Exit(1)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d unparseable log lines\n", skipped)
+	}
+
+	reports := make(map[string]filter.RateLimitReport, len(files))
+	for _, file := range files {
+		sim, err := loadSimulator(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			os.Exit(1)
+		}
+		for _, r := range requests {
+			sim.Replay(r.req, r.at)
+		}
+		reports[file] = sim.Report(*top)
+		if !*asJSON {
+			printReport(file, sim.String(), reports[file])
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	}
+}
+
+func loadSimulator(path string) (*filter.RateLimitSimulator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s settings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	jwt, err := filter.NewJWTVerifier(s.RateLimitJWT)
+	if err != nil {
+		return nil, err
+	}
+	return filter.NewRateLimitSimulator(filter.RateLimitSimConfig{
+		Rate:      s.L7RateLimit,
+		Burst:     s.L7BurstLimit,
+		Key:       s.L7RateLimitKey,
+		Policies:  s.RateLimitPolicies,
+		Whitelist: s.Whitelist,
+		JWT:       jwt,
+	})
+}
+
+// loadLog parses the log and sorts it by time; the limiters need requests
+// in order.
+func loadLog(path string) ([]replayed, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var out []replayed
+	skipped := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var e logEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			skipped++
+			continue
+		}
+		r, ok := e.request()
+		if !ok {
+			skipped++
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].at.Before(out[j].at) })
+	return out, skipped, sc.Err()
+}
+
+func (e logEntry) request() (replayed, bool) {
+	at, ok := parseTime(first(e.Time, e.TS, e.Timestamp))
+	ip := firstString(e.IP, e.ClientIP, e.Remote)
+	if !ok || ip == "" {
+		return replayed{}, false
+	}
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	target := firstString(e.Path, e.URI, "/")
+	host := firstString(e.Host, "localhost")
+	req, err := http.NewRequest(firstString(e.Method, "GET"), "http://"+host+target, nil)
+	if err != nil {
+		return replayed{}, false
+	}
+	req.RemoteAddr = net.JoinHostPort(ip, "0")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	if e.UserAgent != "" {
+		req.Header.Set("User-Agent", e.UserAgent)
+	}
+	return replayed{at: at, req: req}, true
+}
+
+func parseTime(v any) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		sec := int64(v)
+		return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return parseTime(f)
+		}
+	}
+	return time.Time{}, false
+}
+
+func first(vals ...any) any {
+	for _, v := range vals {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func firstString(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func printReport(file, limits string, rep filter.RateLimitReport) {
+	fmt.Printf("== %s (%s)\n", file, limits)
+	pct := 0.0
+	if rep.Requests > 0 {
+		pct = 100 * float64(rep.Limited) / float64(rep.Requests)
+	}
+	fmt.Printf("   %d requests checked, %d limited (%.1f%%), %d keys affected\n\n", rep.Requests, rep.Limited, pct, rep.Keys)
+	if len(rep.Offenders) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "   LIMITED\tPOLICY\tACTION\tKEY\tLAST IP\tFIRST\tLAST")
+	for _, o := range rep.Offenders {
+		fmt.Fprintf(tw, "   %d\t%s\t%s\t%s\t%s\t%s\t%s\n", o.Limited, o.Policy, o.Action, o.Key, o.IP,
+			o.FirstSeen.Format(time.RFC3339), o.LastSeen.Format(time.RFC3339))
+	}
+	tw.Flush()
+	fmt.Println()
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"aegisedge/filter"
 )
 
 type Config struct {
@@ -17,24 +19,85 @@ type Config struct {
 	L3Blacklist      []string          `json:"l3_blacklist"`
 	Whitelist        []string          `json:"whitelist"`
 	L4ConnLimit      int          `json:"l4_conn_limit"`
+	// Per-subnet (/24, /64 by default) and global concurrent connection caps
+	L4SubnetConnLimit int                        `json:"l4_subnet_conn_limit"`
+	L4GlobalConnLimit int                        `json:"l4_global_conn_limit"`
+	L4IPv4Prefix      int                        `json:"l4_ipv4_prefix"`
+	L4IPv6Prefix      int                        `json:"l4_ipv6_prefix"`
+	L4PortLimits      map[string]filter.L4Limits `json:"l4_port_limits"` // keyed by listen/tcp port
+	// New HTTP connections per second (and burst) per IP, checked at accept
+	L4ConnRate        float64 `json:"l4_conn_rate"`
+	L4ConnBurst       int     `json:"l4_conn_burst"`
+	HTTPHeaderTimeout int     `json:"http_header_timeout"` // seconds to deliver request headers
+	// Slowloris / slow-read: minimum bytes/sec while waiting on the client
+	SlowClientRecvRate int `json:"slow_client_recv_rate"`
+	SlowClientSendRate int `json:"slow_client_send_rate"`
+	SlowClientGrace    int `json:"slow_client_grace"` // seconds
+	// PROXY protocol: accepted from trusted proxies on listen_ports, and
+	// sent (version 1 or 2, 0 = off) to HTTP and tcp_ports upstreams
+	ProxyProtocol        bool `json:"proxy_protocol"`
+	SendProxyProtocol    int  `json:"send_proxy_protocol"`
+	TCPSendProxyProtocol int  `json:"tcp_send_proxy_protocol"`
+	// TLS passthrough: tcp_ports routed by ClientHello server name, keyed by port
+	TLSPassthrough map[string]filter.TLSPassthroughConfig `json:"tls_passthrough"`
+	// Upstreams of tcp_ports other than 127.0.0.1:<port>, keyed by port
+	StreamRoutes map[string]filter.StreamRouteConfig `json:"stream_routes"`
 	L7RateLimit      float64      `json:"l7_rate_limit"`
 	L7BurstLimit     int          `json:"l7_burst_limit"`
+	// Per-route limits, tried in order before the default l7 bucket
+	RateLimitPolicies []filter.RateLimitPolicy `json:"rate_limit_policies"`
+	// Bucket key expressions (ip, header:X-Api-Key, jwt:sub, ip+path...)
+	L7RateLimitKey string           `json:"l7_rate_limit_key"`
+	AnomalyKey     string           `json:"anomaly_key"`
+	RateLimitJWT   filter.JWTConfig `json:"rate_limit_jwt"` // verifies jwt: key claims
 	GeoIPDBPath      string       `json:"geoip_db_path"`
 	BlockedCountries []string     `json:"blocked_countries"`
+	AllowedCountries []string          `json:"allowed_countries"` // allow-only mode when set
+	GeoIPAction      string            `json:"geoip_action"`      // block, challenge or rate_limit
+	GeoIPRateLimit   float64           `json:"geoip_rate_limit"`
+	GeoIPBurstLimit  int               `json:"geoip_burst_limit"`
+	GeoRules         []filter.GeoRule  `json:"geo_rules"`
+	// Pass X-Aegis-Country / X-Aegis-ASN to the upstream
+	GeoIPUpstreamHeaders bool `json:"geoip_upstream_headers"`
+
+	// ASN policies (GeoLite2-ASN database)
+	ASNDBPath     string                `json:"asn_db_path"`
+	BlockedASNs   []string              `json:"blocked_asns"`
+	AllowedASNs   []string              `json:"allowed_asns"`
+	ASNRateLimits []filter.ASNRateLimit `json:"asn_rate_limits"`
+
 	HypervisorMode   bool         `json:"hypervisor_mode"`
 	HotTakeover      bool         `json:"hot_takeover"`
 	SSLCertPath      string       `json:"ssl_cert_path"`
 	SSLKeyPath       string            `json:"ssl_key_path"`
 	LogLevel         string            `json:"log_level"`
+	WAFRulesPath     string            `json:"waf_rules_path"`
+	WAFMode          string            `json:"waf_mode"`
+	WAFParanoiaLevel int               `json:"waf_paranoia_level"`
+	WAFThreshold     int               `json:"waf_inbound_threshold"`
+	WAFMaxBodyBytes  int               `json:"waf_max_body_bytes"`
+	WAFMaxJSONDepth  int               `json:"waf_max_json_depth"`
+	WAFMaxFields     int               `json:"waf_max_fields"`
+
+	// Response inspection (toggles.response_inspection)
+	ResponseLeakActions  map[string]string `json:"response_leak_actions"`
+	ResponseMaxBytes     int64             `json:"response_inspection_max_bytes"`
+	ResponseContentTypes []string          `json:"response_inspection_content_types"`
+
+	// Threat-intel IP/CIDR feeds loaded into the L3 blacklist
+	ThreatFeeds []filter.ThreatFeedConfig `json:"threat_feeds"`
 	Toggles          FeatureFlags      `json:"toggles"`
 }
 
 type FeatureFlags struct {
-	WAF       bool `json:"waf"`
-	GeoIP     bool `json:"geoip"`
-	Challenge bool `json:"challenge"`
-	Anomaly   bool `json:"anomaly"`
-	Stats     bool `json:"stats"`
+	WAF                bool `json:"waf"`
+	WAFDetectOnly      bool `json:"waf_detect_only"`
+	GeoIP              bool `json:"geoip"`
+	Challenge          bool `json:"challenge"`
+	Anomaly            bool `json:"anomaly"`
+	Stats              bool `json:"stats"`
+	ResponseInspection bool `json:"response_inspection"`
+	RateLimitShadow    bool `json:"rate_limit_shadow"` // count L7 rate limit hits, never enforce
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -42,6 +105,16 @@ func LoadConfig(path string) (*Config, error) {
 	cfg := Config{
 		UpstreamAddr: "http://localhost:3000",
 		ListenPorts:  []int{8080},
+		WAFRulesPath:     "waf_rules.json",
+		WAFMode:          "immediate",
+		WAFParanoiaLevel: 1,
+		WAFThreshold:     5,
+		WAFMaxBodyBytes:  65536,
+		WAFMaxJSONDepth:  32,
+		WAFMaxFields:     256,
+		ResponseMaxBytes: 1 << 20,
+		HTTPHeaderTimeout: 2,
+		SlowClientGrace:   5,
 		Toggles: FeatureFlags{
 			WAF:       true,
 			GeoIP:     true,
@@ -118,18 +191,96 @@ func LoadConfig(path string) (*Config, error) {
 	if val := os.Getenv("AEGISEDGE_L4_CONN_LIMIT"); val != "" {
 		fmt.Sscanf(val, "%d", &cfg.L4ConnLimit)
 	}
+	if val := os.Getenv("AEGISEDGE_L4_SUBNET_CONN_LIMIT"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.L4SubnetConnLimit)
+	}
+	if val := os.Getenv("AEGISEDGE_L4_GLOBAL_CONN_LIMIT"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.L4GlobalConnLimit)
+	}
+	if val := os.Getenv("AEGISEDGE_L4_CONN_RATE"); val != "" {
+		fmt.Sscanf(val, "%f", &cfg.L4ConnRate)
+	}
+	if val := os.Getenv("AEGISEDGE_HTTP_HEADER_TIMEOUT"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.HTTPHeaderTimeout)
+	}
+	if val := os.Getenv("AEGISEDGE_SLOW_CLIENT_RECV_RATE"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.SlowClientRecvRate)
+	}
+	if val := os.Getenv("AEGISEDGE_SLOW_CLIENT_SEND_RATE"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.SlowClientSendRate)
+	}
+	if val := os.Getenv("AEGISEDGE_PROXY_PROTOCOL"); val != "" {
+		cfg.ProxyProtocol = (val == "true" || val == "1")
+	}
+	if val := os.Getenv("AEGISEDGE_SEND_PROXY_PROTOCOL"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.SendProxyProtocol)
+	}
+	if val := os.Getenv("AEGISEDGE_TCP_SEND_PROXY_PROTOCOL"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.TCPSendProxyProtocol)
+	}
 	if val := os.Getenv("AEGISEDGE_L7_RATE_LIMIT"); val != "" {
 		fmt.Sscanf(val, "%f", &cfg.L7RateLimit)
 	}
 	if val := os.Getenv("AEGISEDGE_L7_BURST_LIMIT"); val != "" {
 		fmt.Sscanf(val, "%d", &cfg.L7BurstLimit)
 	}
+	if val := os.Getenv("AEGISEDGE_L7_RATE_LIMIT_KEY"); val != "" {
+		cfg.L7RateLimitKey = val
+	}
+	if val := os.Getenv("AEGISEDGE_RATE_LIMIT_JWT_SECRET"); val != "" {
+		cfg.RateLimitJWT.Secret = val
+	}
 	if val := os.Getenv("AEGISEDGE_GEOIP_DB"); val != "" {
 		cfg.GeoIPDBPath = val
 	}
 	if val := os.Getenv("AEGISEDGE_BLOCKED_COUNTRIES"); val != "" {
 		cfg.BlockedCountries = strings.Split(val, ",")
 	}
+	if val := os.Getenv("AEGISEDGE_ALLOWED_COUNTRIES"); val != "" {
+		cfg.AllowedCountries = strings.Split(val, ",")
+	}
+	if val := os.Getenv("AEGISEDGE_GEOIP_UPSTREAM_HEADERS"); val != "" {
+		cfg.GeoIPUpstreamHeaders = (val == "true" || val == "1")
+	}
+	if val := os.Getenv("AEGISEDGE_GEOIP_ACTION"); val != "" {
+		cfg.GeoIPAction = val
+	}
+	if val := os.Getenv("AEGISEDGE_ASN_DB"); val != "" {
+		cfg.ASNDBPath = val
+	}
+	if val := os.Getenv("AEGISEDGE_BLOCKED_ASNS"); val != "" {
+		cfg.BlockedASNs = strings.Split(val, ",")
+	}
+	if val := os.Getenv("AEGISEDGE_WAF_RULES"); val != "" {
+		cfg.WAFRulesPath = val
+	}
+	if val := os.Getenv("AEGISEDGE_WAF_MODE"); val != "" {
+		cfg.WAFMode = val
+	}
+	if val := os.Getenv("AEGISEDGE_WAF_PARANOIA_LEVEL"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.WAFParanoiaLevel)
+	}
+	if val := os.Getenv("AEGISEDGE_WAF_INBOUND_THRESHOLD"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.WAFThreshold)
+	}
+	if val := os.Getenv("AEGISEDGE_WAF_MAX_BODY_BYTES"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.WAFMaxBodyBytes)
+	}
+	if val := os.Getenv("AEGISEDGE_WAF_MAX_JSON_DEPTH"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.WAFMaxJSONDepth)
+	}
+	if val := os.Getenv("AEGISEDGE_WAF_MAX_FIELDS"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.WAFMaxFields)
+	}
+	if val := os.Getenv("AEGISEDGE_RESPONSE_INSPECTION"); val != "" {
+		cfg.Toggles.ResponseInspection = (val == "true" || val == "1")
+	}
+	if val := os.Getenv("AEGISEDGE_RATE_LIMIT_SHADOW"); val != "" {
+		cfg.Toggles.RateLimitShadow = (val == "true" || val == "1")
+	}
+	if val := os.Getenv("AEGISEDGE_RESPONSE_MAX_BYTES"); val != "" {
+		fmt.Sscanf(val, "%d", &cfg.ResponseMaxBytes)
+	}
 
 	return &cfg, nil
 }
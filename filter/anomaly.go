@@ -14,7 +14,9 @@ import (
 type AnomalyDetector struct {
 	HeavyURLs map[string]bool
 	Threshold int
-	store     store.Storer
+	// Key groups requests into counters; nil counts per client IP.
+	Key   *RateLimitKey
+	store store.Storer
 }
 
 func NewAnomalyDetector(heavyURLs []string, threshold int, s store.Storer) *AnomalyDetector {
@@ -33,14 +35,15 @@ func (d *AnomalyDetector) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		host := util.GetRealIP(r)
 		path := r.URL.Path
+		id := d.Key.Key(r)
 
 		// Unified Anomaly Detection
-		key := fmt.Sprintf("anomaly:stats:%s:%s", host, path)
+		key := fmt.Sprintf("anomaly:stats:%s:%s", id, path)
 		count, err := d.store.Increment(key, 10*time.Minute)
 		if err == nil {
 			if d.HeavyURLs[path] && int(count) > d.Threshold {
 				logger.Warn("Anomaly detected: High frequency on heavy URL",
-					"remote_addr", host, "path", path, "count", count)
+					"remote_addr", host, "key", id, "path", path, "count", count)
 				BlockedRequests.WithLabelValues("L7", "anomaly_heavy_url").Inc()
 				http.Error(w, "Anomalous traffic detected", http.StatusTooManyRequests)
 				return
@@ -48,10 +51,10 @@ func (d *AnomalyDetector) Middleware(next http.Handler) http.Handler {
 
 			// Entropy Analysis: Detects behavior where a client repeatedly accesses a single resource,
 			// which is characteristic of certain automated tools.
-			entropyKey := "anomaly:entropy:" + host
+			entropyKey := "anomaly:entropy:" + id
 			entropyCount, _ := d.store.Increment(entropyKey, 1*time.Minute)
 			if int(entropyCount) > d.Threshold*3 {
-				logger.Warn("Anomaly detected: Behavioral lock-on", "remote_addr", host)
+				logger.Warn("Anomaly detected: Behavioral lock-on", "remote_addr", host, "key", id)
 				BlockedRequests.WithLabelValues("L7", "low_entropy").Inc()
 				http.Error(w, "Access Denied: Anomalous behavioral pattern", http.StatusForbidden)
 				return
@@ -0,0 +1,226 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aegisedge/logger"
+	"aegisedge/util"
+)
+
+// ASNRateLimit is a rate limit for traffic from matching networks. By
+// default every address in a matching ASN shares one bucket, which reins in
+// a hosting provider's whole fleet; PerIP gives each address its own bucket
+// at this (usually lower than l7_rate_limit) rate instead.
+type ASNRateLimit struct {
+	ASNs  []string `json:"asns"` // "AS16509", "16509" or an org name
+	Rate  float64  `json:"rate"`
+	Burst int      `json:"burst"`
+	PerIP bool     `json:"per_ip,omitempty"`
+}
+
+// ASNConfig configures an ASNFilter.
+type ASNConfig struct {
+	Blocked    []string
+	Allowed    []string // exempt from Blocked and RateLimits
+	RateLimits []ASNRateLimit
+	Whitelist  *IPSet
+}
+
+// ASNFilter resolves the client's autonomous system from a GeoLite2-ASN
+// database, blocks or rate-limits by ASN number or organization name, and
+// records the ASN on the request for later layers and the request log.
+type ASNFilter struct {
+	db        *geoDB
+	lookup    func(net.IP) (uint, string, bool)
+	blocked   asnMatcher
+	allowed   asnMatcher
+	policies  []*asnPolicy
+	whitelist *IPSet
+	stop      chan struct{}
+}
+
+// asnMatcher matches AS numbers exactly and organization names by
+// case-insensitive substring, so "digitalocean" matches "DIGITALOCEAN-ASN".
+type asnMatcher struct {
+	numbers map[uint]bool
+	orgs    []string
+}
+
+type asnPolicy struct {
+	ASNRateLimit
+	match    asnMatcher
+	limiters *keyedLimiters
+}
+
+func NewASNFilter(dbPath string, cfg ASNConfig) (*ASNFilter, error) {
+	f := &ASNFilter{
+		blocked:   newASNMatcher(cfg.Blocked),
+		allowed:   newASNMatcher(cfg.Allowed),
+		whitelist: cfg.Whitelist,
+		stop:      make(chan struct{}),
+	}
+	for i, rl := range cfg.RateLimits {
+		if len(rl.ASNs) == 0 {
+			return nil, fmt.Errorf("asn_rate_limits[%d]: no asns", i)
+		}
+		if rl.Rate <= 0 || rl.Burst <= 0 {
+			return nil, fmt.Errorf("asn_rate_limits[%d]: rate and burst must be positive", i)
+		}
+		f.policies = append(f.policies, &asnPolicy{
+			ASNRateLimit: rl,
+			match:        newASNMatcher(rl.ASNs),
+			limiters:     newKeyedLimiters(rl.Rate, rl.Burst),
+		})
+	}
+
+	f.db = openGeoDB(dbPath, geoDBReloadInterval)
+	if dbPath != "" && f.db.Status().Status != "loaded" {
+		logger.Warn("ASN filter bypassed: Database file not found", "path", dbPath, "tip", "Download GeoLite2-ASN.mmdb from MaxMind to enable ASN policies")
+	}
+	f.lookup = func(ip net.IP) (uint, string, bool) {
+		db := f.db.Reader()
+		if db == nil {
+			return 0, "", false
+		}
+		rec, err := db.ASN(ip)
+		if err != nil || rec.AutonomousSystemNumber == 0 {
+			return 0, "", false
+		}
+		return rec.AutonomousSystemNumber, rec.AutonomousSystemOrganization, true
+	}
+
+	if len(f.policies) > 0 {
+		go f.cleanupLoop()
+	}
+	return f, nil
+}
+
+func newASNMatcher(entries []string) asnMatcher {
+	m := asnMatcher{numbers: make(map[uint]bool)}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		digits := e
+		if len(e) > 2 && strings.EqualFold(e[:2], "AS") {
+			digits = e[2:]
+		}
+		if n, err := strconv.ParseUint(digits, 10, 32); err == nil {
+			m.numbers[uint(n)] = true
+			continue
+		}
+		m.orgs = append(m.orgs, strings.ToLower(e))
+	}
+	return m
+}
+
+func (m asnMatcher) matches(num uint, org string) bool {
+	if m.numbers[num] {
+		return true
+	}
+	if len(m.orgs) == 0 || org == "" {
+		return false
+	}
+	org = strings.ToLower(org)
+	for _, o := range m.orgs {
+		if strings.Contains(org, o) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the AS number and organization for ip.
+func (f *ASNFilter) Lookup(ip string) (uint, string, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0, "", false
+	}
+	return f.lookup(parsed)
+}
+
+// DBStatus reports the ASN database's state and build date.
+func (f *ASNFilter) DBStatus() GeoDBStatus {
+	return f.db.Status()
+}
+
+// Stop cancels the database watcher and limiter cleanup goroutines.
+func (f *ASNFilter) Stop() {
+	f.db.Stop()
+	close(f.stop)
+}
+
+func (f *ASNFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The header is ours; never trust one sent by the client
+		r.Header.Del(util.ASNHeader)
+
+		host := util.GetRealIP(r)
+		num, org, ok := f.Lookup(host)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		asn := "AS" + strconv.FormatUint(uint64(num), 10)
+		util.SetASN(r, asn)
+
+		if f.whitelist.Contains(host) || f.allowed.matches(num, org) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if f.blocked.matches(num, org) {
+			logger.Warn("Blocked request from restricted network", "remote_addr", host, "asn", asn, "asn_org", org)
+			if MetricsEnabled() {
+				BlockedRequests.WithLabelValues("L7", "asn").Inc()
+				ASNBlockedRequests.WithLabelValues(asn, "asn").Inc()
+			}
+			http.Error(w, "Access Denied: Network Restricted", http.StatusForbidden)
+			return
+		}
+
+		for _, p := range f.policies {
+			if !p.match.matches(num, org) {
+				continue
+			}
+			key := asn
+			if p.PerIP {
+				key += "|" + host
+			}
+			if !p.limiters.allow(key) {
+				logger.Warn("ASN rate limit exceeded", "remote_addr", host, "asn", asn, "asn_org", org, "per_ip", p.PerIP)
+				if MetricsEnabled() {
+					BlockedRequests.WithLabelValues("L7", "asn_rate_limit").Inc()
+					ASNBlockedRequests.WithLabelValues(asn, "asn_rate_limit").Inc()
+				}
+				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			break // first matching policy wins
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cleanupLoop drops buckets that have been idle for ten minutes.
+func (f *ASNFilter) cleanupLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, p := range f.policies {
+				p.limiters.purge(10 * time.Minute)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
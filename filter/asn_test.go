@@ -0,0 +1,132 @@
+package filter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"aegisedge/util"
+)
+
+// fakeASNs stands in for a GeoLite2-ASN database.
+func fakeASNs(ip net.IP) (uint, string, bool) {
+	switch ip.String() {
+	case "192.0.2.1", "192.0.2.2":
+		return 14061, "DIGITALOCEAN-ASN", true
+	case "198.51.100.1":
+		return 16509, "AMAZON-02", true
+	case "198.51.100.2":
+		return 14618, "AMAZON-AES", true
+	case "203.0.113.1", "203.0.113.2":
+		return 24940, "Hetzner Online GmbH", true
+	}
+	return 0, "", false
+}
+
+func newTestASNFilter(t *testing.T, cfg ASNConfig) *ASNFilter {
+	t.Helper()
+	f, err := NewASNFilter("", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Stop)
+	f.lookup = fakeASNs
+	return f
+}
+
+func TestASNFilterBlockAndAllow(t *testing.T) {
+	f := newTestASNFilter(t, ASNConfig{
+		Blocked:   []string{"AS14061", "amazon"},
+		Allowed:   []string{"14618"},
+		Whitelist: NewIPSet([]string{"192.0.2.2"}),
+	})
+
+	var seenASN string
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenASN = util.GetASN(r)
+	}))
+
+	tests := []struct {
+		ip      string
+		spoof   string
+		want    int
+		wantASN string
+	}{
+		{"192.0.2.1", "", http.StatusForbidden, "AS14061"},    // by number
+		{"198.51.100.1", "", http.StatusForbidden, "AS16509"}, // by org substring
+		{"198.51.100.2", "", http.StatusOK, "AS14618"},        // allowed overrides the org match
+		{"192.0.2.2", "", http.StatusOK, "AS14061"},           // whitelisted address
+		{"203.0.113.1", "", http.StatusOK, "AS24940"},         // not listed
+		{"233.252.0.1", "AS1", http.StatusOK, ""},             // unknown: client header dropped
+	}
+	for _, tt := range tests {
+		seenASN = ""
+		req := httptest.NewRequest("GET", "/", nil)
+		util.SetRealIP(req, tt.ip)
+		if tt.spoof != "" {
+			req.Header.Set(util.ASNHeader, tt.spoof)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.ip, rr.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && seenASN != tt.wantASN {
+			t.Errorf("%s: downstream saw ASN %q, want %q", tt.ip, seenASN, tt.wantASN)
+		}
+	}
+}
+
+func TestASNFilterRateLimits(t *testing.T) {
+	f := newTestASNFilter(t, ASNConfig{
+		RateLimits: []ASNRateLimit{
+			{ASNs: []string{"AS14061"}, Rate: 0.001, Burst: 2},
+			{ASNs: []string{"hetzner"}, Rate: 0.001, Burst: 1, PerIP: true},
+		},
+	})
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	status := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		util.SetRealIP(req, ip)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Both DigitalOcean addresses draw from one bucket of 2
+	if status("192.0.2.1") != http.StatusOK || status("192.0.2.2") != http.StatusOK {
+		t.Fatal("burst should be allowed")
+	}
+	if status("192.0.2.1") != http.StatusTooManyRequests {
+		t.Error("the ASN's shared bucket should be empty")
+	}
+
+	// Hetzner addresses each get their own bucket of 1
+	if status("203.0.113.1") != http.StatusOK || status("203.0.113.2") != http.StatusOK {
+		t.Error("per-IP buckets should be independent")
+	}
+	if status("203.0.113.1") != http.StatusTooManyRequests {
+		t.Error("per-IP bucket should be empty")
+	}
+
+	// Unmatched networks are untouched
+	for i := 0; i < 5; i++ {
+		if status("198.51.100.1") != http.StatusOK {
+			t.Fatal("AS16509 has no policy")
+		}
+	}
+}
+
+func TestNewASNFilterValidates(t *testing.T) {
+	for _, rl := range []ASNRateLimit{
+		{Rate: 1, Burst: 1},
+		{ASNs: []string{"AS1"}, Rate: 0, Burst: 1},
+		{ASNs: []string{"AS1"}, Rate: 1, Burst: 0},
+	} {
+		if _, err := NewASNFilter("", ASNConfig{RateLimits: []ASNRateLimit{rl}}); err == nil {
+			t.Errorf("NewASNFilter should reject %+v", rl)
+		}
+	}
+}
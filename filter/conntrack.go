@@ -0,0 +1,255 @@
+package filter
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aegisedge/logger"
+)
+
+// ConnTrackerConfig configures a ConnTracker.
+type ConnTrackerConfig struct {
+	Rate  float64 // new connections/sec per IP; 0 disables
+	Burst int
+	// HeaderTimeout bounds how long a connection may take to deliver the
+	// headers of each request, including the first. Installed on the
+	// server by Serve; 0 leaves the server's own setting.
+	HeaderTimeout time.Duration
+	// Exempt reports peers that are not counted, such as trusted load
+	// balancers whose connections carry many clients. Behind
+	// ServeProxyProtocol, a connection whose header names a client is
+	// admitted as that client instead.
+	Exempt func(ip string) bool
+}
+
+// ConnStats is a snapshot of a ConnTracker's connections.
+type ConnStats struct {
+	Open        int64  `json:"open"`
+	Active      int64  `json:"active"` // serving a request
+	Idle        int64  `json:"idle"`   // keep-alive, between requests
+	Accepted    uint64 `json:"accepted"`
+	RateLimited uint64 `json:"rate_limited"`
+	Rejected    uint64 `json:"rejected"` // over an L4 connection limit
+}
+
+// ConnTracker applies L4 limits to the TCP connections an http.Server
+// accepts, rather than to the requests on them: keep-alive and idle
+// connections hold their slot until they close, and clients that never
+// finish a request are refused once they reach their limit. Connections
+// over a limit are closed before the server sees them, or, for a trusted
+// balancer's, as soon as their PROXY header has been read.
+type ConnTracker struct {
+	l4            *L4Filter
+	rate          *keyedLimiters
+	headerTimeout time.Duration
+	exempt        func(string) bool
+
+	states   sync.Map // net.Conn -> http.ConnState
+	open     atomic.Int64
+	active   atomic.Int64
+	idle     atomic.Int64
+	accepted atomic.Uint64
+	limited  atomic.Uint64
+	rejected atomic.Uint64
+	stop     chan struct{}
+}
+
+func NewConnTracker(l4 *L4Filter, cfg ConnTrackerConfig) *ConnTracker {
+	t := &ConnTracker{
+		l4:            l4,
+		headerTimeout: cfg.HeaderTimeout,
+		exempt:        cfg.Exempt,
+		stop:          make(chan struct{}),
+	}
+	if cfg.Rate > 0 && cfg.Burst > 0 {
+		t.rate = newKeyedLimiters(cfg.Rate, cfg.Burst)
+		go t.cleanupLoop()
+	}
+	return t
+}
+
+// Serve installs the tracker on srv and wraps ln, which srv then serves.
+// For HTTPS, pass the result to srv.ServeTLS: the handshake then runs on
+// an already admitted connection.
+func (t *ConnTracker) Serve(srv *http.Server, ln net.Listener) net.Listener {
+	if t.headerTimeout > 0 {
+		srv.ReadHeaderTimeout = t.headerTimeout
+	}
+	srv.ConnState = t.ConnState
+	return &trackedListener{Listener: ln, t: t}
+}
+
+// Stats returns the tracker's counters.
+func (t *ConnTracker) Stats() ConnStats {
+	return ConnStats{
+		Open:        t.open.Load(),
+		Active:      t.active.Load(),
+		Idle:        t.idle.Load(),
+		Accepted:    t.accepted.Load(),
+		RateLimited: t.limited.Load(),
+		Rejected:    t.rejected.Load(),
+	}
+}
+
+// Stop cancels the limiter cleanup goroutine.
+func (t *ConnTracker) Stop() {
+	close(t.stop)
+}
+
+// admit decides whether a connection from addr may be served, and whether
+// it holds an L4 slot.
+func (t *ConnTracker) admit(addr string) (ok, counted bool) {
+	host := splitL4Host(addr)
+	if t.exempt != nil && t.exempt(host) {
+		t.accepted.Add(1)
+		return true, false
+	}
+
+	if t.rate != nil && !t.l4.Whitelist.Contains(host) && !t.rate.allow(host) {
+		t.limited.Add(1)
+		logger.Warn("L4 new-connection rate exceeded", "ip", host)
+		if MetricsEnabled() {
+			BlockedRequests.WithLabelValues("L4", "conn_rate").Inc()
+		}
+		return false, false
+	}
+	if reason := t.l4.Admit(addr); reason != "" {
+		t.rejected.Add(1)
+		if MetricsEnabled() {
+			BlockedRequests.WithLabelValues("L4", reason).Inc()
+		}
+		return false, false
+	}
+	t.accepted.Add(1)
+	return true, true
+}
+
+// ConnState keeps the active/idle counts. It is installed by Serve.
+func (t *ConnTracker) ConnState(c net.Conn, state http.ConnState) {
+	prev, _ := t.states.Load(c)
+	t.gauge(prev, -1)
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		// A hijacked connection (WebSocket) keeps its L4 slot until the
+		// handler closes it, but is no longer the server's to count.
+		t.states.Delete(c)
+	default:
+		t.states.Store(c, state)
+		t.gauge(state, 1)
+	}
+}
+
+func (t *ConnTracker) gauge(state any, delta int64) {
+	switch state {
+	case http.StateActive:
+		t.active.Add(delta)
+		if MetricsEnabled() {
+			HTTPConnections.WithLabelValues("active").Add(float64(delta))
+		}
+	case http.StateIdle:
+		t.idle.Add(delta)
+		if MetricsEnabled() {
+			HTTPConnections.WithLabelValues("idle").Add(float64(delta))
+		}
+	}
+}
+
+// cleanupLoop drops rate buckets that have been idle for ten minutes.
+func (t *ConnTracker) cleanupLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.rate.purge(10 * time.Minute)
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+type trackedListener struct {
+	net.Listener
+	t *ConnTracker
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tc := &trackedConn{Conn: c, t: l.t, addr: c.RemoteAddr().String()}
+		if pc, _ := c.(*proxyConn); pc != nil && pc.proxied() {
+			// The client is known once the header has been read
+			tc.pending = pc
+		} else if ok, counted := l.t.admit(tc.addr); ok {
+			tc.counted = counted
+		} else {
+			c.Close()
+			continue
+		}
+		l.t.open.Add(1)
+		return tc, nil
+	}
+}
+
+var errConnRejected = errors.New("connection over L4 limit")
+
+// trackedConn gives its L4 slot back when it is closed, whoever closes it.
+type trackedConn struct {
+	net.Conn
+	t       *ConnTracker
+	addr    string // the address the slot is held for
+	counted bool
+	once    sync.Once
+
+	// pending is set for a trusted balancer's connection, admitted on its
+	// first read as the client its PROXY header names.
+	pending   *proxyConn
+	admitOnce sync.Once
+	err       error
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	if c.pending != nil {
+		c.admitOnce.Do(c.admitProxied)
+		if c.err != nil {
+			return 0, c.err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *trackedConn) admitProxied() {
+	if err := c.pending.resolve(); err != nil {
+		c.err = err
+		return
+	}
+	c.addr = c.pending.clientAddr().String()
+	ok, counted := c.t.admit(c.addr)
+	if !ok {
+		// A read error, so the server drops the connection without a reply
+		c.err = &net.OpError{Op: "read", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: errConnRejected}
+		return
+	}
+	c.counted = counted
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	// Wait out an admission in progress, which the close has unblocked, and
+	// stop a later one
+	c.admitOnce.Do(func() {})
+	c.once.Do(func() {
+		c.t.open.Add(-1)
+		if c.counted {
+			c.t.l4.ReleaseConnection(c.addr)
+		}
+	})
+	return err
+}
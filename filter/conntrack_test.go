@@ -0,0 +1,194 @@
+package filter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// startTracked serves an OK handler behind a ConnTracker.
+func startTracked(t *testing.T, l4 *L4Filter, cfg ConnTrackerConfig) (*httptest.Server, *ConnTracker) {
+	t.Helper()
+	tracker := NewConnTracker(l4, cfg)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Listener = tracker.Serve(srv.Config, srv.Listener)
+	srv.Start()
+	t.Cleanup(func() {
+		srv.Close()
+		tracker.Stop()
+	})
+	return srv, tracker
+}
+
+// closedByServer reports whether the server hangs up on c within wait.
+func closedByServer(t *testing.T, c net.Conn, wait time.Duration) bool {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(wait))
+	_, err := io.Copy(io.Discard, c)
+	return !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func dial(t *testing.T, srv *httptest.Server) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConnTrackerCountsIdleConnections(t *testing.T) {
+	l4 := NewL4Filter(1, nil)
+	srv, tracker := startTracked(t, l4, ConnTrackerConfig{})
+
+	// An idle connection that never sends a request still holds the slot
+	first := dial(t, srv)
+	if closedByServer(t, first, 100*time.Millisecond) {
+		t.Fatal("first connection should be accepted")
+	}
+	second := dial(t, srv)
+	if !closedByServer(t, second, time.Second) {
+		t.Error("second connection from the same IP should be closed")
+	}
+	if st := tracker.Stats(); st.Rejected != 1 || st.Open != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for tracker.Stats().Open != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := l4.conns.count("l4:conn:127.0.0.1"); n != 0 {
+		t.Errorf("slot not released on close, count = %d", n)
+	}
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request after release failed: %v", err)
+	}
+	resp.Body.Close()
+	if st := tracker.Stats(); st.Idle != 1 {
+		t.Errorf("keep-alive connection should be idle, got %+v", st)
+	}
+}
+
+func TestConnTrackerHijackedConnectionHoldsSlot(t *testing.T) {
+	l4 := NewL4Filter(1, nil)
+	tracker := NewConnTracker(l4, ConnTrackerConfig{})
+	defer tracker.Stop()
+	// A WebSocket-style handler that keeps the connection until the client leaves
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\n\r\n")
+		io.Copy(io.Discard, c)
+		c.Close()
+	}))
+	srv.Listener = tracker.Serve(srv.Config, srv.Listener)
+	srv.Start()
+	defer srv.Close()
+
+	ws := dial(t, srv)
+	io.WriteString(ws, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ws.Read(make([]byte, 64)); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if !closedByServer(t, dial(t, srv), time.Second) {
+		t.Error("second connection admitted while the hijacked one is open")
+	}
+	if n := l4.conns.count("l4:conn:127.0.0.1"); n != 1 {
+		t.Errorf("hijacked connection count = %d, want 1", n)
+	}
+
+	ws.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for l4.conns.count("l4:conn:127.0.0.1") != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := l4.conns.count("l4:conn:127.0.0.1"); n != 0 {
+		t.Errorf("slot not released when the hijacked connection closed, count = %d", n)
+	}
+}
+
+func TestConnTrackerNewConnectionRate(t *testing.T) {
+	srv, tracker := startTracked(t, NewL4Filter(0, nil), ConnTrackerConfig{Rate: 0.001, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		if closedByServer(t, dial(t, srv), 50*time.Millisecond) {
+			t.Fatalf("connection %d should be within the burst", i)
+		}
+	}
+	if !closedByServer(t, dial(t, srv), time.Second) {
+		t.Error("third connection should exceed the rate")
+	}
+	if st := tracker.Stats(); st.RateLimited != 1 || st.Accepted != 2 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestConnTrackerExempt(t *testing.T) {
+	l4 := NewL4Filter(1, nil)
+	srv, _ := startTracked(t, l4, ConnTrackerConfig{
+		Exempt: func(ip string) bool { return ip == "127.0.0.1" },
+	})
+	for i := 0; i < 3; i++ {
+		if closedByServer(t, dial(t, srv), 50*time.Millisecond) {
+			t.Fatalf("exempt peer connection %d was refused", i)
+		}
+	}
+	if n := l4.conns.count("l4:conn:127.0.0.1"); n != 0 {
+		t.Errorf("exempt peer should not be counted, count = %d", n)
+	}
+}
+
+func TestConnTrackerHeaderTimeout(t *testing.T) {
+	srv, _ := startTracked(t, NewL4Filter(0, nil), ConnTrackerConfig{HeaderTimeout: 100 * time.Millisecond})
+
+	c := dial(t, srv)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\n") // never finishes
+	if !closedByServer(t, c, 2*time.Second) {
+		t.Error("slow header sender should be disconnected")
+	}
+}
+
+func TestConnTrackerAdmitsProxiedClient(t *testing.T) {
+	l4 := NewL4Filter(1, nil)
+	trusted := func(ip string) bool { return ip == "127.0.0.1" }
+	tracker := NewConnTracker(l4, ConnTrackerConfig{Exempt: trusted})
+	defer tracker.Stop()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Listener = tracker.Serve(srv.Config, ServeProxyProtocol(srv.Config, srv.Listener, trusted))
+	srv.Start()
+	defer srv.Close()
+
+	// The balancer is exempt, but each client it names is held to its limit
+	proxied := func(client string) net.Conn {
+		c := dial(t, srv)
+		io.WriteString(c, "PROXY TCP4 "+client+" 10.0.0.1 50000 80\r\n")
+		return c
+	}
+	if closedByServer(t, proxied("203.0.113.7"), 100*time.Millisecond) {
+		t.Fatal("first proxied connection should be admitted")
+	}
+	if !closedByServer(t, proxied("203.0.113.7"), time.Second) {
+		t.Error("second connection for the same client should be closed")
+	}
+	if closedByServer(t, proxied("203.0.113.8"), 100*time.Millisecond) {
+		t.Error("another client behind the balancer was refused")
+	}
+	if n := l4.conns.count("l4:conn:203.0.113.7"); n != 1 {
+		t.Errorf("client count = %d, want 1", n)
+	}
+	if n := l4.conns.count("l4:conn:127.0.0.1"); n != 0 {
+		t.Errorf("balancer counted, count = %d", n)
+	}
+}
@@ -0,0 +1,141 @@
+package filter
+
+import (
+	"sync"
+	"time"
+
+	"aegisedge/logger"
+	"aegisedge/store"
+)
+
+// storeLeaseTTL is how long tokens leased from the store may be spent
+// locally. Unspent tokens are forfeited, which errs on the strict side.
+const storeLeaseTTL = 250 * time.Millisecond
+
+// maxStoreLease caps how many tokens one round-trip leases.
+const maxStoreLease = 50
+
+// storeLimiter keeps rate limit buckets in the Storer, so every node
+// sharing a Redis store draws from the same bucket. To keep the hot path
+// off the network it leases a few tokens per round-trip and spends them
+// locally, and remembers a denial until the bucket has room again.
+type storeLimiter struct {
+	store  store.Storer
+	prefix string
+	shards [numShards]*leaseShard
+}
+
+type leaseShard struct {
+	mu      sync.Mutex
+	entries map[string]*leaseEntry
+}
+
+// leaseEntry is one node's cached view of a shared bucket.
+type leaseEntry struct {
+	mu          sync.Mutex // held across the store round-trip
+	tokens      int
+	expires     time.Time
+	deniedUntil time.Time
+	lastSeen    time.Time
+	// The bucket as the store last reported it
+	remaining int
+	fullAt    time.Time
+}
+
+func newStoreLimiter(s store.Storer, prefix string) *storeLimiter {
+	l := &storeLimiter{store: s, prefix: prefix}
+	for i := range l.shards {
+		l.shards[i] = &leaseShard{entries: make(map[string]*leaseEntry)}
+	}
+	return l
+}
+
+func (l *storeLimiter) entry(key string) *leaseEntry {
+	hash := uint32(0)
+	for i := 0; i < len(key); i++ {
+		hash = 31*hash + uint32(key[i])
+	}
+	s := l.shards[hash%numShards]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &leaseEntry{}
+		s.entries[key] = e
+	}
+	e.lastSeen = time.Now()
+	return e
+}
+
+// leaseSize is how many tokens to take per round-trip: what the bucket
+// refills in one lease period, but never more than a quarter of the
+// burst, so one node can't drain a bucket the others share.
+func leaseSize(rate float64, burst int) int {
+	n := min(int(rate*storeLeaseTTL.Seconds()), burst/4, maxStoreLease)
+	return max(n, 1)
+}
+
+// allow takes a token for key from the bucket that refills at rate per
+// second up to burst, and returns the bucket's state as best this node
+// knows it. Store errors fail open.
+func (l *storeLimiter) allow(key string, rate float64, burst int) rateLimitState {
+	e := l.entry(key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	st := rateLimitState{limit: burst}
+	if now.Before(e.deniedUntil) {
+		st.retryAfter = e.deniedUntil.Sub(now)
+		st.reset = max(0, e.fullAt.Sub(now))
+		return st
+	}
+	if e.tokens > 0 && now.Before(e.expires) {
+		e.tokens--
+		st.allowed = true
+		st.remaining = e.remaining + e.tokens
+		st.reset = max(0, e.fullAt.Sub(now))
+		return st
+	}
+
+	n := leaseSize(rate, burst)
+	res, err := l.store.RateLimit(l.prefix+key, rate, burst, n)
+	if err == nil && !res.Allowed && n > 1 {
+		// Not enough for a lease; settle for this request's token
+		n = 1
+		res, err = l.store.RateLimit(l.prefix+key, rate, burst, n)
+	}
+	if err != nil {
+		logger.Error("Distributed rate limit store error (fail open)", "key", key, "err", err)
+		st.allowed, st.remaining = true, burst
+		return st
+	}
+	e.remaining = res.Remaining
+	e.fullAt = now.Add(res.ResetAfter)
+	st.reset = res.ResetAfter
+	if !res.Allowed {
+		e.tokens = 0
+		e.deniedUntil = now.Add(res.RetryAfter)
+		st.retryAfter = res.RetryAfter
+		return st
+	}
+	e.tokens = n - 1
+	e.expires = now.Add(storeLeaseTTL)
+	st.allowed = true
+	st.remaining = e.remaining + e.tokens
+	return st
+}
+
+// purge drops cached entries idle for longer than idle.
+func (l *storeLimiter) purge(idle time.Duration) {
+	for _, s := range l.shards {
+		s.mu.Lock()
+		for key, e := range s.entries {
+			if time.Since(e.lastSeen) > idle {
+				delete(s.entries, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,418 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aegisedge/logger"
+)
+
+// Threat feed formats.
+const (
+	FeedFormatDROP    = "drop"    // Spamhaus DROP/EDROP: "1.10.16.0/20 ; SBL256894"
+	FeedFormatFireHOL = "firehol" // FireHOL .netset/.ipset: one entry per line, # comments
+	FeedFormatPlain   = "plain"   // one entry per line, # or ; comments
+	FeedFormatCSV     = "csv"     // entry in column csv_column
+	FeedFormatJSON    = "json"    // array, object or NDJSON stream
+)
+
+const (
+	defaultURLFeedRefresh  = time.Hour
+	defaultFileFeedRefresh = time.Minute
+	maxFeedBytes           = 64 << 20
+)
+
+// defaultFeedJSONFields are tried when a JSON feed holds objects and no
+// json_field is set. Spamhaus' drop_v4.json uses "cidr".
+var defaultFeedJSONFields = []string{"cidr", "ip", "ip_address", "network", "prefix"}
+
+// ThreatFeedConfig describes one IP/CIDR blocklist feed.
+type ThreatFeedConfig struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`            // file path or http(s):// URL
+	Format  string `json:"format"`            // drop, firehol, plain, csv or json
+	Refresh string `json:"refresh,omitempty"` // e.g. "6h"; 1h for URLs, 1m for files
+	Column  int    `json:"csv_column,omitempty"`
+	Field   string `json:"json_field,omitempty"`
+}
+
+// ThreatFeedStatus is the state of one feed as reported by /api/feeds.
+type ThreatFeedStatus struct {
+	Name        string    `json:"name"`
+	Source      string    `json:"source"`
+	Format      string    `json:"format"`
+	Status      string    `json:"status"` // pending, ok or error
+	Entries     int       `json:"entries"`
+	Invalid     int       `json:"invalid"`
+	LastUpdate  time.Time `json:"last_update"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// ThreatFeeds keeps threat-intel feeds loaded into an L3Filter. Each feed
+// is re-fetched on its own interval and swapped in whole; a failed fetch
+// or parse keeps the previous entries.
+type ThreatFeeds struct {
+	l3     *L3Filter
+	feeds  []*threatFeed
+	client *http.Client
+	stop   chan struct{}
+}
+
+type threatFeed struct {
+	cfg     ThreatFeedConfig
+	refresh time.Duration
+	status  atomic.Value // stores ThreatFeedStatus
+	mu      sync.Mutex   // serializes loads
+	version feedVersion  // of the data currently loaded
+}
+
+// feedVersion identifies fetched data so unchanged sources are not re-parsed.
+type feedVersion struct {
+	etag         string
+	lastModified string
+	modTime      time.Time
+}
+
+// NewThreatFeeds validates the feed configs. Call Start to begin loading.
+func NewThreatFeeds(l3 *L3Filter, configs []ThreatFeedConfig) (*ThreatFeeds, error) {
+	tf := &ThreatFeeds{
+		l3:     l3,
+		client: &http.Client{Timeout: time.Minute},
+		stop:   make(chan struct{}),
+	}
+	seen := make(map[string]bool)
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("threat feed %q: name is required", cfg.Source)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("threat feed %q: duplicate name", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		if cfg.Source == "" {
+			return nil, fmt.Errorf("threat feed %q: source is required", cfg.Name)
+		}
+
+		cfg.Format = strings.ToLower(cfg.Format)
+		switch cfg.Format {
+		case "":
+			cfg.Format = FeedFormatPlain
+		case "edrop", "spamhaus":
+			cfg.Format = FeedFormatDROP
+		case "netset", "ipset":
+			cfg.Format = FeedFormatFireHOL
+		case FeedFormatDROP, FeedFormatFireHOL, FeedFormatPlain, FeedFormatCSV, FeedFormatJSON:
+		default:
+			return nil, fmt.Errorf("threat feed %q: unknown format %q", cfg.Name, cfg.Format)
+		}
+
+		refresh := defaultFileFeedRefresh
+		if isFeedURL(cfg.Source) {
+			refresh = defaultURLFeedRefresh
+		}
+		if cfg.Refresh != "" {
+			d, err := time.ParseDuration(cfg.Refresh)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("threat feed %q: invalid refresh %q", cfg.Name, cfg.Refresh)
+			}
+			refresh = d
+		}
+
+		feed := &threatFeed{cfg: cfg, refresh: refresh}
+		feed.status.Store(ThreatFeedStatus{
+			Name:   cfg.Name,
+			Source: cfg.Source,
+			Format: cfg.Format,
+			Status: "pending",
+		})
+		tf.feeds = append(tf.feeds, feed)
+	}
+	return tf, nil
+}
+
+// Start loads every feed in the background and keeps them refreshed.
+func (tf *ThreatFeeds) Start() {
+	for _, feed := range tf.feeds {
+		go tf.loop(feed)
+	}
+}
+
+// Stop cancels the background refresh goroutines.
+func (tf *ThreatFeeds) Stop() {
+	close(tf.stop)
+}
+
+// Reload fetches one feed, or every feed when name is empty, right away.
+// With no name and no feeds configured there is nothing to do.
+func (tf *ThreatFeeds) Reload(name string) error {
+	found := false
+	var errs []error
+	for _, feed := range tf.feeds {
+		if name != "" && feed.cfg.Name != name {
+			continue
+		}
+		found = true
+		if err := tf.load(feed); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", feed.cfg.Name, err))
+		}
+	}
+	if !found && name != "" {
+		return fmt.Errorf("unknown threat feed %q", name)
+	}
+	return errors.Join(errs...)
+}
+
+// Status returns the state of every feed, in config order.
+func (tf *ThreatFeeds) Status() []ThreatFeedStatus {
+	out := make([]ThreatFeedStatus, 0, len(tf.feeds))
+	for _, feed := range tf.feeds {
+		st, _ := feed.status.Load().(ThreatFeedStatus)
+		out = append(out, st)
+	}
+	return out
+}
+
+func (tf *ThreatFeeds) loop(feed *threatFeed) {
+	tf.load(feed)
+	ticker := time.NewTicker(feed.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tf.load(feed)
+		case <-tf.stop:
+			return
+		}
+	}
+}
+
+// load fetches and parses a feed and swaps it into the L3 filter.
+func (tf *ThreatFeeds) load(feed *threatFeed) error {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	st, _ := feed.status.Load().(ThreatFeedStatus)
+	st.LastAttempt = time.Now()
+
+	err := tf.update(feed, &st)
+	if err != nil {
+		st.Status = "error"
+		st.LastError = err.Error()
+		logger.Error("Threat feed update failed, keeping previous entries", "feed", feed.cfg.Name, "source", feed.cfg.Source, "err", err)
+	} else {
+		st.Status = "ok"
+		st.LastError = ""
+	}
+	feed.status.Store(st)
+	return err
+}
+
+func (tf *ThreatFeeds) update(feed *threatFeed, st *ThreatFeedStatus) error {
+	data, version, unchanged, err := tf.fetch(feed)
+	if err != nil || unchanged {
+		return err
+	}
+	prefixes, invalid, err := parseThreatFeed(data, feed.cfg)
+	if err != nil {
+		return err
+	}
+	// An error page or a truncated download must not wipe a working list
+	if len(prefixes) == 0 && invalid > 0 {
+		return fmt.Errorf("no valid entries (%d invalid)", invalid)
+	}
+
+	set := newIPSetFromPrefixes(prefixes)
+	tf.l3.SetFeed(feed.cfg.Name, set)
+	feed.version = version
+
+	st.Entries = set.Len()
+	st.Invalid = invalid
+	st.LastUpdate = st.LastAttempt
+	ThreatFeedEntries.WithLabelValues(feed.cfg.Name).Set(float64(st.Entries))
+	logger.Info("Threat feed loaded", "feed", feed.cfg.Name, "source", feed.cfg.Source, "entries", st.Entries, "invalid", invalid)
+	return nil
+}
+
+// fetch reads the feed source. unchanged is true when the source reports
+// (or its mtime shows) the data already loaded is current.
+func (tf *ThreatFeeds) fetch(feed *threatFeed) (data []byte, version feedVersion, unchanged bool, err error) {
+	if !isFeedURL(feed.cfg.Source) {
+		info, err := os.Stat(feed.cfg.Source)
+		if err != nil {
+			return nil, version, false, err
+		}
+		if info.ModTime().Equal(feed.version.modTime) {
+			return nil, version, true, nil
+		}
+		if info.Size() > maxFeedBytes {
+			return nil, version, false, fmt.Errorf("feed larger than %d bytes", maxFeedBytes)
+		}
+		data, err := os.ReadFile(feed.cfg.Source)
+		return data, feedVersion{modTime: info.ModTime()}, false, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, feed.cfg.Source, nil)
+	if err != nil {
+		return nil, version, false, err
+	}
+	req.Header.Set("User-Agent", "AegisEdge-ThreatFeeds/1.0")
+	if feed.version.etag != "" {
+		req.Header.Set("If-None-Match", feed.version.etag)
+	}
+	if feed.version.lastModified != "" {
+		req.Header.Set("If-Modified-Since", feed.version.lastModified)
+	}
+	resp, err := tf.client.Do(req)
+	if err != nil {
+		return nil, version, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, version, true, nil
+	default:
+		return nil, version, false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxFeedBytes+1))
+	if err != nil {
+		return nil, version, false, err
+	}
+	if len(data) > maxFeedBytes {
+		return nil, version, false, fmt.Errorf("feed larger than %d bytes", maxFeedBytes)
+	}
+	version = feedVersion{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	return data, version, false, nil
+}
+
+func isFeedURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// parseThreatFeed extracts the prefixes from feed data. invalid counts the
+// entries that could not be parsed (CSV headers land here too).
+func parseThreatFeed(data []byte, cfg ThreatFeedConfig) (prefixes []netip.Prefix, invalid int, err error) {
+	add := func(entry string) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return
+		}
+		p, err := ParseIPEntry(entry)
+		if err != nil {
+			invalid++
+			return
+		}
+		prefixes = append(prefixes, p...)
+	}
+
+	switch cfg.Format {
+	case FeedFormatCSV:
+		err = parseCSVFeed(data, cfg.Column, add)
+	case FeedFormatJSON:
+		err = parseJSONFeed(data, cfg.Field, add)
+	default:
+		err = parseLineFeed(data, add)
+	}
+	return prefixes, invalid, err
+}
+
+// parseLineFeed handles the line-oriented formats: DROP/EDROP put the SBL
+// reference after ";", FireHOL and most plain lists comment with "#", and
+// anything after the first field is treated as a note.
+func parseLineFeed(data []byte, add func(string)) error {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			add(fields[0])
+		}
+	}
+	return sc.Err()
+}
+
+func parseCSVFeed(data []byte, column int, add func(string)) error {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if column < len(record) {
+			add(record[column])
+		}
+	}
+}
+
+// parseJSONFeed walks every JSON value in data (a single document or
+// newline-delimited ones). Strings are entries; objects contribute their
+// field, or the first of defaultFeedJSONFields they have.
+func parseJSONFeed(data []byte, field string, add func(string)) error {
+	fields := defaultFeedJSONFields
+	if field != "" {
+		fields = []string{field}
+	}
+
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case string:
+			add(v)
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]any:
+			for _, f := range fields {
+				if fv, ok := v[f]; ok {
+					walk(fv)
+					return
+				}
+			}
+			// A wrapper object such as {"data": [...]}
+			for _, fv := range v {
+				if _, ok := fv.([]any); ok {
+					walk(fv)
+				}
+			}
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var v any
+		if err := dec.Decode(&v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		walk(v)
+	}
+}
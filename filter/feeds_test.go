@@ -0,0 +1,211 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseThreatFeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ThreatFeedConfig
+		data    string
+		want    []string
+		invalid int
+	}{
+		{
+			name: "spamhaus drop",
+			cfg:  ThreatFeedConfig{Format: FeedFormatDROP},
+			data: "; Spamhaus DROP List 2024/01/01\n; Last-Modified: Mon, 01 Jan 2024\n1.10.16.0/20 ; SBL256894\n1.19.0.0/16 ; SBL434604\n",
+			want: []string{"1.10.16.0/20", "1.19.0.0/16"},
+		},
+		{
+			name: "firehol netset",
+			cfg:  ThreatFeedConfig{Format: FeedFormatFireHOL},
+			data: "#\n# firehol_level1\n#\n0.0.0.0/8\n5.188.10.179\n2001:db8::/32\n",
+			want: []string{"0.0.0.0/8", "5.188.10.179/32", "2001:db8::/32"},
+		},
+		{
+			name:    "plain with notes and junk",
+			cfg:     ThreatFeedConfig{Format: FeedFormatPlain},
+			data:    "198.51.100.7   scanner\n\n203.0.113.1-203.0.113.2\nhello\n",
+			want:    []string{"198.51.100.7/32", "203.0.113.1/32", "203.0.113.2/32"},
+			invalid: 1,
+		},
+		{
+			name:    "csv column",
+			cfg:     ThreatFeedConfig{Format: FeedFormatCSV, Column: 1},
+			data:    "first_seen,ip,malware\n2024-01-01,192.0.2.10,emotet\n# comment\n2024-01-02,\"192.0.2.11\",qakbot\n",
+			want:    []string{"192.0.2.10/32", "192.0.2.11/32"},
+			invalid: 1, // header
+		},
+		{
+			name: "json array of strings",
+			cfg:  ThreatFeedConfig{Format: FeedFormatJSON},
+			data: `["192.0.2.0/24", "2001:db8::1"]`,
+			want: []string{"192.0.2.0/24", "2001:db8::1/128"},
+		},
+		{
+			name: "spamhaus ndjson",
+			cfg:  ThreatFeedConfig{Format: FeedFormatJSON},
+			data: "{\"cidr\":\"1.10.16.0/20\",\"sblid\":\"SBL256894\",\"rir\":\"apnic\"}\n{\"cidr\":\"1.19.0.0/16\",\"sblid\":\"SBL434604\",\"rir\":\"apnic\"}\n{\"type\":\"metadata\",\"timestamp\":1704067200}\n",
+			want: []string{"1.10.16.0/20", "1.19.0.0/16"},
+		},
+		{
+			name: "json wrapper with custom field",
+			cfg:  ThreatFeedConfig{Format: FeedFormatJSON, Field: "addr"},
+			data: `{"generated": "2024-01-01", "data": [{"addr": "192.0.2.1"}, {"addr": "192.0.2.2"}]}`,
+			want: []string{"192.0.2.1/32", "192.0.2.2/32"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, invalid, err := parseThreatFeed([]byte(tt.data), tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if invalid != tt.invalid {
+				t.Errorf("invalid = %d, want %d", invalid, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestThreatFeedsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drop.txt")
+	os.WriteFile(path, []byte("192.0.2.0/24 ; SBL1\n"), 0644)
+
+	l3 := NewL3Filter([]string{"198.51.100.1"}, nil)
+	tf, err := NewThreatFeeds(l3, []ThreatFeedConfig{{Name: "drop", Source: path, Format: "drop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := tf.Status()[0]; st.Status != "pending" {
+		t.Errorf("status before first load = %q, want pending", st.Status)
+	}
+	if err := tf.Reload(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if source, blocked := l3.Lookup("192.0.2.55"); !blocked || source != "feed:drop" {
+		t.Errorf("Lookup(192.0.2.55) = %q, %v; want feed:drop, true", source, blocked)
+	}
+	if source, _ := l3.Lookup("198.51.100.1"); source != "blacklist" {
+		t.Errorf("static entry source = %q, want blacklist", source)
+	}
+	st := tf.Status()[0]
+	if st.Status != "ok" || st.Entries != 1 || st.LastUpdate.IsZero() {
+		t.Errorf("unexpected status after load: %+v", st)
+	}
+
+	// The new file replaces the old entries whole
+	os.WriteFile(path, []byte("203.0.113.0/24\n"), 0644)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err := tf.Reload("drop"); err != nil {
+		t.Fatal(err)
+	}
+	if l3.IsBlacklisted("192.0.2.55") || !l3.IsBlacklisted("203.0.113.9") {
+		t.Error("reload should swap the feed's entries")
+	}
+
+	// A broken source keeps the last good entries
+	os.Remove(path)
+	if err := tf.Reload("drop"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	if !l3.IsBlacklisted("203.0.113.9") {
+		t.Error("failed reload must keep the previous entries")
+	}
+	if st := tf.Status()[0]; st.Status != "error" || st.LastError == "" || st.Entries != 1 {
+		t.Errorf("unexpected status after failure: %+v", st)
+	}
+
+	if err := tf.Reload("nope"); err == nil {
+		t.Error("expected an error for an unknown feed")
+	}
+
+	none, _ := NewThreatFeeds(l3, nil)
+	if err := none.Reload(""); err != nil {
+		t.Errorf("reloading all of no feeds: %v", err)
+	}
+}
+
+func TestThreatFeedsHTTP(t *testing.T) {
+	var hits, notModified atomic.Int32
+	body := "192.0.2.0/24\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/broken" {
+			w.Write([]byte("<html>maintenance</html>"))
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	l3 := NewL3Filter(nil, NewIPSet([]string{"192.0.2.7"}))
+	tf, err := NewThreatFeeds(l3, []ThreatFeedConfig{
+		{Name: "firehol", Source: srv.URL + "/level1.netset", Format: "netset"},
+		{Name: "broken", Source: srv.URL + "/broken"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tf.Reload("")
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the broken feed to fail, got %v", err)
+	}
+	if !l3.IsBlacklisted("192.0.2.1") {
+		t.Error("192.0.2.1 should be blocked by the HTTP feed")
+	}
+	if l3.IsBlacklisted("192.0.2.7") {
+		t.Error("whitelist must take precedence over feeds")
+	}
+
+	if err := tf.Reload("firehol"); err != nil {
+		t.Fatal(err)
+	}
+	if notModified.Load() != 1 {
+		t.Error("second fetch should be conditional and get 304")
+	}
+	if !l3.IsBlacklisted("192.0.2.1") {
+		t.Error("304 must keep the loaded entries")
+	}
+
+	status := tf.Status()
+	if status[0].Status != "ok" || status[1].Status != "error" {
+		t.Errorf("unexpected statuses: %+v", status)
+	}
+}
+
+func TestNewThreatFeedsValidates(t *testing.T) {
+	bad := [][]ThreatFeedConfig{
+		{{Source: "x.txt"}},
+		{{Name: "a", Source: "x.txt"}, {Name: "a", Source: "y.txt"}},
+		{{Name: "a"}},
+		{{Name: "a", Source: "x.txt", Format: "xml"}},
+		{{Name: "a", Source: "x.txt", Refresh: "soon"}},
+	}
+	for _, cfgs := range bad {
+		if _, err := NewThreatFeeds(NewL3Filter(nil, nil), cfgs); err == nil {
+			t.Errorf("NewThreatFeeds(%+v) should fail", cfgs)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package filter
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aegisedge/logger"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoDBReloadInterval is how often the database files are checked for changes.
+const geoDBReloadInterval = time.Minute
+
+// geoDBCloseDelay is how long a replaced reader stays open so lookups that
+// loaded it just before the swap can finish.
+const geoDBCloseDelay = time.Minute
+
+// GeoDBStatus describes a MaxMind database as reported by /api/status.
+type GeoDBStatus struct {
+	Path      string    `json:"path"`
+	Type      string    `json:"type,omitempty"` // e.g. GeoLite2-Country
+	Status    string    `json:"status"`         // loaded, missing or error
+	BuildDate time.Time `json:"build_date"`     // when MaxMind built the file
+	LoadedAt  time.Time `json:"loaded_at"`      // when this process opened it
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// geoDB keeps a MaxMind database open and swaps in a new reader when the
+// file changes, so weekly updates don't need a restart. Lookups load the
+// reader atomically and never wait on a reload. The reader memory-maps the
+// file, so updates must replace it (write elsewhere, then rename, as
+// geoipupdate does) rather than rewrite it in place.
+type geoDB struct {
+	path    string
+	reader  atomic.Value // stores *geoip2.Reader
+	status  atomic.Value // stores GeoDBStatus
+	modTime time.Time
+	mu      sync.Mutex // guards reloads
+	stop    chan struct{}
+}
+
+// openGeoDB opens path and, if interval > 0, re-checks it on that interval.
+// A missing file is not an error: lookups simply find nothing until it
+// appears.
+func openGeoDB(path string, interval time.Duration) *geoDB {
+	g := &geoDB{path: path, stop: make(chan struct{})}
+	g.status.Store(GeoDBStatus{Path: path, Status: "missing"})
+	if path == "" {
+		return g
+	}
+	g.Reload()
+	if interval > 0 {
+		go g.loop(interval)
+	}
+	return g
+}
+
+// Reader returns the current reader, or nil if none is loaded.
+func (g *geoDB) Reader() *geoip2.Reader {
+	if g == nil {
+		return nil
+	}
+	r, _ := g.reader.Load().(*geoip2.Reader)
+	return r
+}
+
+// Status returns the database's current state.
+func (g *geoDB) Status() GeoDBStatus {
+	st, _ := g.status.Load().(GeoDBStatus)
+	return st
+}
+
+// Reload re-opens the file. On error the previous reader stays active.
+func (g *geoDB) Reload() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	st := g.Status()
+	info, err := os.Stat(g.path)
+	if err != nil {
+		if st.Status != "loaded" {
+			st.Status = "missing"
+		}
+		st.LastError = err.Error()
+		g.status.Store(st)
+		return err
+	}
+	r, err := geoip2.Open(g.path)
+	if err != nil {
+		st.LastError = err.Error()
+		if st.Status != "loaded" {
+			st.Status = "error"
+		}
+		g.status.Store(st)
+		return err
+	}
+
+	meta := r.Metadata()
+	old := g.Reader()
+	g.reader.Store(r)
+	g.modTime = info.ModTime()
+	g.status.Store(GeoDBStatus{
+		Path:      g.path,
+		Type:      meta.DatabaseType,
+		Status:    "loaded",
+		BuildDate: time.Unix(int64(meta.BuildEpoch), 0).UTC(),
+		LoadedAt:  time.Now(),
+	})
+	if old != nil {
+		time.AfterFunc(geoDBCloseDelay, func() { old.Close() })
+	}
+	logger.Info("MaxMind database loaded", "path", g.path, "type", meta.DatabaseType, "build_date", time.Unix(int64(meta.BuildEpoch), 0).UTC())
+	return nil
+}
+
+// Stop cancels the background reload goroutine.
+func (g *geoDB) Stop() {
+	close(g.stop)
+}
+
+func (g *geoDB) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(g.path)
+			if err != nil {
+				continue
+			}
+			g.mu.Lock()
+			changed := !info.ModTime().Equal(g.modTime)
+			g.mu.Unlock()
+			if changed {
+				if err := g.Reload(); err != nil {
+					logger.Error("MaxMind database reload failed, keeping previous database", "path", g.path, "err", err)
+				}
+			}
+		case <-g.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"aegisedge/util"
+)
+
+// writeTestMMDB writes a minimal IPv4 MaxMind DB in which every address
+// resolves to record.
+func writeTestMMDB(t *testing.T, path, dbType string, buildEpoch uint64, record map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+
+	// Search tree: one node whose two records both point at the first
+	// (only) data entry: node_count + 16 + offset 0.
+	buf.Write([]byte{0, 0, 17, 0, 0, 17})
+	buf.Write(make([]byte, 16))
+	mmdbEncode(&buf, record)
+
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbEncode(&buf, map[string]any{
+		"node_count":                  uint32(1),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               dbType,
+		"languages":                   []any{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 buildEpoch,
+		"description":                 map[string]any{"en": "test"},
+	})
+	// Replace the file the way geoipupdate does: readers memory-map it, so
+	// it must never be rewritten in place.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mmdbEncode writes v in the MaxMind DB data section format. Only the
+// types the tests need are supported, and sizes stay under 285.
+func mmdbEncode(buf *bytes.Buffer, v any) {
+	control := func(typ, size int) {
+		sz, ext := size, -1
+		if size >= 29 {
+			sz, ext = 29, size-29
+		}
+		if typ <= 7 {
+			buf.WriteByte(byte(typ<<5 | sz))
+		} else {
+			buf.WriteByte(byte(sz))
+			buf.WriteByte(byte(typ - 7))
+		}
+		if ext >= 0 {
+			buf.WriteByte(byte(ext))
+		}
+	}
+	uint := func(typ int, n uint64, width int) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, n)
+		b = bytes.TrimLeft(b[8-width:], "\x00")
+		control(typ, len(b))
+		buf.Write(b)
+	}
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		uint(5, uint64(v), 2)
+	case uint32:
+		uint(6, uint64(v), 4)
+	case uint64:
+		uint(9, v, 8)
+	case []any:
+		control(11, len(v))
+		for _, item := range v {
+			mmdbEncode(buf, item)
+		}
+	case map[string]any:
+		control(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			mmdbEncode(buf, k)
+			mmdbEncode(buf, v[k])
+		}
+	}
+}
+
+func countryRecord(iso string) map[string]any {
+	return map[string]any{"country": map[string]any{"iso_code": iso}}
+}
+
+func TestGeoIPFilterReloadsDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	writeTestMMDB(t, path, "GeoLite2-Country", 1700000000, countryRecord("US"))
+
+	f, err := NewGeoIPFilter(path, GeoIPConfig{Blocked: []string{"NL"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	if c, _ := f.Country("192.0.2.1"); c != "US" {
+		t.Fatalf("country = %q, want US", c)
+	}
+	st := f.DBStatus()
+	if st.Status != "loaded" || st.Type != "GeoLite2-Country" || !st.BuildDate.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected status: %+v", st)
+	}
+
+	// A weekly update arrives
+	writeTestMMDB(t, path, "GeoLite2-Country", 1700600000, countryRecord("NL"))
+	if err := f.db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := f.Country("192.0.2.1"); c != "NL" {
+		t.Errorf("country after reload = %q, want NL", c)
+	}
+	if !f.DBStatus().BuildDate.Equal(time.Unix(1700600000, 0)) {
+		t.Error("build date should follow the new file")
+	}
+	h := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if got := geoStatus(h, "192.0.2.1", "example.com", "/"); got != http.StatusForbidden {
+		t.Errorf("policy should use the reloaded database, got %d", got)
+	}
+
+	// A truncated download keeps the previous reader
+	os.WriteFile(path+".tmp", []byte("not a database"), 0644)
+	os.Rename(path+".tmp", path)
+	if err := f.db.Reload(); err == nil {
+		t.Error("expected an error for a corrupt file")
+	}
+	if c, _ := f.Country("192.0.2.1"); c != "NL" {
+		t.Errorf("corrupt file must keep the previous database, got %q", c)
+	}
+	if st := f.DBStatus(); st.Status != "loaded" || st.LastError == "" {
+		t.Errorf("unexpected status after failed reload: %+v", st)
+	}
+}
+
+func TestGeoIPFilterMissingDatabase(t *testing.T) {
+	f, err := NewGeoIPFilter(filepath.Join(t.TempDir(), "missing.mmdb"), GeoIPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	if st := f.DBStatus(); st.Status != "missing" {
+		t.Errorf("status = %q, want missing", st.Status)
+	}
+	if _, ok := f.Country("192.0.2.1"); ok {
+		t.Error("lookups should find nothing without a database")
+	}
+}
+
+func TestEnrichmentHeaders(t *testing.T) {
+	dir := t.TempDir()
+	countryDB := filepath.Join(dir, "country.mmdb")
+	asnDB := filepath.Join(dir, "asn.mmdb")
+	writeTestMMDB(t, countryDB, "GeoLite2-Country", 1700000000, countryRecord("DE"))
+	writeTestMMDB(t, asnDB, "GeoLite2-ASN", 1700000000, map[string]any{
+		"autonomous_system_number":       uint32(24940),
+		"autonomous_system_organization": "Hetzner Online GmbH",
+	})
+
+	geoip, err := NewGeoIPFilter(countryDB, GeoIPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geoip.Stop()
+	asn, err := NewASNFilter(asnDB, ASNConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer asn.Stop()
+
+	var country, network string
+	h := asn.Middleware(geoip.Enrich(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		country, network = util.GetCountry(r), util.GetASN(r)
+	})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	util.SetRealIP(req, "192.0.2.1")
+	req.Header.Set(util.CountryHeader, "US") // spoofed by the client
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if country != "DE" || network != "AS24940" {
+		t.Errorf("got country %q, asn %q; want DE, AS24940", country, network)
+	}
+	if st := asn.DBStatus(); st.Type != "GeoLite2-ASN" {
+		t.Errorf("ASN database type = %q", st.Type)
+	}
+}
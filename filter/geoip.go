@@ -1,53 +1,270 @@
 package filter
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"aegisedge/logger"
 	"aegisedge/util"
-	"github.com/oschwald/geoip2-golang"
 )
 
+// Actions for a country match.
+const (
+	GeoActionBlock     = "block"      // 403
+	GeoActionChallenge = "challenge"  // send through the JS challenge
+	GeoActionRateLimit = "rate_limit" // per-IP bucket at the rule's rate
+)
+
+// GeoRule is the country policy for the requests its Host and PathPrefix
+// select. The first rule that selects a request replaces the global lists
+// for it, so a rule with no countries opens a path the global lists would
+// restrict. The rule acts on a country in Block, or, when Allow is set, on
+// any country not in Allow.
+type GeoRule struct {
+	Host       string   `json:"host,omitempty"` // exact, or *.example.com for any subdomain
+	PathPrefix string   `json:"path_prefix,omitempty"`
+	Allow      []string `json:"allow,omitempty"`
+	Block      []string `json:"block,omitempty"`
+	Action     string   `json:"action,omitempty"` // block (default), challenge or rate_limit
+	Rate       float64  `json:"rate,omitempty"`
+	Burst      int      `json:"burst,omitempty"`
+
+	allow    map[string]bool
+	block    map[string]bool
+	limiters *keyedLimiters
+}
+
+// GeoIPConfig configures a GeoIPFilter. The global lists act as a final
+// rule that selects every request no other rule did.
+type GeoIPConfig struct {
+	Blocked []string // blocked_countries
+	Allowed []string // allowed_countries: when set, only these pass
+	Action  string   // for the global lists
+	Rate    float64
+	Burst   int
+	Rules   []GeoRule
+
+	Whitelist *IPSet
+	// Challenge wraps a handler in the JS challenge; required for the
+	// challenge action.
+	Challenge func(http.Handler) http.Handler
+}
+
 type GeoIPFilter struct {
-	db *geoip2.Reader
-	blockedCountries map[string]bool
+	db        *geoDB
+	lookup    func(net.IP) (string, bool)
+	rules     []*GeoRule
+	whitelist *IPSet
+	challenge func(http.Handler) http.Handler
+	stop      chan struct{}
 }
 
-func NewGeoIPFilter(dbPath string, blockedCountries []string) *GeoIPFilter {
-	db, err := geoip2.Open(dbPath)
-	if err != nil {
+func NewGeoIPFilter(dbPath string, cfg GeoIPConfig) (*GeoIPFilter, error) {
+	f := &GeoIPFilter{
+		whitelist: cfg.Whitelist,
+		challenge: cfg.Challenge,
+		stop:      make(chan struct{}),
+	}
+
+	rules := append([]GeoRule(nil), cfg.Rules...)
+	if len(cfg.Blocked) > 0 || len(cfg.Allowed) > 0 {
+		rules = append(rules, GeoRule{
+			Allow:  cfg.Allowed,
+			Block:  cfg.Blocked,
+			Action: cfg.Action,
+			Rate:   cfg.Rate,
+			Burst:  cfg.Burst,
+		})
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("geo rule %d: %w", i, err)
+		}
+		if rule.Action == GeoActionChallenge && f.challenge == nil {
+			return nil, fmt.Errorf("geo rule %d: challenge action needs a challenge handler", i)
+		}
+		f.rules = append(f.rules, rule)
+	}
+
+	f.db = openGeoDB(dbPath, geoDBReloadInterval)
+	if f.db.Status().Status != "loaded" {
 		logger.Warn("GeoIP filter bypassed: Database file not found", "path", dbPath, "tip", "Download GeoLite2-Country.mmdb from MaxMind to enable country blocking")
 	}
+	f.lookup = func(ip net.IP) (string, bool) {
+		db := f.db.Reader()
+		if db == nil {
+			return "", false
+		}
+		record, err := db.Country(ip)
+		if err != nil || record.Country.IsoCode == "" {
+			return "", false
+		}
+		return record.Country.IsoCode, true
+	}
+
+	go f.cleanupLoop()
+	return f, nil
+}
 
-	bc := make(map[string]bool)
-	for _, c := range blockedCountries {
-		bc[c] = true
+func (r *GeoRule) compile() error {
+	r.Host = strings.ToLower(r.Host)
+	r.allow = countrySet(r.Allow)
+	r.block = countrySet(r.Block)
+
+	switch r.Action {
+	case "":
+		r.Action = GeoActionBlock
+	case GeoActionBlock, GeoActionChallenge:
+	case GeoActionRateLimit:
+		if r.Rate <= 0 || r.Burst <= 0 {
+			return fmt.Errorf("rate_limit needs a positive rate and burst")
+		}
+		r.limiters = newKeyedLimiters(r.Rate, r.Burst)
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
 	}
+	return nil
+}
 
-	return &GeoIPFilter{
-		db: db,
-		blockedCountries: bc,
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			set[c] = true
+		}
 	}
+	return set
+}
+
+// selects reports whether the rule covers req.
+func (r *GeoRule) selects(req *http.Request) bool {
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	return hostMatches(r.Host, req)
+}
+
+// restricts reports whether the rule acts on a request from country.
+func (r *GeoRule) restricts(country string) bool {
+	if r.block[country] {
+		return true
+	}
+	return len(r.allow) > 0 && !r.allow[country]
+}
+
+// Country returns the ISO code for ip.
+func (f *GeoIPFilter) Country(ip string) (string, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", false
+	}
+	return f.lookup(parsed)
+}
+
+// DBStatus reports the country database's state and build date.
+func (f *GeoIPFilter) DBStatus() GeoDBStatus {
+	return f.db.Status()
+}
+
+// Stop cancels the database watcher and limiter cleanup goroutines.
+func (f *GeoIPFilter) Stop() {
+	f.db.Stop()
+	close(f.stop)
+}
+
+// Enrich records the client's country on the request for the request log
+// and, when the proxy forwards it, the upstream. It runs whether or not the
+// geoip toggle is on, and always replaces a client-supplied header.
+func (f *GeoIPFilter) Enrich(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(util.CountryHeader)
+		if country, ok := f.Country(util.GetRealIP(r)); ok {
+			util.SetCountry(r, country)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (f *GeoIPFilter) Middleware(next http.Handler) http.Handler {
+	challenged := next
+	if f.challenge != nil {
+		challenged = f.challenge(next) // pre-built, like wrapToggle
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		host := util.GetRealIP(r)
-		ip := net.ParseIP(host)
-		
-		if f.db != nil && ip != nil {
-			record, err := f.db.Country(ip)
-			if err == nil {
-				if f.blockedCountries[record.Country.IsoCode] {
-					logger.Warn("Blocked request from unauthorized country", "remote_addr", host, "country", record.Country.IsoCode)
-					BlockedRequests.WithLabelValues("L7", "geoip").Inc()
-					http.Error(w, "Access Denied: Country Restricted", http.StatusForbidden)
-					return
-				}
+
+		// Addresses the database can't place (private ranges, new
+		// allocations) are never held to a country policy.
+		country, ok := f.Country(host)
+		if !ok || f.whitelist.Contains(host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule := f.ruleFor(r)
+		if rule == nil || !rule.restricts(country) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if MetricsEnabled() {
+			GeoIPActions.WithLabelValues(country, rule.Action).Inc()
+		}
+
+		switch rule.Action {
+		case GeoActionChallenge:
+			logger.Info("Challenging request from restricted country", "remote_addr", host, "country", country, "path", r.URL.Path)
+			challenged.ServeHTTP(w, r)
+
+		case GeoActionRateLimit:
+			if rule.limiters.allow(host) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			logger.Warn("Country rate limit exceeded", "remote_addr", host, "country", country, "asn", util.GetASN(r), "path", r.URL.Path)
+			if MetricsEnabled() {
+				BlockedRequests.WithLabelValues("L7", "geoip_rate_limit").Inc()
+			}
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+
+		default:
+			logger.Warn("Blocked request from unauthorized country", "remote_addr", host, "country", country, "asn", util.GetASN(r), "path", r.URL.Path)
+			if MetricsEnabled() {
+				BlockedRequests.WithLabelValues("L7", "geoip").Inc()
 			}
+			http.Error(w, "Access Denied: Country Restricted", http.StatusForbidden)
 		}
-		
-		next.ServeHTTP(w, r)
 	})
 }
+
+// ruleFor returns the first rule that selects r, or nil.
+func (f *GeoIPFilter) ruleFor(r *http.Request) *GeoRule {
+	for _, rule := range f.rules {
+		if rule.selects(r) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// cleanupLoop drops rate_limit buckets that have been idle for ten minutes.
+func (f *GeoIPFilter) cleanupLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, rule := range f.rules {
+				if rule.limiters != nil {
+					rule.limiters.purge(10 * time.Minute)
+				}
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package filter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"aegisedge/util"
+)
+
+// fakeCountries stands in for a GeoLite2-Country database.
+func fakeCountries(ip net.IP) (string, bool) {
+	switch ip.String() {
+	case "192.0.2.1":
+		return "US", true
+	case "192.0.2.2":
+		return "NL", true
+	case "192.0.2.3":
+		return "CN", true
+	case "192.0.2.4":
+		return "BR", true
+	}
+	return "", false
+}
+
+func newTestGeoIPFilter(t *testing.T, cfg GeoIPConfig) *GeoIPFilter {
+	t.Helper()
+	f, err := NewGeoIPFilter("", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Stop)
+	f.lookup = fakeCountries
+	return f
+}
+
+func geoStatus(h http.Handler, ip, host, path string) int {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Host = host
+	util.SetRealIP(req, ip)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestGeoIPFilterPolicies(t *testing.T) {
+	challenge := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable) // stands in for the JS challenge page
+		})
+	}
+	f := newTestGeoIPFilter(t, GeoIPConfig{
+		Blocked: []string{"cn"},
+		Action:  GeoActionBlock,
+		Rules: []GeoRule{
+			{Host: "admin.example.com", Allow: []string{"NL"}},
+			{PathPrefix: "/public"}, // open to everyone
+			{PathPrefix: "/login", Block: []string{"CN", "BR"}, Action: GeoActionChallenge},
+			{PathPrefix: "/api", Block: []string{"BR"}, Action: GeoActionRateLimit, Rate: 0.001, Burst: 1},
+		},
+		Whitelist: NewIPSet([]string{"192.0.2.1"}),
+		Challenge: challenge,
+	})
+	h := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name, ip, host, path string
+		want                 int
+	}{
+		{"admin from home", "192.0.2.2", "admin.example.com", "/", http.StatusOK},
+		{"admin from abroad", "192.0.2.4", "admin.example.com", "/", http.StatusForbidden},
+		{"admin, whitelisted", "192.0.2.1", "admin.example.com", "/", http.StatusOK},
+		{"public page overrides global list", "192.0.2.3", "www.example.com", "/public/about", http.StatusOK},
+		{"login challenges", "192.0.2.3", "www.example.com", "/login", http.StatusServiceUnavailable},
+		{"login from elsewhere", "192.0.2.2", "www.example.com", "/login", http.StatusOK},
+		{"global blocklist", "192.0.2.3", "www.example.com", "/", http.StatusForbidden},
+		{"global lets others through", "192.0.2.4", "www.example.com", "/", http.StatusOK},
+		{"unknown country passes", "203.0.113.9", "admin.example.com", "/", http.StatusOK},
+		{"api burst", "192.0.2.4", "www.example.com", "/api/x", http.StatusOK},
+		{"api limited", "192.0.2.4", "www.example.com", "/api/x", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if got := geoStatus(h, tt.ip, tt.host, tt.path); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGeoIPFilterAllowOnly(t *testing.T) {
+	f := newTestGeoIPFilter(t, GeoIPConfig{Allowed: []string{"US", "NL"}})
+	h := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for ip, want := range map[string]int{
+		"192.0.2.1": http.StatusOK,
+		"192.0.2.2": http.StatusOK,
+		"192.0.2.3": http.StatusForbidden,
+		"192.0.2.4": http.StatusForbidden,
+	} {
+		if got := geoStatus(h, ip, "example.com", "/"); got != want {
+			t.Errorf("%s: status %d, want %d", ip, got, want)
+		}
+	}
+}
+
+func TestNewGeoIPFilterValidates(t *testing.T) {
+	bad := []GeoIPConfig{
+		{Blocked: []string{"CN"}, Action: "tarpit"},
+		{Blocked: []string{"CN"}, Action: GeoActionRateLimit},
+		{Blocked: []string{"CN"}, Action: GeoActionChallenge}, // no challenge handler
+		{Rules: []GeoRule{{Block: []string{"CN"}, Action: GeoActionRateLimit, Rate: 1}}},
+	}
+	for _, cfg := range bad {
+		if _, err := NewGeoIPFilter("", cfg); err == nil {
+			t.Errorf("NewGeoIPFilter(%+v) should fail", cfg)
+		}
+	}
+}
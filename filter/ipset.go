@@ -0,0 +1,294 @@
+package filter
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"aegisedge/logger"
+)
+
+// IPSet is a set of IPv4 and IPv6 addresses and prefixes, stored as a
+// path-compressed binary trie per address family. Lookups walk an immutable
+// trie loaded atomically, so they take no locks; updates copy the nodes on
+// the path they change and swap the new root in (copy-on-write).
+//
+// Entries may be a single address (1.2.3.4, 2001:db8::1), a CIDR
+// (10.0.0.0/8, 2001:db8::/32) or an inclusive range (10.0.0.1-10.0.0.50).
+type IPSet struct {
+	trie atomic.Value // stores *ipTrie
+	mu   sync.Mutex   // guards updates only
+}
+
+// ipTrie is one immutable version of an IPSet.
+type ipTrie struct {
+	v4, v6 *ipNode
+	n      int // prefixes inserted
+}
+
+// ipNode covers prefix. A terminal node means every address under the
+// prefix is in the set; its children are then never consulted.
+type ipNode struct {
+	prefix   netip.Prefix
+	terminal bool
+	child    [2]*ipNode
+}
+
+// NewIPSet builds a set from entries. Invalid entries are logged and
+// skipped so one typo in a config list doesn't disable the rest.
+func NewIPSet(entries []string) *IPSet {
+	s := &IPSet{}
+	t := &ipTrie{}
+	for _, e := range entries {
+		prefixes, err := ParseIPEntry(e)
+		if err != nil {
+			logger.Warn("Ignoring invalid IP set entry", "entry", e, "err", err)
+			continue
+		}
+		for _, p := range prefixes {
+			t = t.insert(p)
+		}
+	}
+	s.trie.Store(t)
+	return s
+}
+
+// newIPSetFromPrefixes builds a set from already parsed prefixes.
+func newIPSetFromPrefixes(prefixes []netip.Prefix) *IPSet {
+	s := &IPSet{}
+	t := &ipTrie{}
+	for _, p := range prefixes {
+		t = t.insert(p)
+	}
+	s.trie.Store(t)
+	return s
+}
+
+// Add inserts an address, CIDR or range.
+func (s *IPSet) Add(entry string) error {
+	prefixes, err := ParseIPEntry(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.load()
+	for _, p := range prefixes {
+		t = t.insert(p)
+	}
+	s.trie.Store(t)
+	return nil
+}
+
+// Contains reports whether ip (an address without a port) is in the set.
+// A nil set is empty.
+func (s *IPSet) Contains(ip string) bool {
+	if s == nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return s.ContainsAddr(addr)
+}
+
+// ContainsAddr reports whether addr is in the set. IPv4-mapped IPv6
+// addresses (::ffff:1.2.3.4) match IPv4 entries.
+func (s *IPSet) ContainsAddr(addr netip.Addr) bool {
+	if s == nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	t := s.load()
+	n := t.v6
+	if addr.Is4() {
+		n = t.v4
+	}
+	for n != nil {
+		if !n.prefix.Contains(addr) {
+			return false
+		}
+		if n.terminal {
+			return true
+		}
+		n = n.child[addrBit(addr, n.prefix.Bits())]
+	}
+	return false
+}
+
+// Len returns the number of prefixes added to the set. Ranges count as
+// the prefixes they were split into.
+func (s *IPSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.load().n
+}
+
+func (s *IPSet) load() *ipTrie {
+	t, _ := s.trie.Load().(*ipTrie)
+	if t == nil {
+		return &ipTrie{}
+	}
+	return t
+}
+
+// insert returns a new trie that also holds p, sharing every node it
+// doesn't change with t.
+func (t *ipTrie) insert(p netip.Prefix) *ipTrie {
+	out := &ipTrie{v4: t.v4, v6: t.v6, n: t.n + 1}
+	if p.Addr().Is4() {
+		out.v4 = insertPrefix(t.v4, p)
+	} else {
+		out.v6 = insertPrefix(t.v6, p)
+	}
+	return out
+}
+
+func insertPrefix(n *ipNode, p netip.Prefix) *ipNode {
+	if n == nil {
+		return &ipNode{prefix: p, terminal: true}
+	}
+	if n.terminal && n.prefix.Bits() <= p.Bits() && n.prefix.Contains(p.Addr()) {
+		return n // already covered
+	}
+
+	common := commonBits(n.prefix.Addr(), p.Addr(), min(n.prefix.Bits(), p.Bits()))
+	switch {
+	case common == n.prefix.Bits() && common == p.Bits():
+		// Same prefix: it now covers everything below it.
+		return &ipNode{prefix: p, terminal: true}
+	case common == n.prefix.Bits():
+		// p lies under n.
+		c := *n
+		b := addrBit(p.Addr(), common)
+		c.child[b] = insertPrefix(n.child[b], p)
+		return &c
+	case common == p.Bits():
+		// p covers n, which is now redundant.
+		return &ipNode{prefix: p, terminal: true}
+	default:
+		// n and p diverge: branch at the first differing bit.
+		branch := &ipNode{prefix: netip.PrefixFrom(p.Addr(), common).Masked()}
+		branch.child[addrBit(n.prefix.Addr(), common)] = n
+		branch.child[addrBit(p.Addr(), common)] = &ipNode{prefix: p, terminal: true}
+		return branch
+	}
+}
+
+// addrBit returns bit i of addr, counting from the most significant.
+func addrBit(addr netip.Addr, i int) int {
+	if addr.Is4() {
+		b := addr.As4()
+		return int(b[i/8]>>(7-i%8)) & 1
+	}
+	b := addr.As16()
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits returns how many leading bits a and b share, up to limit.
+func commonBits(a, b netip.Addr, limit int) int {
+	ab, bb := a.As16(), b.As16()
+	off := 0
+	if a.Is4() {
+		off = 12 // As16 of an IPv4 address is ::ffff:a.b.c.d
+	}
+	n := 0
+	for i := off; i < 16 && n < limit; i++ {
+		x := ab[i] ^ bb[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return min(n, limit)
+}
+
+// ParseIPEntry parses an address, CIDR or inclusive range into prefixes.
+func ParseIPEntry(entry string) ([]netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if from, to, ok := strings.Cut(entry, "-"); ok {
+		return parseIPRange(strings.TrimSpace(from), strings.TrimSpace(to))
+	}
+	if strings.Contains(entry, "/") {
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), max(p.Bits()-96, 0))
+		}
+		return []netip.Prefix{p.Masked()}, nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return nil, err
+	}
+	addr = addr.Unmap().WithZone("")
+	return []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
+
+// parseIPRange splits from-to into the fewest prefixes that cover it.
+func parseIPRange(from, to string) ([]netip.Prefix, error) {
+	start, err := netip.ParseAddr(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := netip.ParseAddr(to)
+	if err != nil {
+		return nil, err
+	}
+	start, end = start.Unmap().WithZone(""), end.Unmap().WithZone("")
+	if start.Is4() != end.Is4() {
+		return nil, fmt.Errorf("range %s-%s mixes IPv4 and IPv6", from, to)
+	}
+	if end.Less(start) {
+		return nil, fmt.Errorf("range %s-%s ends before it starts", from, to)
+	}
+
+	var out []netip.Prefix
+	for {
+		// Widen the prefix at start while it stays aligned and inside the range.
+		bits := start.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(start, bits-1).Masked()
+			if p.Addr() != start || lastAddr(p).Compare(end) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(start, bits)
+		out = append(out, p)
+
+		last := lastAddr(p)
+		if last == end {
+			return out, nil
+		}
+		start = last.Next()
+	}
+}
+
+// lastAddr returns the highest address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	if p.Addr().Is4() {
+		b := p.Addr().As4()
+		for i := p.Bits(); i < 32; i++ {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+		return netip.AddrFrom4(b)
+	}
+	b := p.Addr().As16()
+	for i := p.Bits(); i < 128; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	return netip.AddrFrom16(b)
+}
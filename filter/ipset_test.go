@@ -0,0 +1,149 @@
+package filter
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestIPSet(t *testing.T) {
+	s := NewIPSet([]string{
+		"10.0.0.0/8",
+		"192.168.1.7",
+		"172.16.5.10-172.16.5.20",
+		"2001:db8::/32",
+		"fe80::1",
+		"not-an-ip", // skipped, not fatal
+	})
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"172.16.5.9", false},
+		{"172.16.5.10", true},
+		{"172.16.5.16", true},
+		{"172.16.5.20", true},
+		{"172.16.5.21", false},
+		{"2001:db8::1", true},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+		{"fe80::1", true},
+		{"fe80::2", false},
+		{"::ffff:10.1.2.3", true}, // IPv4-mapped matches the IPv4 entry
+		{"::a01:203", false},      // ...but an IPv6 address with the same bits doesn't
+		{"", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		if got := s.Contains(tt.ip); got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	var nilSet *IPSet
+	if nilSet.Contains("10.0.0.1") {
+		t.Error("nil set should be empty")
+	}
+}
+
+func TestIPSetAdd(t *testing.T) {
+	s := NewIPSet(nil)
+	if s.Contains("203.0.113.9") {
+		t.Fatal("empty set should not match")
+	}
+
+	before := s.load()
+	for _, e := range []string{"203.0.113.0/25", "203.0.113.128/25", "203.0.113.9"} {
+		if err := s.Add(e); err != nil {
+			t.Fatalf("Add(%q): %v", e, err)
+		}
+	}
+	if !s.Contains("203.0.113.9") || !s.Contains("203.0.113.200") {
+		t.Error("added prefixes should match")
+	}
+	if before.v4 != nil {
+		t.Error("Add must not modify the trie readers already loaded")
+	}
+
+	// A covering prefix replaces the ones under it
+	if err := s.Add("203.0.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Contains("203.0.1.1") {
+		t.Error("203.0.0.0/16 should match 203.0.1.1")
+	}
+
+	for _, bad := range []string{"300.1.1.1", "10.0.0.0/33", "10.0.0.9-10.0.0.1", "10.0.0.1-::1"} {
+		if err := s.Add(bad); err == nil {
+			t.Errorf("Add(%q) should fail", bad)
+		}
+	}
+}
+
+func TestParseIPEntryRange(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  []string
+	}{
+		{"10.0.0.0-10.0.0.255", []string{"10.0.0.0/24"}},
+		{"10.0.0.1-10.0.0.6", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}},
+		{"0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}},
+		{"2001:db8::-2001:db8::ffff", []string{"2001:db8::/112"}},
+		{"10.1.2.3/16", []string{"10.1.0.0/16"}},
+		{"::ffff:10.0.0.0/104", []string{"10.0.0.0/8"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseIPEntry(tt.entry)
+		if err != nil {
+			t.Errorf("ParseIPEntry(%q): %v", tt.entry, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ParseIPEntry(%q) = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestIPSetConcurrentReads(t *testing.T) {
+	s := NewIPSet([]string{"10.0.0.0/8"})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if !s.Contains("10.1.2.3") {
+					t.Error("lookup raced with an update")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 256; i++ {
+		s.Add(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)}).String())
+	}
+	wg.Wait()
+	if !s.Contains("198.51.100.255") {
+		t.Error("concurrent adds were lost")
+	}
+}
+
+func BenchmarkIPSetContains(b *testing.B) {
+	entries := make([]string, 0, 5000)
+	for i := 0; i < 5000; i++ {
+		entries = append(entries, fmt.Sprintf("%d.%d.%d.0/24", 1+i%200, i/200, i%256))
+	}
+	s := NewIPSet(entries)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Contains("203.0.113.9")
+	}
+}
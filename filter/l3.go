@@ -2,73 +2,122 @@ package filter
 
 import (
 	"net"
-	"strings"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 )
 
+// L3Filter blocks by source address. Both lists accept addresses, CIDRs
+// and ranges, IPv4 and IPv6. Threat-intel feeds are kept as separate named
+// sets so a block can be traced back to the feed that caused it.
 type L3Filter struct {
-	blacklist atomic.Value // stores map[string]bool
-	whitelist atomic.Value // stores map[string]bool
-	mu        sync.Mutex   // guards updates only
+	blacklist *IPSet
+	whitelist *IPSet
+	feeds     atomic.Value // stores []feedSet
+	mu        sync.Mutex   // guards feed updates only
 }
 
-func NewL3Filter(ips []string, whitelist []string) *L3Filter {
-	bl := make(map[string]bool)
-	for _, ip := range ips {
-		bl[ip] = true
+type feedSet struct {
+	name string
+	set  *IPSet
+}
+
+// NewL3Filter builds the blacklist from ips. The whitelist is shared with
+// the L4 and L7 filters so every layer agrees on who bypasses them.
+func NewL3Filter(ips []string, whitelist *IPSet) *L3Filter {
+	if whitelist == nil {
+		whitelist = NewIPSet(nil)
 	}
-	wl := make(map[string]bool)
-	for _, ip := range whitelist {
-		wl[ip] = true
+	return &L3Filter{
+		blacklist: NewIPSet(ips),
+		whitelist: whitelist,
 	}
-
-	f := &L3Filter{}
-	f.blacklist.Store(bl)
-	f.whitelist.Store(wl)
-	return f
 }
 
 func (f *L3Filter) IsBlacklisted(ip string) bool {
-	// Optimization: If the IP string contains a port (standard RemoteAddr), split it.
-	// But our RealIP middleware already passes a clean IP.
-	if strings.Contains(ip, ":") && !strings.Contains(ip, "]") { // naive but fast check for IP:Port
-		host, _, err := net.SplitHostPort(ip)
-		if err == nil {
-			ip = host
+	_, blocked := f.Lookup(ip)
+	return blocked
+}
+
+// Lookup reports whether ip is blocked and by what: "blacklist" for the
+// static list and fast-path soft blocks, "feed:<name>" for a threat feed.
+func (f *L3Filter) Lookup(ip string) (string, bool) {
+	// Our RealIP middleware already passes a clean IP; a raw RemoteAddr
+	// (ip:port or [v6]:port) is split first.
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		host, _, splitErr := net.SplitHostPort(ip)
+		if splitErr != nil {
+			return "", false
 		}
+		if addr, err = netip.ParseAddr(host); err != nil {
+			return "", false
+		}
+		ip = host
 	}
 
 	// Whitelist takes absolute precedence
-	wl, _ := f.whitelist.Load().(map[string]bool)
-	if wl[ip] {
-		return false
+	if f.whitelist.ContainsAddr(addr) {
+		return "", false
 	}
 
 	// High-speed "Fast-Path" check (Zero-Lock / Sharded)
-	if IsSoftBlocked(ip) {
-		return true
+	if IsSoftBlocked(ip) || f.blacklist.ContainsAddr(addr) {
+		return "blacklist", true
 	}
 
-	bl, _ := f.blacklist.Load().(map[string]bool)
-	return bl[ip]
+	feeds, _ := f.feeds.Load().([]feedSet)
+	for _, fs := range feeds {
+		if fs.set.ContainsAddr(addr) {
+			return "feed:" + fs.name, true
+		}
+	}
+	return "", false
 }
 
 func (f *L3Filter) IsWhitelisted(ip string) bool {
-	wl, _ := f.whitelist.Load().(map[string]bool)
-	return wl[ip]
+	return f.whitelist.Contains(ip)
+}
+
+// AddIP blacklists an address, CIDR or range. Lookups never wait on it:
+// the set is copied and swapped atomically.
+func (f *L3Filter) AddIP(ip string) error {
+	return f.blacklist.Add(ip)
 }
 
-func (f *L3Filter) AddIP(ip string) {
+// SetFeed installs or replaces the set for a threat feed. Lookups see
+// either the old set or the new one, never a partial load.
+func (f *L3Filter) SetFeed(name string, set *IPSet) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Copy-on-Write: rebuild the map and swap it atomically
-	oldMap, _ := f.blacklist.Load().(map[string]bool)
-	newMap := make(map[string]bool, len(oldMap)+1)
-	for k, v := range oldMap {
-		newMap[k] = v
+	old, _ := f.feeds.Load().([]feedSet)
+	feeds := make([]feedSet, 0, len(old)+1)
+	replaced := false
+	for _, fs := range old {
+		if fs.name == name {
+			fs.set = set
+			replaced = true
+		}
+		feeds = append(feeds, fs)
+	}
+	if !replaced {
+		feeds = append(feeds, feedSet{name: name, set: set})
+	}
+	f.feeds.Store(feeds)
+}
+
+// RemoveFeed drops a threat feed's set.
+func (f *L3Filter) RemoveFeed(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old, _ := f.feeds.Load().([]feedSet)
+	feeds := make([]feedSet, 0, len(old))
+	for _, fs := range old {
+		if fs.name != name {
+			feeds = append(feeds, fs)
+		}
 	}
-	newMap[ip] = true
-	f.blacklist.Store(newMap)
+	f.feeds.Store(feeds)
 }
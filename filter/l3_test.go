@@ -5,9 +5,7 @@ import (
 )
 
 func TestL3Filter(t *testing.T) {
-	f := &L3Filter{
-		Blacklist: make(map[string]bool),
-	}
+	f := NewL3Filter(nil, nil)
 
 	ip := "1.2.3.4"
 	if f.IsBlacklisted(ip) {
@@ -28,3 +26,27 @@ func TestL3Filter(t *testing.T) {
 		t.Error("Expected 127.0.0.1 to not be blacklisted")
 	}
 }
+
+func TestL3FilterCIDR(t *testing.T) {
+	f := NewL3Filter([]string{"10.0.0.0/8", "2001:db8::/32"}, NewIPSet([]string{"10.9.0.0/16"}))
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"10.1.2.3:4567", true},
+		{"[2001:db8::5]:443", true},
+		{"2001:db8::5", true},
+		{"10.9.1.1", false}, // whitelist takes precedence
+		{"11.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := f.IsBlacklisted(tt.ip); got != tt.want {
+			t.Errorf("IsBlacklisted(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if !f.IsWhitelisted("10.9.200.1") {
+		t.Error("10.9.200.1 should be whitelisted")
+	}
+}
@@ -2,72 +2,229 @@ package filter
 
 import (
 	"net"
-	"time"
+	"net/netip"
+	"strconv"
+	"sync"
 
 	"aegisedge/logger"
-	"aegisedge/store"
 )
 
+// Default prefix lengths that connections are aggregated under for the
+// per-subnet limit: a /24 or an IPv6 /64 is what one customer usually gets.
+const (
+	DefaultL4IPv4Prefix = 24
+	DefaultL4IPv6Prefix = 64
+)
+
+// L4Limits are the concurrent connection ceilings for a listener. In a
+// per-port override, a zero field inherits the global setting and a
+// negative one turns the port's own limit off.
+type L4Limits struct {
+	PerIP      int `json:"conn_limit,omitempty"`
+	PerSubnet  int `json:"subnet_conn_limit,omitempty"`
+	Global     int `json:"global_conn_limit,omitempty"`
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
 type L4Filter struct {
-	MaxConnPerIP int
-	IdleTimeout  time.Duration
-	Whitelist    map[string]bool
-	store        store.Storer
+	MaxConnPerIP     int
+	MaxConnPerSubnet int // per IPv4Prefix / IPv6Prefix network
+	MaxConnGlobal    int // across all clients
+	IPv4Prefix       int
+	IPv6Prefix       int
+	Whitelist        *IPSet
+	conns            *connCounts // shared with ForPort filters
+	scope            string      // counter key prefix; per-port filters count apart
+	shared           *L4Filter   // for a per-port filter, the filter whose limits also apply
 }
 
-func NewL4Filter(maxConn int, idleTimeout time.Duration, s store.Storer, whitelist []string) *L4Filter {
-	wl := make(map[string]bool)
-	for _, ip := range whitelist {
-		wl[ip] = true
-	}
+func NewL4Filter(maxConn int, whitelist *IPSet) *L4Filter {
 	return &L4Filter{
 		MaxConnPerIP: maxConn,
-		IdleTimeout:  idleTimeout,
-		Whitelist:    wl,
-		store:        s,
+		IPv4Prefix:   DefaultL4IPv4Prefix,
+		IPv6Prefix:   DefaultL4IPv6Prefix,
+		Whitelist:    whitelist,
+		conns:        &connCounts{n: make(map[string]int)},
+		scope:        "l4:conn:",
 	}
 }
 
-func (f *L4Filter) AllowConnection(addr string) bool {
-	// Performance Bypass: If limit is 0, skip all tracking and locks
-	if f.MaxConnPerIP <= 0 {
-		return true
+// SetLimits replaces the subnet, global and per-IP limits. Zero prefix
+// lengths keep the current ones.
+func (f *L4Filter) SetLimits(l L4Limits) {
+	f.MaxConnPerIP = l.PerIP
+	f.MaxConnPerSubnet = l.PerSubnet
+	f.MaxConnGlobal = l.Global
+	if l.IPv4Prefix > 0 && l.IPv4Prefix <= 32 {
+		f.IPv4Prefix = l.IPv4Prefix
 	}
+	if l.IPv6Prefix > 0 && l.IPv6Prefix <= 128 {
+		f.IPv6Prefix = l.IPv6Prefix
+	}
+}
 
-	host, _, _ := net.SplitHostPort(addr)
-	
-	// Whitelist takes absolute precedence
-	if f.Whitelist[host] {
-		return true
+// Limits returns the filter's current limits.
+func (f *L4Filter) Limits() L4Limits {
+	return L4Limits{
+		PerIP:      f.MaxConnPerIP,
+		PerSubnet:  f.MaxConnPerSubnet,
+		Global:     f.MaxConnGlobal,
+		IPv4Prefix: f.IPv4Prefix,
+		IPv6Prefix: f.IPv6Prefix,
+	}
+}
+
+// ForPort returns a filter for one listen or tcp_ports port, with override
+// applied on top of f's limits. Its own counters apply to that port alone,
+// so its global limit caps the port; a connection must also fit under f's
+// limits, which every port shares.
+func (f *L4Filter) ForPort(port int, override L4Limits) *L4Filter {
+	pf := *f
+	pf.scope = "l4:conn:" + strconv.Itoa(port) + ":"
+	pf.shared = f
+	l := f.Limits()
+	inherit := func(dst *int, v int) {
+		if v != 0 {
+			*dst = v
+		}
 	}
+	inherit(&l.PerIP, override.PerIP)
+	inherit(&l.PerSubnet, override.PerSubnet)
+	inherit(&l.Global, override.Global)
+	inherit(&l.IPv4Prefix, override.IPv4Prefix)
+	inherit(&l.IPv6Prefix, override.IPv6Prefix)
+	pf.SetLimits(l)
+	return &pf
+}
+
+func (f *L4Filter) enabled() bool {
+	return f.MaxConnPerIP > 0 || f.MaxConnPerSubnet > 0 || f.MaxConnGlobal > 0 ||
+		(f.shared != nil && f.shared.enabled())
+}
+
+// l4Counter is one limit a connection is counted against.
+type l4Counter struct {
+	key    string
+	limit  int
+	reason string
+}
 
-	key := "l4:conn:" + host
+// counters returns the limits that apply to host, broadest first: the
+// shared ones, then a per-port filter's own.
+func (f *L4Filter) counters(host string) []l4Counter {
+	out := make([]l4Counter, 0, 6)
+	if f.shared != nil {
+		out = append(out, f.shared.counters(host)...)
+	}
+	if f.MaxConnGlobal > 0 {
+		out = append(out, l4Counter{f.scope + "global", f.MaxConnGlobal, "global_conn_limit"})
+	}
+	if f.MaxConnPerSubnet > 0 {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addr = addr.Unmap().WithZone("")
+			bits := f.IPv6Prefix
+			if addr.Is4() {
+				bits = f.IPv4Prefix
+			}
+			subnet := netip.PrefixFrom(addr, bits).Masked()
+			out = append(out, l4Counter{f.scope + "net:" + subnet.String(), f.MaxConnPerSubnet, "subnet_conn_limit"})
+		}
+	}
+	if f.MaxConnPerIP > 0 {
+		out = append(out, l4Counter{f.scope + host, f.MaxConnPerIP, "conn_limit"})
+	}
+	return out
+}
 
-	count, err := f.store.Increment(key, f.IdleTimeout)
+func splitL4Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		logger.Error("L4 store error (fail open)", "err", err, "ip", host)
-		return true // Fail open
+		return addr
 	}
+	return host
+}
+
+func (f *L4Filter) AllowConnection(addr string) bool {
+	return f.Admit(addr) == ""
+}
 
-	if int(count) > f.MaxConnPerIP {
-		logger.Warn("L4 connection limit exceeded", "ip", host, "count", count, "limit", f.MaxConnPerIP)
-		return false
+// Admit claims a connection slot for addr under every configured limit. It
+// returns "" when the connection may proceed, or the limit it exceeded:
+// conn_limit, subnet_conn_limit or global_conn_limit.
+func (f *L4Filter) Admit(addr string) string {
+	// Performance Bypass: If no limit is set, skip all tracking and locks
+	if !f.enabled() {
+		return ""
 	}
-	return true
+
+	host := splitL4Host(addr)
+
+	// Whitelist takes absolute precedence
+	if f.Whitelist.Contains(host) {
+		return ""
+	}
+
+	if c, count := f.conns.acquire(f.counters(host)); c != nil {
+		logger.Warn("L4 connection limit exceeded", "ip", host, "limit_type", c.reason, "key", c.key, "count", count, "limit", c.limit)
+		return c.reason
+	}
+	return ""
 }
 
 func (f *L4Filter) ReleaseConnection(addr string) {
-	// Performance Bypass: If limit is 0, skip all tracking and locks
-	if f.MaxConnPerIP <= 0 {
+	// Performance Bypass: If no limit is set, skip all tracking and locks
+	if !f.enabled() {
 		return
 	}
 
-	host, _, _ := net.SplitHostPort(addr)
-	key := "l4:conn:" + host
-	
-	_, err := f.store.Decrement(key)
-	if err != nil {
-		logger.Error("L4 store decrement error", "err", err, "ip", host)
+	host := splitL4Host(addr)
+	// Whitelisted connections never claimed a slot
+	if f.Whitelist.Contains(host) {
+		return
 	}
+	f.conns.release(f.counters(host))
+}
+
+// connCounts holds open connection counts. They live in process, since the
+// connections do, and never expire: a count lasts exactly as long as the
+// connections it counts, however long those stay open.
+type connCounts struct {
+	mu sync.Mutex
+	n  map[string]int
 }
 
+// acquire claims a slot under every counter, or under none if one is full.
+// It returns the full counter and what its count would have been.
+func (c *connCounts) acquire(counters []l4Counter) (*l4Counter, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range counters {
+		if n := c.n[counters[i].key]; n >= counters[i].limit {
+			return &counters[i], n + 1
+		}
+	}
+	for _, k := range counters {
+		c.n[k.key]++
+	}
+	return nil, 0
+}
+
+func (c *connCounts) release(counters []l4Counter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range counters {
+		if c.n[k.key] <= 1 {
+			delete(c.n, k.key) // never below zero, and no empty entries left behind
+		} else {
+			c.n[k.key]--
+		}
+	}
+}
+
+// count returns the open connections under key.
+func (c *connCounts) count(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n[key]
+}
@@ -2,15 +2,11 @@ package filter
 
 import (
 	"testing"
-	"time"
-
-	"aegisedge/store"
 )
 
 func TestL4Filter(t *testing.T) {
-	s := store.NewLocalStore()
 	// Set a small limit of 2 conns per IP
-	f := NewL4Filter(2, 1*time.Minute, s)
+	f := NewL4Filter(2, nil)
 
 	addr := "1.1.1.1:1234"
 	ip := "1.1.1.1"
@@ -19,12 +15,8 @@ func TestL4Filter(t *testing.T) {
 		t.Error("Initial connection should be allowed")
 	}
 	
-	count, err := s.GetCounter("l4:conn:" + ip)
-	if err != nil {
-		t.Fatalf("GetCounter failed: %v", err)
-	}
-	if count != 1 {
-		t.Errorf("Expected 1 connection in store for %s, got %d", ip, count)
+	if count := f.conns.count("l4:conn:" + ip); count != 1 {
+		t.Errorf("Expected 1 connection counted for %s, got %d", ip, count)
 	}
 
 	if !f.AllowConnection(addr) {
@@ -36,11 +28,152 @@ func TestL4Filter(t *testing.T) {
 	}
 
 	f.ReleaseConnection(addr)
-	count, err = s.GetCounter("l4:conn:" + ip)
-	if err != nil {
-		t.Fatalf("GetCounter failed: %v", err)
-	}
-	if count != 1 {
+	if count := f.conns.count("l4:conn:" + ip); count != 1 {
 		t.Errorf("Expected 1 connection after release, got %d", count)
 	}
 }
+
+func TestL4FilterRejectionReleasesSlot(t *testing.T) {
+	f := NewL4Filter(1, nil)
+
+	f.AllowConnection("5.5.5.5:1")
+	for i := 0; i < 3; i++ {
+		if f.AllowConnection("5.5.5.5:1") {
+			t.Fatal("connection over the limit allowed")
+		}
+	}
+	if n := f.conns.count("l4:conn:5.5.5.5"); n != 1 {
+		t.Errorf("count = %d after rejections, want 1", n)
+	}
+	// Releasing the one admitted connection frees the IP again
+	f.ReleaseConnection("5.5.5.5:1")
+	if !f.AllowConnection("5.5.5.5:1") {
+		t.Error("IP still blocked after its only connection closed")
+	}
+}
+
+func TestL4FilterCountsNeverGoNegative(t *testing.T) {
+	f := NewL4Filter(0, nil)
+	f.SetLimits(L4Limits{PerIP: 1, Global: 1})
+
+	// Stray releases must not bank slots for later connections
+	f.ReleaseConnection("6.6.6.6:1")
+	f.ReleaseConnection("6.6.6.6:1")
+	if !f.AllowConnection("6.6.6.6:1") {
+		t.Fatal("first connection refused")
+	}
+	if f.AllowConnection("7.7.7.7:1") {
+		t.Error("global limit loosened by releases without connections")
+	}
+	f.ReleaseConnection("6.6.6.6:1")
+	if n := f.conns.count("l4:conn:global"); n != 0 {
+		t.Errorf("global count = %d after the last release, want 0", n)
+	}
+}
+
+func TestL4FilterSubnetAndGlobalLimits(t *testing.T) {
+	f := NewL4Filter(0, NewIPSet([]string{"10.9.9.9"}))
+	f.SetLimits(L4Limits{PerSubnet: 2, Global: 5})
+
+	steps := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.1:1000", ""},
+		{"203.0.113.2:1000", ""},
+		{"203.0.113.3:1000", "subnet_conn_limit"}, // same /24
+		{"[2001:db8:1:1::1]:1000", ""},
+		{"[2001:db8:1:1:ffff::2]:1000", ""},
+		{"[2001:db8:1:1::3]:1000", "subnet_conn_limit"}, // same /64
+		{"198.51.100.1:1000", ""},
+		{"198.51.100.2:1000", "global_conn_limit"},
+		{"10.9.9.9:1000", ""}, // whitelisted
+	}
+	for _, st := range steps {
+		if got := f.Admit(st.addr); got != st.want {
+			t.Errorf("Admit(%s) = %q, want %q", st.addr, got, st.want)
+		}
+	}
+	if n := f.conns.count("l4:conn:global"); n != 5 {
+		t.Errorf("global count = %d, want 5 (rejections must roll back)", n)
+	}
+
+	f.ReleaseConnection("203.0.113.1:1000")
+	f.ReleaseConnection("10.9.9.9:1000")
+	if n := f.conns.count("l4:conn:global"); n != 4 {
+		t.Errorf("global count after release = %d, want 4", n)
+	}
+	if got := f.Admit("203.0.113.3:1000"); got != "" {
+		t.Errorf("released slot should be reusable, got %q", got)
+	}
+}
+
+func TestL4FilterForPort(t *testing.T) {
+	f := NewL4Filter(10, nil)
+	f.SetLimits(L4Limits{PerIP: 10, PerSubnet: 20})
+	ssh := f.ForPort(22, L4Limits{PerIP: 1, PerSubnet: -1, IPv4Prefix: 16})
+
+	if l := ssh.Limits(); l.PerIP != 1 || l.PerSubnet > 0 || l.IPv4Prefix != 16 || l.IPv6Prefix != DefaultL4IPv6Prefix {
+		t.Errorf("unexpected port limits: %+v", l)
+	}
+	if !ssh.AllowConnection("192.0.2.1:5000") {
+		t.Fatal("first SSH connection should be allowed")
+	}
+	if ssh.AllowConnection("192.0.2.1:5001") {
+		t.Error("second SSH connection from the same IP should be rejected")
+	}
+	// The port's own limit doesn't reach other ports
+	if !f.AllowConnection("192.0.2.1:5002") {
+		t.Error("other ports should not be held to the SSH limit")
+	}
+	if n := f.conns.count("l4:conn:22:192.0.2.1"); n != 1 {
+		t.Errorf("port counter = %d, want 1", n)
+	}
+	if n := f.conns.count("l4:conn:192.0.2.1"); n != 2 {
+		t.Errorf("shared counter = %d, want 2 (both ports)", n)
+	}
+}
+
+func TestL4FilterForPortChargesSharedLimits(t *testing.T) {
+	f := NewL4Filter(0, nil)
+	f.SetLimits(L4Limits{PerIP: 2, Global: 3})
+	web := f.ForPort(443, L4Limits{PerIP: 5})
+	ssh := f.ForPort(22, L4Limits{Global: 10})
+
+	// The global ceiling holds across ports, whatever their own limits
+	for _, st := range []struct {
+		f    *L4Filter
+		addr string
+		want string
+	}{
+		{web, "198.51.100.1:1", ""},
+		{ssh, "198.51.100.2:1", ""},
+		{f, "198.51.100.3:1", ""},
+		{ssh, "198.51.100.4:1", "global_conn_limit"},
+		{web, "198.51.100.5:1", "global_conn_limit"},
+	} {
+		if got := st.f.Admit(st.addr); got != st.want {
+			t.Errorf("Admit(%s) = %q, want %q", st.addr, got, st.want)
+		}
+	}
+	web.ReleaseConnection("198.51.100.1:1")
+	if n := f.conns.count("l4:conn:global"); n != 2 {
+		t.Errorf("global count = %d after release, want 2", n)
+	}
+
+	// A client's per-IP slots are shared across ports too
+	if got := web.Admit("203.0.113.9:1"); got != "" {
+		t.Fatalf("first connection refused: %q", got)
+	}
+	if got := ssh.Admit("203.0.113.9:2"); got != "global_conn_limit" {
+		t.Errorf("Admit over the global limit = %q", got)
+	}
+	ssh.ReleaseConnection("198.51.100.2:1")
+	if got := ssh.Admit("203.0.113.9:2"); got != "" {
+		t.Errorf("second connection refused: %q", got)
+	}
+	f.ReleaseConnection("198.51.100.3:1") // room under the global limit
+	if got := web.Admit("203.0.113.9:3"); got != "conn_limit" {
+		t.Errorf("third connection from one IP across ports = %q, want conn_limit", got)
+	}
+}
@@ -3,9 +3,11 @@ package filter
 import (
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"aegisedge/logger"
+	"aegisedge/store"
 	"aegisedge/util"
 
 	"golang.org/x/time/rate"
@@ -29,23 +31,32 @@ type shard struct {
 // L7Filter enforces per-IP Token Bucket rate limiting with sharded locks for 10k+ RPS scale.
 type L7Filter struct {
 	shards       [numShards]*shard
-	Whitelist    map[string]bool
+	Whitelist    *IPSet
 	DefaultRate  float64
 	DefaultBurst int
+	// Challenge wraps a handler in the JS challenge; required for policies
+	// with the challenge action.
+	Challenge func(http.Handler) http.Handler
+	// Key groups requests into default buckets; nil keys on client IP.
+	Key *RateLimitKey
+	// JWT verifies tokens for jwt: components of policy keys; nil reads
+	// claims unverified.
+	JWT *JWTVerifier
+	policies  atomic.Value // stores []*RateLimitPolicy
+	dist      *storeLimiter // cluster-wide buckets; nil keeps them in memory
+	shadow    atomic.Bool
+	shadowRec atomic.Value // stores *shadowRecorder
 	stop         chan struct{}
 }
 
-func NewL7Filter(rateLimit float64, burstLimit int, whitelist []string) *L7Filter {
-	wl := make(map[string]bool)
-	for _, ip := range whitelist {
-		wl[ip] = true
-	}
+func NewL7Filter(rateLimit float64, burstLimit int, whitelist *IPSet) *L7Filter {
 	f := &L7Filter{
-		Whitelist:    wl,
+		Whitelist:    whitelist,
 		DefaultRate:  rateLimit,
 		DefaultBurst: burstLimit,
 		stop:         make(chan struct{}),
 	}
+	f.shadowRec.Store(newShadowRecorder(time.Now()))
 	for i := 0; i < numShards; i++ {
 		f.shards[i] = &shard{
 			limiters: make(map[string]*limiterEntry),
@@ -60,6 +71,13 @@ func (f *L7Filter) Stop() {
 	close(f.stop)
 }
 
+// UseStore keeps the default and policy buckets in s instead of in memory,
+// so nodes sharing a Redis store enforce one limit between them. Call it
+// before Middleware.
+func (f *L7Filter) UseStore(s store.Storer) {
+	f.dist = newStoreLimiter(s, "rl:")
+}
+
 func (f *L7Filter) getShard(ip string) *shard {
 	// Simple hash for IP to shard
 	hash := uint32(0)
@@ -69,14 +87,17 @@ func (f *L7Filter) getShard(ip string) *shard {
 	return f.shards[hash%numShards]
 }
 
-// getLimiter returns both the limiter and the cached multiplier for an IP.
-func (f *L7Filter) getLimiter(ip string, rep *ReputationManager) (*rate.Limiter, float64) {
-	s := f.getShard(ip)
+// getLimiter returns both the limiter and the cached multiplier for a
+// bucket key. When the bucket is ip's own, the multiplier follows that
+// client's reputation; a bucket shared between addresses (an API key, a
+// claim) keeps its configured size whoever is asking.
+func (f *L7Filter) getLimiter(key, ip string, rep *ReputationManager) (*rate.Limiter, float64) {
+	s := f.getShard(key)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	now := time.Now()
-	entry, exists := s.limiters[ip]
+	entry, exists := s.limiters[key]
 	
 	if !exists {
 		entry = &limiterEntry{
@@ -84,12 +105,12 @@ func (f *L7Filter) getLimiter(ip string, rep *ReputationManager) (*rate.Limiter,
 			multiplier: 1.0,
 			lastUpdate: time.Time{}, // Force immediate update
 		}
-		s.limiters[ip] = entry
+		s.limiters[key] = entry
 	}
-	s.lastSeen[ip] = now
+	s.lastSeen[key] = now
 
 	// Optimization: Only refresh reputation score every 2 seconds to save store cycles
-	if rep != nil && now.Sub(entry.lastUpdate) > 2*time.Second {
+	if rep != nil && key == ip && now.Sub(entry.lastUpdate) > 2*time.Second {
 		entry.multiplier = rep.GetMultiplier(ip)
 		entry.lastUpdate = now
 		entry.limiter.SetLimit(rate.Limit(f.DefaultRate * entry.multiplier))
@@ -99,6 +120,91 @@ func (f *L7Filter) getLimiter(ip string, rep *ReputationManager) (*rate.Limiter,
 	return entry.limiter, entry.multiplier
 }
 
+// keyedLimiters is a sharded set of fixed-rate token buckets, keyed by
+// whatever the caller groups traffic by (an ASN, an IP within a country).
+type keyedLimiters struct {
+	rate   float64
+	burst  int
+	shards [numShards]*shard
+}
+
+func newKeyedLimiters(r float64, burst int) *keyedLimiters {
+	k := &keyedLimiters{rate: r, burst: burst}
+	for i := range k.shards {
+		k.shards[i] = &shard{
+			limiters: make(map[string]*limiterEntry),
+			lastSeen: make(map[string]time.Time),
+		}
+	}
+	return k
+}
+
+func (k *keyedLimiters) allow(key string) bool {
+	return k.take(key).allowed
+}
+
+// take is allow, also returning the bucket's state.
+func (k *keyedLimiters) take(key string) rateLimitState {
+	return k.takeAt(key, time.Now())
+}
+
+// takeAt is take at a given time, for replaying recorded traffic.
+func (k *keyedLimiters) takeAt(key string, now time.Time) rateLimitState {
+	hash := uint32(0)
+	for i := 0; i < len(key); i++ {
+		hash = 31*hash + uint32(key[i])
+	}
+	s := k.shards[hash%numShards]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.limiters[key]
+	if !exists {
+		entry = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(k.rate), k.burst), multiplier: 1.0}
+		s.limiters[key] = entry
+	}
+	s.lastSeen[key] = now
+	allowed := entry.limiter.AllowN(now, 1)
+	return limiterState(entry.limiter, now, allowed)
+}
+
+// reserve takes a token for key, however long it takes to become
+// available; the caller waits Delay() or cancels the reservation. The
+// state is the bucket's once the reservation is taken.
+func (k *keyedLimiters) reserve(key string) (*rate.Reservation, rateLimitState) {
+	hash := uint32(0)
+	for i := 0; i < len(key); i++ {
+		hash = 31*hash + uint32(key[i])
+	}
+	s := k.shards[hash%numShards]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.limiters[key]
+	if !exists {
+		entry = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(k.rate), k.burst), multiplier: 1.0}
+		s.limiters[key] = entry
+	}
+	now := time.Now()
+	s.lastSeen[key] = now
+	res := entry.limiter.ReserveN(now, 1)
+	return res, limiterState(entry.limiter, now, true)
+}
+
+// purge drops buckets idle for longer than idle.
+func (k *keyedLimiters) purge(idle time.Duration) {
+	for _, s := range k.shards {
+		s.mu.Lock()
+		for key, last := range s.lastSeen {
+			if time.Since(last) > idle {
+				delete(s.limiters, key)
+				delete(s.lastSeen, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
 // cleanupLoop removes stale entries from all shards concurrently.
 func (f *L7Filter) cleanupLoop() {
 	ticker := time.NewTicker(5 * time.Minute)
@@ -117,6 +223,14 @@ func (f *L7Filter) cleanupLoop() {
 				}
 				s.mu.Unlock()
 			}
+			for _, p := range f.Policies() {
+				if p.limiters != nil {
+					p.limiters.purge(10 * time.Minute)
+				}
+			}
+			if f.dist != nil {
+				f.dist.purge(10 * time.Minute)
+			}
 			logger.Info("L7 limiter: sharded stale IP entries purged")
 		case <-f.stop:
 			return
@@ -125,34 +239,49 @@ func (f *L7Filter) cleanupLoop() {
 }
 
 func (f *L7Filter) Middleware(next http.Handler, rep *ReputationManager) http.Handler {
+	challenged := next
+	if f.Challenge != nil {
+		challenged = f.Challenge(next) // pre-built, like wrapToggle
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		host := util.GetRealIP(r)
 
 		// Whitelist takes absolute precedence
-		if f.Whitelist[host] {
+		if f.Whitelist.Contains(host) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		limiter, multiplier := f.getLimiter(host, rep)
-
-		if !limiter.AllowN(time.Now(), 1) {
-			logger.Warn("L7 rate limit exceeded", "remote_addr", host, "multiplier", multiplier)
-
-			if rep != nil {
-				rep.Penalize(host)
+		// A matching policy replaces the default per-IP bucket
+		if p := f.policyFor(r); p != nil {
+			if f.applyPolicy(p, w, r, challenged, rep) {
+				return
 			}
+		} else {
+			key := f.Key.Key(r)
+			limiter, multiplier := f.getLimiter(key, host, rep)
 
-			if MetricsEnabled() {
-				BlockedRequests.WithLabelValues("L7", "rate_limit").Inc()
+			var st rateLimitState
+			if f.dist != nil {
+				st = f.dist.allow("default:"+key, float64(limiter.Limit()), limiter.Burst())
+			} else {
+				now := time.Now()
+				st = limiterState(limiter, now, limiter.AllowN(now, 1))
+			}
+			switch {
+			case f.shadow.Load():
+				f.recorder().requests.Add(1)
+				if !st.allowed {
+					f.shadowHit(r, "default", key, RateLimitReject)
+				}
+			case !st.allowed:
+				logger.Warn("L7 rate limit exceeded", "remote_addr", host, "key", key, "asn", util.GetASN(r), "multiplier", multiplier)
+				f.reject(w, r, "default", key, st, rep)
+				return
+			default:
+				st.setHeaders(w.Header())
 			}
-			IncrementL7Blocks()
-			
-			// Potential "Fast-Path" trigger point for repeat offenders
-			TriggerSoftBlock(host) 
-
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			return
 		}
 
 		if r.Header.Get("User-Agent") == "" {
@@ -166,3 +295,36 @@ func (f *L7Filter) Middleware(next http.Handler, rep *ReputationManager) http.Ha
 		next.ServeHTTP(w, r)
 	})
 }
+
+// reject answers a request over its rate limit with 429. When the bucket
+// key is the client's IP, the violation also counts against that IP; an
+// exhausted shared bucket (one API key behind a NAT) says nothing about
+// the address it was used from.
+func (f *L7Filter) reject(w http.ResponseWriter, r *http.Request, policy, key string, st rateLimitState, rep *ReputationManager) {
+	host := util.GetRealIP(r)
+	if policy != "default" {
+		logger.Warn("Rate limit policy exceeded", "policy", policy, "remote_addr", host, "asn", util.GetASN(r), "path", r.URL.Path)
+	}
+
+	perIP := key == host
+	if rep != nil && perIP {
+		rep.Penalize(host)
+	}
+
+	if MetricsEnabled() {
+		reason := "rate_limit"
+		if policy != "default" {
+			reason = "rate_limit:" + policy
+		}
+		BlockedRequests.WithLabelValues("L7", reason).Inc()
+	}
+	f.countPolicy(policy, RateLimitReject)
+	IncrementL7Blocks()
+
+	// Potential "Fast-Path" trigger point for repeat offenders
+	if perIP {
+		TriggerSoftBlock(host)
+	}
+
+	writeRateLimited(w, r, st, policy)
+}
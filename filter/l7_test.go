@@ -1,10 +1,15 @@
 package filter
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"aegisedge/store"
 )
 
 func TestL7Filter(t *testing.T) {
@@ -22,6 +27,7 @@ func TestL7Filter(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		req := httptest.NewRequest("GET", "/", nil)
 		req.RemoteAddr = ip
+		req.Header.Set("User-Agent", "Mozilla/5.0")
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
 		if rr.Code != http.StatusOK {
@@ -32,6 +38,7 @@ func TestL7Filter(t *testing.T) {
 	// 2. Trigger rate limit
 	req := httptest.NewRequest("GET", "/", nil)
 	req.RemoteAddr = ip
+	req.Header.Set("User-Agent", "Mozilla/5.0")
 	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, req)
 	if rr.Code != http.StatusTooManyRequests {
@@ -44,3 +51,237 @@ func TestL7Filter(t *testing.T) {
 	// This test is harder to verify precisely without sleeping, 
 	// but we can verify the multiplier logic in reputation_test.go
 }
+
+func TestL7FilterPolicies(t *testing.T) {
+	f := NewL7Filter(100, 100, nil)
+	defer f.Stop()
+	f.Challenge = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable) // challenge page
+		})
+	}
+	err := f.SetPolicies([]RateLimitPolicy{
+		{Name: "login", Path: "/login", Methods: []string{"post"}, Rate: 2, Window: "1m"},
+		{Name: "static", Path: "/static/*"},
+		{Name: "api-keys", Host: "api.example.com", Headers: map[string]string{"x-api-key": "*"}, Rate: 1, Burst: 1, Action: "challenge"},
+		{Name: "search", Path: "/search*", Headers: map[string]string{"Accept": "*json*"}, Rate: 1, Burst: 1, Action: "tarpit"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), NewReputationManager(nil))
+
+	tests := []struct {
+		name    string
+		method  string
+		host    string
+		path    string
+		headers map[string]string
+		want    []int
+	}{
+		{"login budget", "POST", "example.com", "/login", nil, []int{200, 200, 429}},
+		{"login GET uses default bucket", "GET", "example.com", "/login", nil, []int{200, 200, 200}},
+		{"static exempt", "GET", "example.com", "/static/app.js", nil, []int{200, 200, 200}},
+		{"api key challenged", "GET", "api.example.com", "/v1", map[string]string{"X-Api-Key": "k"}, []int{200, 503}},
+		{"api without key", "GET", "api.example.com", "/v1", nil, []int{200, 200}},
+		{"search tarpit serves", "GET", "example.com", "/search?q=x", map[string]string{"Accept": "application/json"}, []int{200}},
+	}
+	for i, tt := range tests {
+		ip := "10.0.0." + string(rune('1'+i))
+		for n, want := range tt.want {
+			req := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, nil)
+			req.RemoteAddr = ip + ":1234"
+			req.Header.Set("User-Agent", "Mozilla/5.0")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != want {
+				t.Errorf("%s: request %d got %d, want %d", tt.name, n, rr.Code, want)
+			}
+		}
+	}
+}
+
+func TestL7FilterTarpitWaits(t *testing.T) {
+	f := NewL7Filter(100, 100, nil)
+	defer f.Stop()
+	if err := f.SetPolicies([]RateLimitPolicy{{Name: "slow", Rate: 10, Burst: 1, Action: "tarpit"}}); err != nil {
+		t.Fatal(err)
+	}
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("tarpitted request %d got %d", i, rr.Code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("3 requests at 10/s with burst 1 took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestL7FilterTarpitStopsWhenClientLeaves(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		f := NewL7Filter(100, 100, nil)
+		defer f.Stop()
+		if shared {
+			f.UseStore(store.NewLocalStore())
+		}
+		if err := f.SetPolicies([]RateLimitPolicy{{Name: "slow", Rate: 1, Burst: 1, Action: "tarpit"}}); err != nil {
+			t.Fatal(err)
+		}
+		served := 0
+		handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }), nil)
+		serve := func(ctx context.Context) {
+			req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+			req.Header.Set("User-Agent", "Mozilla/5.0")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		serve(context.Background())
+		// The next token is a second away; the client hangs up long before
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		serve(ctx)
+		cancel()
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("shared=%v: tarpit held a departed client for %v", shared, elapsed)
+		}
+		if served != 1 {
+			t.Errorf("shared=%v: %d requests reached the upstream, want 1", shared, served)
+		}
+	}
+}
+
+func TestL7FilterSharedStore(t *testing.T) {
+	// Two nodes sharing one store draw from one bucket per client
+	s := store.NewLocalStore()
+	var handlers []http.Handler
+	for i := 0; i < 2; i++ {
+		f := NewL7Filter(1, 8, nil)
+		defer f.Stop()
+		f.UseStore(s)
+		handlers = append(handlers, f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil))
+	}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "1.2.3.4:5555"
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		rr := httptest.NewRecorder()
+		handlers[i%2].ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			allowed++
+		}
+	}
+	if allowed != 8 {
+		t.Errorf("two nodes allowed %d of 10 requests, want the shared burst of 8", allowed)
+	}
+
+	// Another client has its own bucket
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "5.6.7.8:5555"
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	rr := httptest.NewRecorder()
+	handlers[0].ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("other client got %d", rr.Code)
+	}
+}
+
+func TestL7FilterRateLimitHeaders(t *testing.T) {
+	f := NewL7Filter(1, 2, nil)
+	defer f.Stop()
+	if err := f.SetPolicies([]RateLimitPolicy{{Name: "login", Path: "/login", Rate: 1, Burst: 1, Window: "1m"}}); err != nil {
+		t.Fatal(err)
+	}
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil)
+	send := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i, want := range []string{"1", "0"} {
+		rr := send("/", "*/*")
+		if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != want {
+			t.Fatalf("request %d: got %d with headers %v", i, rr.Code, rr.Header())
+		}
+	}
+
+	tests := []struct {
+		path, accept, contentType string
+	}{
+		{"/", "application/json", "application/problem+json"},
+		{"/", "", "application/problem+json"},
+		{"/", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"/", "application/json, text/html;q=0.5", "application/problem+json"},
+		{"/login", "application/json", "application/problem+json"},
+	}
+	send("/login", "") // spend the login policy's only token
+	for _, tt := range tests {
+		rr := send(tt.path, tt.accept)
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s %q: got %d", tt.path, tt.accept, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("%s %q: Content-Type %q, want %q", tt.path, tt.accept, ct, tt.contentType)
+		}
+		if rr.Header().Get("Retry-After") == "" || rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("RateLimit-Reset") == "" {
+			t.Errorf("%s %q: missing rate limit headers: %v", tt.path, tt.accept, rr.Header())
+		}
+		if !strings.HasSuffix(tt.contentType, "json") {
+			continue
+		}
+		var problem struct {
+			Status     int    `json:"status"`
+			Policy     string `json:"policy"`
+			RetryAfter int    `json:"retry_after"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil {
+			t.Fatalf("%s: bad problem body %q: %v", tt.path, rr.Body, err)
+		}
+		wantPolicy := "default"
+		if tt.path == "/login" {
+			wantPolicy = "login"
+		}
+		if problem.Status != 429 || problem.Policy != wantPolicy || problem.RetryAfter < 1 {
+			t.Errorf("%s: got problem %+v", tt.path, problem)
+		}
+	}
+
+	// One login per minute: the client is told to come back in about a minute
+	rr := send("/login", "")
+	if got := rr.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("login Retry-After = %q, want 60", got)
+	}
+}
+
+func TestL7FilterPolicyValidation(t *testing.T) {
+	bad := [][]RateLimitPolicy{
+		{{Rate: 1}},
+		{{Name: "default", Rate: 1}},
+		{{Name: "a", Rate: 1, Action: "drop"}},
+		{{Name: "a", Rate: 1, Window: "soon"}},
+		{{Name: "a", Rate: 1, Action: "challenge"}}, // no Challenge handler
+		{{Name: "a", Rate: 1}, {Name: "a", Rate: 2}},
+	}
+	for i, policies := range bad {
+		f := NewL7Filter(1, 1, nil)
+		if err := f.SetPolicies(policies); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+		f.Stop()
+	}
+}
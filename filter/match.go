@@ -0,0 +1,33 @@
+package filter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostMatches reports whether the request's Host matches pattern: an exact
+// lower-case name, "*.example.com" for any subdomain, or "" for any host.
+func hostMatches(pattern string, r *http.Request) bool {
+	if pattern == "" {
+		return true
+	}
+	return matchHostPattern(pattern, requestHost(r))
+}
+
+// matchHostPattern is hostMatches for a lower-case host name.
+func matchHostPattern(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+// requestHost returns r's Host without the port, lowercased.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
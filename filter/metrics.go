@@ -17,6 +17,70 @@ var (
 		[]string{"layer", "reason"},
 	)
 
+	WAFDetectOnlyMatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aegisedge_waf_detect_only_matches_total",
+			Help: "WAF rule matches that were logged but not enforced (detect-only mode)",
+		},
+		[]string{"rule_id"},
+	)
+
+	ResponseLeaks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aegisedge_response_leaks_total",
+			Help: "Sensitive data found in upstream responses, by category and action taken",
+		},
+		[]string{"category", "action"},
+	)
+
+	ASNBlockedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aegisedge_asn_blocked_requests_total",
+			Help: "Requests blocked or rate-limited by ASN policy, by network",
+		},
+		[]string{"asn", "reason"},
+	)
+
+	GeoIPActions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aegisedge_geoip_actions_total",
+			Help: "Country policy matches, by country and action (block, challenge, rate_limit)",
+		},
+		[]string{"country", "action"},
+	)
+
+	RateLimitExceeded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aegisedge_rate_limit_exceeded_total",
+			Help: "Requests over an L7 rate limit, by policy (default for l7_rate_limit) and action taken",
+		},
+		[]string{"policy", "action"},
+	)
+
+	ThreatFeedEntries = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "aegisedge_threat_feed_entries",
+			Help: "Prefixes currently loaded from each threat-intel feed",
+		},
+		[]string{"feed"},
+	)
+
+	HTTPConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "aegisedge_http_connections",
+			Help: "Client connections on the HTTP listeners, by state (active, idle)",
+		},
+		[]string{"state"},
+	)
+
+	StreamConnections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aegisedge_stream_connections_total",
+			Help: "Connections on tcp_ports, by port, detected protocol and outcome (forwarded, rejected, upstream_error)",
+		},
+		[]string{"port", "protocol", "outcome"},
+	)
+
 	ActiveConnections = promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "aegisedge_active_connections",
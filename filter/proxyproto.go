@@ -0,0 +1,443 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol v2 signature, the first 12 bytes of every v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV types.
+const (
+	PP2TypeALPN      = 0x01
+	PP2TypeAuthority = 0x02
+	PP2TypeCRC32C    = 0x03
+	PP2TypeNoop      = 0x04
+	PP2TypeUniqueID  = 0x05
+	PP2TypeSSL       = 0x20
+	PP2TypeNetNS     = 0x30
+	PP2TypeAWS       = 0xEA // AWS sub-type 0x01 is the VPC endpoint ID
+
+	pp2SubtypeSSLVersion = 0x21
+	pp2SubtypeSSLCN      = 0x22
+	pp2SubtypeSSLCipher  = 0x23
+	pp2SubtypeSSLSigAlg  = 0x24
+	pp2SubtypeSSLKeyAlg  = 0x25
+	pp2SubtypeAWSVPCEID  = 0x01
+)
+
+// ProxyHeader is a parsed PROXY protocol (v1 or v2) header: who the load
+// balancer in front of us says the client is.
+type ProxyHeader struct {
+	Version int  // 1 or 2
+	Local   bool // LOCAL command (v2): the balancer's own connection, e.g. a health check
+	// Network is tcp4, tcp6, udp4, udp6, unix or unixgram; "" when the
+	// addresses are unknown (LOCAL, AF_UNSPEC, or v1 UNKNOWN).
+	Network     string
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyTLV // v2 only, in header order
+
+	// Well-known TLVs, decoded
+	ALPN      string
+	Authority string // the host name the client asked for (SNI)
+	UniqueID  string
+	SSL       *ProxySSL
+	AWSVPCEID string
+	NetNS     string
+}
+
+// ProxyTLV is one v2 type-length-value extension.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxySSL is the PP2_TYPE_SSL TLV: how the client connected to the
+// balancer, when it terminated TLS.
+type ProxySSL struct {
+	Client   byte // PP2_CLIENT_SSL (0x01), _CERT_CONN (0x02), _CERT_SESS (0x04)
+	Verified bool // a client certificate was presented and verified
+	Version  string
+	CN       string
+	Cipher   string
+	SigAlg   string
+	KeyAlg   string
+}
+
+// ClientAddr returns the address to treat as the client's: the header's
+// source for a proxied TCP or UDP connection, otherwise peer (the
+// balancer itself), since a LOCAL or UNIX header names no client IP.
+func (h *ProxyHeader) ClientAddr(peer net.Addr) net.Addr {
+	if h == nil || h.Local || h.Source == nil {
+		return peer
+	}
+	switch h.Source.(type) {
+	case *net.TCPAddr, *net.UDPAddr:
+		return h.Source
+	}
+	return peer
+}
+
+// ServerAddr returns the address the client connected to: the header's
+// destination for a proxied TCP or UDP connection, otherwise local.
+func (h *ProxyHeader) ServerAddr(local net.Addr) net.Addr {
+	if h == nil || h.Local || h.Destination == nil {
+		return local
+	}
+	switch h.Destination.(type) {
+	case *net.TCPAddr, *net.UDPAddr:
+		return h.Destination
+	}
+	return local
+}
+
+// ReadProxyHeader reads a PROXY protocol header from the start of br. It
+// returns nil and no error when the stream doesn't start with one, having
+// consumed nothing. That includes a stream that ends or times out before
+// its first byte: a client of a server-speaks-first protocol sends nothing
+// until it is greeted. It blocks until the first byte arrives, so set a
+// read deadline first.
+func ReadProxyHeader(br *bufio.Reader) (*ProxyHeader, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, nil
+	}
+	switch first[0] {
+	case proxyV2Sig[0]:
+		sig, err := br.Peek(len(proxyV2Sig))
+		if err != nil || !bytes.Equal(sig, proxyV2Sig) {
+			return nil, nil
+		}
+		return readProxyV2(br)
+	case 'P':
+		prefix, err := br.Peek(6)
+		if err != nil || string(prefix) != "PROXY " {
+			return nil, nil
+		}
+		return readProxyV1(br)
+	}
+	return nil, nil
+}
+
+// maxProxyV1Line is the longest valid v1 header, CRLF included.
+const maxProxyV1Line = 107
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readProxyV1(br *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < maxProxyV1Line {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not CRLF-terminated")
+	}
+
+	h := &ProxyHeader{Version: 1}
+	parts := strings.Fields(string(line[:len(line)-2]))
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return h, nil // the balancer couldn't tell; the rest is ignored
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	src, err := parseProxyV1Addr(parts[1], parts[2], parts[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(parts[1], parts[3], parts[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Network = strings.ToLower(parts[1])
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseProxyV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (proto == "TCP6") != strings.Contains(ip, ":") {
+		return nil, fmt.Errorf("bad PROXY v1 %s address %q", proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("bad PROXY v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyV2 parses the binary header: the signature, version/command,
+// family/transport, length, addresses and TLVs.
+func readProxyV2(br *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY version %d", fixed[12]>>4)
+	}
+	h := &ProxyHeader{Version: 2}
+	switch fixed[12] & 0x0F {
+	case 0x0:
+		h.Local = true
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unknown PROXY v2 command %#x", fixed[12]&0x0F)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	family, transport := fixed[13]>>4, fixed[13]&0x0F
+	if transport > 2 {
+		return nil, fmt.Errorf("unknown PROXY v2 transport %#x", transport)
+	}
+	var addrLen int
+	switch family {
+	case 0x0: // AF_UNSPEC
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("unknown PROXY v2 address family %#x", family)
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("PROXY v2 header too short for its addresses")
+	}
+	if !h.Local && family != 0 && transport != 0 {
+		h.Network, h.Source, h.Destination = proxyV2Addrs(family, transport, body[:addrLen])
+	}
+
+	if err := h.parseTLVs(body[addrLen:]); err != nil {
+		return nil, err
+	}
+	if crc := h.tlv(PP2TypeCRC32C); crc != nil {
+		if len(crc) != 4 || !proxyV2ChecksumOK(fixed, body, addrLen) {
+			return nil, errors.New("PROXY v2 header checksum mismatch")
+		}
+	}
+	return h, nil
+}
+
+func proxyV2Addrs(family, transport byte, b []byte) (string, net.Addr, net.Addr) {
+	stream := transport == 0x1
+	ipAddr := func(ip net.IP, port uint16) net.Addr {
+		if stream {
+			return &net.TCPAddr{IP: ip, Port: int(port)}
+		}
+		return &net.UDPAddr{IP: ip, Port: int(port)}
+	}
+	proto := "tcp"
+	if !stream {
+		proto = "udp"
+	}
+	switch family {
+	case 0x1:
+		return proto + "4",
+			ipAddr(net.IP(b[0:4]), binary.BigEndian.Uint16(b[8:10])),
+			ipAddr(net.IP(b[4:8]), binary.BigEndian.Uint16(b[10:12]))
+	case 0x2:
+		return proto + "6",
+			ipAddr(net.IP(b[0:16]), binary.BigEndian.Uint16(b[32:34])),
+			ipAddr(net.IP(b[16:32]), binary.BigEndian.Uint16(b[34:36]))
+	}
+	// AF_UNIX: two NUL-padded 108-byte paths
+	network := "unix"
+	if !stream {
+		network = "unixgram"
+	}
+	path := func(p []byte) string {
+		if i := bytes.IndexByte(p, 0); i >= 0 {
+			p = p[:i]
+		}
+		return string(p)
+	}
+	return network,
+		&net.UnixAddr{Name: path(b[0:108]), Net: network},
+		&net.UnixAddr{Name: path(b[108:216]), Net: network}
+}
+
+func (h *ProxyHeader) parseTLVs(b []byte) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errors.New("truncated PROXY v2 TLV")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return errors.New("truncated PROXY v2 TLV")
+		}
+		tlv := ProxyTLV{Type: b[0], Value: b[3 : 3+n]}
+		h.TLVs = append(h.TLVs, tlv)
+		b = b[3+n:]
+
+		switch tlv.Type {
+		case PP2TypeALPN:
+			h.ALPN = string(tlv.Value)
+		case PP2TypeAuthority:
+			h.Authority = string(tlv.Value)
+		case PP2TypeUniqueID:
+			h.UniqueID = string(tlv.Value)
+		case PP2TypeNetNS:
+			h.NetNS = string(tlv.Value)
+		case PP2TypeAWS:
+			if len(tlv.Value) > 0 && tlv.Value[0] == pp2SubtypeAWSVPCEID {
+				h.AWSVPCEID = string(tlv.Value[1:])
+			}
+		case PP2TypeSSL:
+			ssl, err := parseProxySSL(tlv.Value)
+			if err != nil {
+				return err
+			}
+			h.SSL = ssl
+		}
+	}
+	return nil
+}
+
+func parseProxySSL(b []byte) (*ProxySSL, error) {
+	if len(b) < 5 {
+		return nil, errors.New("truncated PROXY v2 SSL TLV")
+	}
+	ssl := &ProxySSL{Client: b[0], Verified: binary.BigEndian.Uint32(b[1:5]) == 0}
+	sub := &ProxyHeader{}
+	if err := sub.parseTLVs(b[5:]); err != nil {
+		return nil, err
+	}
+	for _, tlv := range sub.TLVs {
+		switch tlv.Type {
+		case pp2SubtypeSSLVersion:
+			ssl.Version = string(tlv.Value)
+		case pp2SubtypeSSLCN:
+			ssl.CN = string(tlv.Value)
+		case pp2SubtypeSSLCipher:
+			ssl.Cipher = string(tlv.Value)
+		case pp2SubtypeSSLSigAlg:
+			ssl.SigAlg = string(tlv.Value)
+		case pp2SubtypeSSLKeyAlg:
+			ssl.KeyAlg = string(tlv.Value)
+		}
+	}
+	return ssl, nil
+}
+
+// tlv returns the value of the first TLV of type t, or nil.
+func (h *ProxyHeader) tlv(t byte) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// proxyV2ChecksumOK checks the CRC32C TLV: the checksum of the whole
+// header, computed with the checksum field itself zeroed. The TLVs after
+// addrLen have already been validated.
+func proxyV2ChecksumOK(fixed, body []byte, addrLen int) bool {
+	header := append(append([]byte{}, fixed...), body...)
+	var want uint32
+	for tlvs := header[len(fixed)+addrLen:]; len(tlvs) >= 3; {
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if tlvs[0] == PP2TypeCRC32C {
+			want = binary.BigEndian.Uint32(tlvs[3:7])
+			copy(tlvs[3:7], []byte{0, 0, 0, 0})
+			break
+		}
+		tlvs = tlvs[3+n:]
+	}
+	return crc32.Checksum(header, castagnoli) == want
+}
+
+// WriteProxyHeader writes a PROXY protocol header of the given version (1
+// or 2) to w, describing a TCP connection from src to dst. When either
+// address isn't TCP the header says the client is unknown, and the
+// receiver falls back to the connection's own endpoints.
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	var buf []byte
+	switch version {
+	case 1:
+		buf = appendProxyV1(nil, src, dst)
+	case 2:
+		buf = appendProxyV2(nil, src, dst)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// proxyEndpoints returns src and dst as IPs of one family, mapping IPv4 to
+// IPv6 if the two differ, or ok false if either isn't a TCP address.
+func proxyEndpoints(src, dst net.Addr) (sip, dip net.IP, sport, dport int, v4, ok bool) {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok || s.IP == nil || d.IP == nil {
+		return nil, nil, 0, 0, false, false
+	}
+	if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil && d4 != nil {
+		return s4, d4, s.Port, d.Port, true, true
+	}
+	return s.IP.To16(), d.IP.To16(), s.Port, d.Port, false, true
+}
+
+func appendProxyV1(b []byte, src, dst net.Addr) []byte {
+	sip, dip, sport, dport, v4, ok := proxyEndpoints(src, dst)
+	if !ok {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	proto := "TCP6"
+	if v4 {
+		proto = "TCP4"
+	}
+	return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n", proto, proxyV1IP(sip, v4), proxyV1IP(dip, v4), sport, dport)
+}
+
+// proxyV1IP formats ip for a TCP4 or TCP6 line; net.IP prints IPv4-mapped
+// addresses as IPv4, which a TCP6 line can't carry.
+func proxyV1IP(ip net.IP, v4 bool) string {
+	if !v4 && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+func appendProxyV2(b []byte, src, dst net.Addr) []byte {
+	b = append(b, proxyV2Sig...)
+	sip, dip, sport, dport, v4, ok := proxyEndpoints(src, dst)
+	if !ok {
+		return append(b, 0x21, 0x00, 0, 0) // PROXY, AF_UNSPEC
+	}
+	fam, n := byte(0x21), 36 // AF_INET6, STREAM
+	if v4 {
+		fam, n = 0x11, 12
+	}
+	b = append(b, 0x21, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(n))
+	b = append(b, sip...)
+	b = append(b, dip...)
+	b = binary.BigEndian.AppendUint16(b, uint16(sport))
+	return binary.BigEndian.AppendUint16(b, uint16(dport))
+}
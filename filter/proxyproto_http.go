@@ -0,0 +1,156 @@
+package filter
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServeProxyProtocol wraps ln so the connections srv accepts from trusted
+// peers may start with a PROXY protocol header (v1 or v2). The header is
+// read on the connection's first read, not in Accept, so a slow balancer
+// can't hold up others; ProxyHeaderFromContext then returns it for the
+// connection's requests. Install it first, on the raw listener, so that
+// ConnTracker.Serve and SlowClientDetector.Serve, wrapped around it, admit
+// and judge a trusted balancer's connections by the client it names.
+func ServeProxyProtocol(srv *http.Server, ln net.Listener, trust func(ip string) bool) net.Listener {
+	prevCtx := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if prevCtx != nil {
+			ctx = prevCtx(ctx, c)
+		}
+		if pc := asProxyConn(c); pc != nil {
+			ctx = context.WithValue(ctx, proxyConnKey{}, pc)
+		}
+		return ctx
+	}
+	return &proxyListener{Listener: ln, trust: trust}
+}
+
+// ProxyHeaderFromContext returns the PROXY header the request's connection
+// was opened with, or nil.
+func ProxyHeaderFromContext(ctx context.Context) *ProxyHeader {
+	pc, _ := ctx.Value(proxyConnKey{}).(*proxyConn)
+	if pc == nil {
+		return nil
+	}
+	return pc.header.Load()
+}
+
+type proxyConnKey struct{}
+
+type proxyListener struct {
+	net.Listener
+	trust func(string) bool
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, trust: l.trust}, nil
+}
+
+// proxyConn reads a PROXY header from the front of a connection before
+// handing out the bytes after it.
+type proxyConn struct {
+	net.Conn
+	trust func(string) bool
+
+	once   sync.Once
+	err    error
+	br     *bufio.Reader // bytes buffered past the header; nil once drained
+	header atomic.Pointer[ProxyHeader]
+
+	mu           sync.Mutex
+	readDeadline time.Time // the server's, restored after the header
+}
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if err := c.resolve(); err != nil {
+		return 0, err
+	}
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(p)
+		}
+		c.br = nil
+	}
+	return c.Conn.Read(p)
+}
+
+// resolve reads the header, if the peer may send one, on first use.
+func (c *proxyConn) resolve() error {
+	c.once.Do(c.readHeader)
+	return c.err
+}
+
+// proxied reports whether the peer may open with a header, so the client
+// is not known until resolve.
+func (c *proxyConn) proxied() bool {
+	return c.trust(splitL4Host(c.RemoteAddr().String()))
+}
+
+// clientAddr returns the header's client, or the peer's own address when
+// the header is missing, unread or names no client.
+func (c *proxyConn) clientAddr() net.Addr {
+	return c.header.Load().ClientAddr(c.RemoteAddr())
+}
+
+func (c *proxyConn) readHeader() {
+	c.mu.Lock()
+	restore := c.readDeadline
+	c.mu.Unlock()
+
+	br := bufio.NewReader(c.Conn)
+	h, ok := resolveProxyProtocol(br, c.Conn, c.trust, restore)
+	if !ok {
+		// A read error, so the server drops the connection without a reply
+		c.err = &net.OpError{Op: "read", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: errProxyHeader}
+		return
+	}
+	c.header.Store(h)
+	c.br = br
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// asProxyConn finds the proxyConn under c, through TLS and the ConnTracker
+// and SlowClientDetector wrappers.
+func asProxyConn(c net.Conn) *proxyConn {
+	for {
+		switch cc := c.(type) {
+		case *proxyConn:
+			return cc
+		case *tls.Conn:
+			c = cc.NetConn()
+		case *slowConn:
+			c = cc.Conn
+		case *trackedConn:
+			c = cc.Conn
+		default:
+			return nil
+		}
+	}
+}
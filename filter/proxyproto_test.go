@@ -0,0 +1,319 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header: cmd is 0x0 (LOCAL) or 0x1 (PROXY), fam the
+// family/transport byte.
+func proxyV2(cmd, fam byte, addrs []byte, tlvs ...[]byte) []byte {
+	body := append([]byte{}, addrs...)
+	for _, t := range tlvs {
+		body = append(body, t...)
+	}
+	h := append([]byte{}, proxyV2Sig...)
+	h = append(h, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:16], uint16(len(body)))
+	return append(h, body...)
+}
+
+func tlv(typ byte, value []byte) []byte {
+	t := []byte{typ, 0, 0}
+	binary.BigEndian.PutUint16(t[1:3], uint16(len(value)))
+	return append(t, value...)
+}
+
+// withCRC appends a CRC32C TLV and fills in the header's checksum.
+func withCRC(h []byte) []byte {
+	h = append(h, tlv(PP2TypeCRC32C, make([]byte, 4))...)
+	binary.BigEndian.PutUint16(h[14:16], uint16(len(h)-16))
+	binary.BigEndian.PutUint32(h[len(h)-4:], crc32.Checksum(h, castagnoli))
+	return h
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xC3, 0x50, 0x01, 0xBB} // :50000 -> :443
+	tcp6 := make([]byte, 36)
+	copy(tcp6, net.ParseIP("2001:db8::7"))
+	copy(tcp6[16:], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(tcp6[32:], 50000)
+	binary.BigEndian.PutUint16(tcp6[34:], 443)
+	unix := make([]byte, 216)
+	copy(unix, "/run/client.sock")
+	copy(unix[108:], "/run/server.sock")
+
+	ssl := append([]byte{0x01, 0, 0, 0, 0}, tlv(pp2SubtypeSSLVersion, []byte("TLSv1.3"))...)
+	ssl = append(ssl, tlv(pp2SubtypeSSLCN, []byte("client.example.com"))...)
+	corrupt := withCRC(proxyV2(0x1, 0x11, tcp4))
+	corrupt[17] ^= 0xFF
+
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr bool
+		check   func(*ProxyHeader) bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 50000 443\r\n"), false, func(h *ProxyHeader) bool {
+			return h.Version == 1 && h.Network == "tcp4" && h.Source.String() == "203.0.113.7:50000"
+		}},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 50000 443\r\n"), false, func(h *ProxyHeader) bool {
+			return h.Network == "tcp6" && h.Source.String() == "[2001:db8::7]:50000"
+		}},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), false, func(h *ProxyHeader) bool {
+			return h.Network == "" && h.Source == nil
+		}},
+		{"v1 bad address", []byte("PROXY TCP4 not-an-ip 10.0.0.1 1 2\r\n"), true, nil},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::7 10.0.0.1 1 2\r\n"), true, nil},
+		{"v1 no CRLF", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 50000 443" + strings.Repeat(" ", 80)), true, nil},
+		{"v2 tcp4", proxyV2(0x1, 0x11, tcp4), false, func(h *ProxyHeader) bool {
+			return h.Version == 2 && h.Network == "tcp4" && h.Source.String() == "203.0.113.7:50000" && h.Destination.String() == "10.0.0.1:443"
+		}},
+		{"v2 udp6", proxyV2(0x1, 0x22, tcp6), false, func(h *ProxyHeader) bool {
+			_, udp := h.Source.(*net.UDPAddr)
+			return h.Network == "udp6" && udp && h.Source.String() == "[2001:db8::7]:50000"
+		}},
+		{"v2 unix", proxyV2(0x1, 0x31, unix), false, func(h *ProxyHeader) bool {
+			return h.Network == "unix" && h.Source.String() == "/run/client.sock" && h.Destination.String() == "/run/server.sock"
+		}},
+		{"v2 local", proxyV2(0x0, 0x00, nil), false, func(h *ProxyHeader) bool {
+			return h.Local && h.Source == nil
+		}},
+		{"v2 local skips addresses", proxyV2(0x0, 0x11, tcp4), false, func(h *ProxyHeader) bool {
+			return h.Local && h.Source == nil
+		}},
+		{"v2 tlvs", proxyV2(0x1, 0x11, tcp4,
+			tlv(PP2TypeAuthority, []byte("api.example.com")),
+			tlv(PP2TypeALPN, []byte("h2")),
+			tlv(PP2TypeSSL, ssl),
+			tlv(PP2TypeAWS, append([]byte{pp2SubtypeAWSVPCEID}, "vpce-0123abcd"...)),
+			tlv(0xE0, []byte("custom"))), false, func(h *ProxyHeader) bool {
+			return h.Authority == "api.example.com" && h.ALPN == "h2" && h.AWSVPCEID == "vpce-0123abcd" &&
+				h.SSL != nil && h.SSL.Verified && h.SSL.Version == "TLSv1.3" && h.SSL.CN == "client.example.com" &&
+				len(h.TLVs) == 5 && string(h.tlv(0xE0)) == "custom"
+		}},
+		{"v2 checksum", withCRC(proxyV2(0x1, 0x11, tcp4, tlv(PP2TypeAuthority, []byte("a")))), false, func(h *ProxyHeader) bool {
+			return h.Authority == "a"
+		}},
+		{"v2 bad checksum", corrupt, true, nil},
+		{"v2 truncated tlv", proxyV2(0x1, 0x11, tcp4, []byte{PP2TypeAuthority, 0, 9, 'a'}), true, nil},
+		{"v2 short addresses", proxyV2(0x1, 0x21, tcp4), true, nil},
+		{"v2 bad command", proxyV2(0x2, 0x11, tcp4), true, nil},
+	}
+	for _, tt := range tests {
+		br := bufio.NewReader(bytes.NewReader(append(tt.in, "payload"...)))
+		h, err := ReadProxyHeader(br)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got err %v, want error=%v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if h == nil || !tt.check(h) {
+			t.Errorf("%s: got %+v", tt.name, h)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != "payload" {
+			t.Errorf("%s: header not fully consumed, left %q", tt.name, rest)
+		}
+	}
+
+	// Anything else is left for the application
+	for _, in := range []string{"GET / HTTP/1.1\r\n", "PROXZ", "\r\nhello", ""} {
+		br := bufio.NewReader(strings.NewReader(in))
+		if h, err := ReadProxyHeader(br); h != nil || err != nil {
+			t.Errorf("%q: got %+v, %v", in, h, err)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != in {
+			t.Errorf("%q: consumed input, left %q", in, rest)
+		}
+	}
+}
+
+func TestResolveProxyProtocolTrust(t *testing.T) {
+	header := "PROXY TCP4 203.0.113.7 10.0.0.1 50000 443\r\n"
+
+	resolve := func(trusted bool, in string) (string, bool, string) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go func() {
+			io.WriteString(client, in)
+			client.Close()
+		}()
+		br := bufio.NewReader(server)
+		h, ok := resolveProxyProtocol(br, server, func(string) bool { return trusted }, time.Time{})
+		addr := h.ClientAddr(server.RemoteAddr()).String()
+		rest, _ := io.ReadAll(br)
+		return addr, ok, string(rest)
+	}
+
+	// A trusted balancer's header names the client
+	if addr, ok, rest := resolve(true, header+"data"); !ok || addr != "203.0.113.7:50000" || rest != "data" {
+		t.Errorf("trusted: got %q, %v, rest %q", addr, ok, rest)
+	}
+	// An untrusted peer's header is passed through, not believed
+	if addr, ok, rest := resolve(false, header+"data"); !ok || addr != "pipe" || rest != header+"data" {
+		t.Errorf("untrusted: got %q, %v, rest %q", addr, ok, rest)
+	}
+	// A trusted balancer that sends garbage is dropped
+	if _, ok, _ := resolve(true, "PROXY TCP4 junk\r\n"); ok {
+		t.Error("malformed header from a trusted proxy should drop the connection")
+	}
+	// A trusted peer that hangs up before sending anything has no header
+	if addr, ok, _ := resolve(true, ""); !ok || addr != "pipe" {
+		t.Errorf("trusted, closed: got %q, %v", addr, ok)
+	}
+
+	// So does one that waits for the server to speak first (MySQL, SMTP)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	start := time.Now()
+	h, ok := resolveProxyProtocol(bufio.NewReader(server), server, func(string) bool { return true }, start.Add(50*time.Millisecond))
+	if !ok || h != nil {
+		t.Errorf("trusted, silent: got %+v, %v; want no header and the connection kept", h, ok)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %v, past the connection's own deadline", waited)
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	v4 := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		network  string
+		source   string
+	}{
+		{"tcp4", v4("203.0.113.7", 50000), v4("10.0.0.1", 443), "tcp4", "203.0.113.7:50000"},
+		{"tcp6", v4("2001:db8::7", 50000), v4("2001:db8::1", 443), "tcp6", "[2001:db8::7]:50000"},
+		{"mixed families", v4("203.0.113.7", 50000), v4("2001:db8::1", 443), "tcp6", "203.0.113.7:50000"},
+		{"unknown client", nil, v4("10.0.0.1", 443), "", ""},
+		{"unix", &net.UnixAddr{Name: "/run/x.sock", Net: "unix"}, v4("10.0.0.1", 443), "", ""},
+	}
+	for _, tt := range tests {
+		for _, version := range []int{1, 2} {
+			var buf bytes.Buffer
+			if err := WriteProxyHeader(&buf, version, tt.src, tt.dst); err != nil {
+				t.Fatalf("%s v%d: %v", tt.name, version, err)
+			}
+			h, err := ReadProxyHeader(bufio.NewReader(&buf))
+			if err != nil || h == nil {
+				t.Fatalf("%s v%d: reading back: %+v, %v", tt.name, version, h, err)
+			}
+			source := ""
+			if h.Source != nil {
+				source = h.Source.String()
+			}
+			if h.Version != version || h.Network != tt.network || source != tt.source {
+				t.Errorf("%s v%d: got %s %q, want %s %q", tt.name, version, h.Network, source, tt.network, tt.source)
+			}
+		}
+	}
+	if err := WriteProxyHeader(io.Discard, 3, nil, nil); err == nil {
+		t.Error("version 3 should be rejected")
+	}
+}
+
+func TestServeProxyProtocol(t *testing.T) {
+	start := func(trusted bool) string {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := ProxyHeaderFromContext(r.Context())
+			io.WriteString(w, h.ClientAddr(nil).String())
+		}))
+		srv.Listener = ServeProxyProtocol(srv.Config, srv.Listener, func(string) bool { return trusted })
+		srv.Start()
+		t.Cleanup(srv.Close)
+		return srv.Listener.Addr().String()
+	}
+	get := func(addr, header string) (string, error) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		io.WriteString(c, header+"GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.Status + " " + string(body), nil
+	}
+
+	v1 := "PROXY TCP4 203.0.113.7 10.0.0.1 50000 80\r\n"
+	v2 := string(appendProxyV2(nil, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 4000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}))
+
+	trusted := start(true)
+	for header, want := range map[string]string{v1: "203.0.113.7:50000", v2: "[2001:db8::7]:4000"} {
+		if got, err := get(trusted, header); err != nil || got != "200 OK "+want {
+			t.Errorf("trusted %q: got %q, %v", header[:12], got, err)
+		}
+	}
+	// A trusted balancer's garbage drops the connection
+	if got, err := get(trusted, "PROXY TCP4 junk\r\n"); err == nil {
+		t.Errorf("malformed header got a response: %q", got)
+	}
+	// An untrusted client's header is just bytes, which HTTP rejects
+	if got, _ := get(start(false), v1); strings.HasPrefix(got, "200") {
+		t.Errorf("untrusted header honoured: %q", got)
+	}
+}
+
+func TestStreamProxySendsProxyHeader(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	received := make(chan *ProxyHeader, 1)
+	go func() {
+		c, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		h, _ := ReadProxyHeader(bufio.NewReader(c))
+		received <- h
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go StreamProxy(ln, StreamConfig{
+		Target:     upstream.Addr().String(),
+		L4:         NewL4Filter(0, nil),
+		TrustProxy: func(string) bool { return true },
+		SendProxy:  2,
+	})
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 203.0.113.7 10.0.0.1 50000 22\r\nSSH-2.0-test\r\n")
+
+	select {
+	case h := <-received:
+		if h == nil || h.Version != 2 || h.Source.String() != "203.0.113.7:50000" || h.Destination.String() != "10.0.0.1:22" {
+			t.Errorf("upstream got %+v", h)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream received no connection")
+	}
+}
@@ -0,0 +1,191 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"aegisedge/logger"
+	"aegisedge/util"
+)
+
+// RateLimitKey decides which requests share a rate limit bucket. It is
+// parsed from an expression of components joined by "+":
+//
+//	ip              client IP (the default)
+//	header:<name>   a request header, e.g. header:X-Api-Key
+//	cookie:<name>   a cookie
+//	jwt:<claim>     a claim of the bearer token, e.g. jwt:sub or jwt:org.id
+//	path, host, method, asn
+//	route           method, host and path together
+//
+// "header:X-Api-Key+path" gives each API key a bucket per path. A request
+// missing a header, cookie or claim the expression needs falls back to its
+// IP, so anonymous clients are still limited one by one. Header, cookie
+// and claim values are hashed, keeping credentials out of the store.
+//
+// Header and cookie values are whatever the client sends, so a key built
+// from them without ip gives a client a fresh bucket each time it changes
+// the value; use them for credentials the upstream rejects when invalid,
+// or add ip. ParseRateLimitKey warns about such keys, and about jwt
+// components read without a verifier.
+type RateLimitKey struct {
+	expr  string
+	parts []keyPart
+	jwt   *JWTVerifier
+}
+
+type keyPart struct {
+	kind string // ip, header, cookie, jwt, path, host, method, asn, route
+	arg  string
+}
+
+// ParseRateLimitKey parses expr. An empty expression is "ip". Claims in
+// jwt components are only trusted from tokens jwt verifies; with a nil
+// jwt they are read unverified.
+func ParseRateLimitKey(expr string, jwt *JWTVerifier) (*RateLimitKey, error) {
+	if strings.TrimSpace(expr) == "" {
+		expr = "ip"
+	}
+	k := &RateLimitKey{expr: expr, jwt: jwt}
+	for _, comp := range strings.Split(expr, "+") {
+		kind, arg, _ := strings.Cut(strings.TrimSpace(comp), ":")
+		kind = strings.ToLower(kind)
+		switch kind {
+		case "ip", "path", "host", "method", "asn", "route":
+			if arg != "" {
+				return nil, fmt.Errorf("key component %q takes no argument", kind)
+			}
+		case "header", "cookie", "jwt":
+			if arg == "" {
+				return nil, fmt.Errorf("key component %q needs a name, e.g. %s:<name>", kind, kind)
+			}
+			if kind == "header" {
+				arg = http.CanonicalHeaderKey(arg)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key component %q", comp)
+		}
+		k.parts = append(k.parts, keyPart{kind: kind, arg: arg})
+	}
+	if jwt == nil && slices.ContainsFunc(k.parts, func(p keyPart) bool { return p.kind == "jwt" }) {
+		logger.Warn("Rate limit key reads JWT claims without verifying them; clients can mint tokens for fresh buckets, set rate_limit_jwt to verify", "key", expr)
+	}
+	if !slices.ContainsFunc(k.parts, func(p keyPart) bool { return p.kind == "ip" }) &&
+		slices.ContainsFunc(k.parts, func(p keyPart) bool { return p.kind == "header" || p.kind == "cookie" }) {
+		logger.Warn("Rate limit key relies on client-supplied header or cookie values without the IP; clients can change them for fresh buckets, add ip to the key", "key", expr)
+	}
+	return k, nil
+}
+
+// String returns the expression k was parsed from.
+func (k *RateLimitKey) String() string {
+	if k == nil {
+		return "ip"
+	}
+	return k.expr
+}
+
+// IsIP reports whether k keys on the client IP alone.
+func (k *RateLimitKey) IsIP() bool {
+	return k == nil || (len(k.parts) == 1 && k.parts[0].kind == "ip")
+}
+
+// Key returns r's bucket key. For the plain "ip" expression that is the IP
+// itself. A nil k is "ip".
+func (k *RateLimitKey) Key(r *http.Request) string {
+	ip := util.GetRealIP(r)
+	if k.IsIP() {
+		return ip
+	}
+
+	var claims map[string]any
+	values := make([]string, 0, len(k.parts))
+	for _, p := range k.parts {
+		var v string
+		switch p.kind {
+		case "ip":
+			v = ip
+		case "path":
+			v = r.URL.Path
+		case "host":
+			v = requestHost(r)
+		case "method":
+			v = r.Method
+		case "asn":
+			v = util.GetASN(r)
+		case "route":
+			v = r.Method + " " + requestHost(r) + r.URL.Path
+		case "header":
+			v = hashKeyValue(r.Header.Get(p.arg))
+		case "cookie":
+			if c, err := r.Cookie(p.arg); err == nil {
+				v = hashKeyValue(c.Value)
+			}
+		case "jwt":
+			if claims == nil {
+				claims = k.claims(r)
+			}
+			v = hashKeyValue(claimString(claims, p.arg))
+		}
+		if v == "" {
+			return ip
+		}
+		values = append(values, p.kind+"="+v)
+	}
+	return strings.Join(values, "|")
+}
+
+// claims returns the bearer token's claims, or an empty map if there is
+// no usable token.
+func (k *RateLimitKey) claims(r *http.Request) map[string]any {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return map[string]any{}
+	}
+	var claims map[string]any
+	var err error
+	if k.jwt != nil {
+		claims, err = k.jwt.Claims(strings.TrimSpace(token))
+	} else {
+		claims, err = unverifiedJWTClaims(strings.TrimSpace(token))
+	}
+	if err != nil {
+		return map[string]any{}
+	}
+	return claims
+}
+
+// claimString looks up a claim by dotted path and renders it as a string;
+// objects and arrays don't make keys.
+func claimString(claims map[string]any, path string) string {
+	var v any = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = m[name]
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case fmt.Stringer: // json.Number
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// hashKeyValue shortens a credential to a stable, non-reversible token.
+func hashKeyValue(v string) string {
+	if v == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,216 @@
+package filter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signJWT builds a token over claims, signing with sign.
+func signJWT(t *testing.T, alg string, claims map[string]any, sign func(signed []byte) []byte) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	token := signJWT(t, "HS256", map[string]any{"sub": "alice", "org": map[string]any{"id": 42}}, hs256("s3cret"))
+
+	req := func(mod func(r *http.Request)) *http.Request {
+		r := httptest.NewRequest("POST", "http://API.example.com:8443/v1/orders", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if mod != nil {
+			mod(r)
+		}
+		return r
+	}
+	withKey := func(r *http.Request) { r.Header.Set("X-Api-Key", "key-1") }
+	withToken := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+
+	tests := []struct {
+		expr string
+		req  *http.Request
+		want string
+	}{
+		{"", req(nil), "10.0.0.1"},
+		{"ip", req(withKey), "10.0.0.1"},
+		{"ip+path", req(nil), "ip=10.0.0.1|path=/v1/orders"},
+		{"route", req(nil), "route=POST api.example.com/v1/orders"},
+		{"header:x-api-key", req(withKey), "header=" + hashKeyValue("key-1")},
+		{"header:X-Api-Key", req(nil), "10.0.0.1"}, // missing: falls back to IP
+		{"cookie:session", req(func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "abc"}) }), "cookie=" + hashKeyValue("abc")},
+		{"jwt:sub", req(withToken), "jwt=" + hashKeyValue("alice")},
+		{"jwt:org.id+method", req(withToken), "jwt=" + hashKeyValue("42") + "|method=POST"},
+		{"jwt:sub", req(func(r *http.Request) { r.Header.Set("Authorization", "Bearer junk") }), "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		k, err := ParseRateLimitKey(tt.expr, nil)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		if got := k.Key(tt.req); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"header", "ip:1", "user", "ip+"} {
+		if _, err := ParseRateLimitKey(bad, nil); err == nil {
+			t.Errorf("%q: expected a parse error", bad)
+		}
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	writeKey := func(pub any) string {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "key.pem")
+		os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+		return path
+	}
+	rs256 := func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		return sig
+	}
+	es256 := func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, sum[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+
+	hmacV, _ := NewJWTVerifier(JWTConfig{Secret: "s3cret", Issuer: "auth", Audience: "api"})
+	rsaV, _ := NewJWTVerifier(JWTConfig{PublicKeyFile: writeKey(&rsaKey.PublicKey)})
+	ecV, _ := NewJWTVerifier(JWTConfig{PublicKeyFile: writeKey(&ecKey.PublicKey)})
+
+	good := map[string]any{"sub": "alice", "exp": future, "iss": "auth", "aud": []string{"web", "api"}}
+	tests := []struct {
+		name  string
+		v     *JWTVerifier
+		token string
+		ok    bool
+	}{
+		{"hs256", hmacV, signJWT(t, "HS256", good, hs256("s3cret")), true},
+		{"wrong secret", hmacV, signJWT(t, "HS256", good, hs256("guess")), false},
+		{"expired", hmacV, signJWT(t, "HS256", map[string]any{"exp": past, "iss": "auth", "aud": "api"}, hs256("s3cret")), false},
+		{"wrong audience", hmacV, signJWT(t, "HS256", map[string]any{"iss": "auth", "aud": "web"}, hs256("s3cret")), false},
+		{"alg none", hmacV, signJWT(t, "none", good, func([]byte) []byte { return nil }), false},
+		{"rs256", rsaV, signJWT(t, "RS256", good, rs256), true},
+		{"hs256 with rsa key", rsaV, signJWT(t, "HS256", good, hs256("")), false},
+		{"es256", ecV, signJWT(t, "ES256", good, es256), true},
+	}
+	for _, tt := range tests {
+		claims, err := tt.v.Claims(tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got err %v, want ok=%v", tt.name, err, tt.ok)
+		}
+		if tt.ok && claims["sub"] != "alice" {
+			t.Errorf("%s: got claims %v", tt.name, claims)
+		}
+	}
+
+	// A verified key ignores forged tokens
+	k, _ := ParseRateLimitKey("jwt:sub", hmacV)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("Authorization", "Bearer "+signJWT(t, "HS256", good, hs256("guess")))
+	if got := k.Key(r); got != "10.0.0.1" {
+		t.Errorf("forged token keyed as %q", got)
+	}
+}
+
+func TestL7FilterKeyedByAPIKey(t *testing.T) {
+	f := NewL7Filter(1, 2, nil)
+	defer f.Stop()
+	f.Key, _ = ParseRateLimitKey("header:X-Api-Key", nil)
+	rep := NewReputationManager(nil)
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), rep)
+
+	send := func(ip, apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":5555"
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// One customer behind several IPs shares a bucket...
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if code := send(ip, "cust-a"); code != http.StatusOK {
+			t.Fatalf("request %d got %d", i, code)
+		}
+	}
+	if code := send("10.0.0.3", "cust-a"); code != http.StatusTooManyRequests {
+		t.Errorf("third cust-a request got %d, want 429", code)
+	}
+	// ...while another customer behind the same NAT has its own
+	if code := send("10.0.0.1", "cust-b"); code != http.StatusOK {
+		t.Errorf("cust-b got %d", code)
+	}
+	// Without a key, the client IP is the bucket
+	if code := send("10.0.0.1", ""); code != http.StatusOK {
+		t.Errorf("keyless request got %d", code)
+	}
+
+	// An exhausted API key is not held against the address it came from
+	for i := 0; i < violationLimit; i++ {
+		send("10.0.0.9", "cust-a")
+	}
+	if trust := rep.GetTrust("10.0.0.9"); trust != 0 {
+		t.Errorf("shared bucket rejection penalized the IP: trust %d", trust)
+	}
+	if IsSoftBlocked("10.0.0.9") {
+		t.Error("shared bucket rejections soft-blocked the IP")
+	}
+
+	// Nor does a bad address shrink a shared bucket for everyone else
+	for i := 0; i < 5; i++ {
+		rep.Penalize("10.0.0.8")
+	}
+	for i := 0; i < 2; i++ {
+		if code := send("10.0.0.8", "cust-c"); code != http.StatusOK {
+			t.Errorf("cust-c request %d from a low-trust IP got %d, want the full burst", i, code)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"aegisedge/logger"
+	"aegisedge/util"
+)
+
+// Actions for a request over its rate limit.
+const (
+	RateLimitReject    = "reject"    // 429
+	RateLimitChallenge = "challenge" // send through the JS challenge
+	RateLimitTarpit    = "tarpit"    // hold until a token frees up, then serve
+)
+
+// maxRateLimitTarpit caps how long the tarpit action holds a request. A
+// request that would wait longer is rejected instead.
+const maxRateLimitTarpit = 5 * time.Second
+
+// RateLimitPolicy is a rate limit for the requests it selects. Policies are
+// tried in order; the first that selects a request replaces the default
+// l7_rate_limit bucket for it. Every selector that is set must match.
+type RateLimitPolicy struct {
+	Name    string            `json:"name"`
+	Host    string            `json:"host,omitempty"`    // exact, or *.example.com for any subdomain
+	Path    string            `json:"path,omitempty"`    // * matches any run of characters, including /
+	Methods []string          `json:"methods,omitempty"` // any method when empty
+	Headers map[string]string `json:"headers,omitempty"` // header -> value pattern; "*" means present
+	Rate    float64           `json:"rate"`              // requests per window; 0 exempts the requests
+	Burst   int               `json:"burst,omitempty"`   // defaults to rate
+	Window  string            `json:"window,omitempty"`  // e.g. 1s (default), 1m, 1h
+	Action  string            `json:"action,omitempty"`  // reject (default), challenge or tarpit
+	Key     string            `json:"key,omitempty"`     // bucket key expression; client IP by default
+
+	key       *RateLimitKey
+	methods   map[string]bool
+	headers   map[string]string // canonical name -> pattern
+	perSecond float64
+	limiters  *keyedLimiters
+}
+
+// compile validates the policy and prepares it for matching. jwt verifies
+// tokens for jwt: key components.
+func (p *RateLimitPolicy) compile(jwt *JWTVerifier) error {
+	if p.Name == "" || p.Name == "default" {
+		return fmt.Errorf("missing or reserved name %q", p.Name)
+	}
+	key, err := ParseRateLimitKey(p.Key, jwt)
+	if err != nil {
+		return err
+	}
+	p.key = key
+	p.Host = strings.ToLower(p.Host)
+	p.methods = make(map[string]bool, len(p.Methods))
+	for _, m := range p.Methods {
+		p.methods[strings.ToUpper(m)] = true
+	}
+	p.headers = make(map[string]string, len(p.Headers))
+	for name, pattern := range p.Headers {
+		p.headers[http.CanonicalHeaderKey(name)] = pattern
+	}
+
+	switch p.Action {
+	case "":
+		p.Action = RateLimitReject
+	case RateLimitReject, RateLimitChallenge, RateLimitTarpit:
+	default:
+		return fmt.Errorf("unknown action %q", p.Action)
+	}
+
+	if p.Rate < 0 || p.Burst < 0 {
+		return fmt.Errorf("rate and burst must not be negative")
+	}
+	if p.Rate == 0 {
+		return nil // exempt
+	}
+	window := time.Second
+	if p.Window != "" {
+		d, err := time.ParseDuration(p.Window)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid window %q", p.Window)
+		}
+		window = d
+	}
+	if p.Burst == 0 {
+		p.Burst = max(1, int(p.Rate))
+	}
+	p.perSecond = p.Rate / window.Seconds()
+	p.limiters = newKeyedLimiters(p.perSecond, p.Burst)
+	return nil
+}
+
+// take takes a token from key's bucket, which lives in the store when
+// dist is set.
+func (p *RateLimitPolicy) take(dist *storeLimiter, key string) rateLimitState {
+	if dist == nil {
+		return p.limiters.take(key)
+	}
+	return dist.allow("policy:"+p.Name+":"+key, p.perSecond, p.Burst)
+}
+
+// selects reports whether the policy covers r.
+func (p *RateLimitPolicy) selects(r *http.Request) bool {
+	if len(p.methods) > 0 && !p.methods[r.Method] {
+		return false
+	}
+	if p.Path != "" && !globMatch(p.Path, r.URL.Path) {
+		return false
+	}
+	for name, pattern := range p.headers {
+		values, ok := r.Header[name]
+		if !ok {
+			return false
+		}
+		if pattern == "*" {
+			continue
+		}
+		matched := false
+		for _, v := range values {
+			if globMatch(pattern, v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return hostMatches(p.Host, r)
+}
+
+// globMatch reports whether s matches pattern, where * matches any run of
+// characters (including none) and everything else matches itself.
+func globMatch(pattern, s string) bool {
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, pattern[:star]) {
+		return false
+	}
+	s, pattern = s[star:], pattern[star+1:]
+	for {
+		if globMatch(pattern, s) {
+			return true
+		}
+		if s == "" {
+			return false
+		}
+		s = s[1:]
+	}
+}
+
+// SetPolicies compiles policies and makes them active. Call it before
+// Middleware; the challenge action needs Challenge to be set, and JWT must
+// be set first for policy keys to verify tokens.
+func (f *L7Filter) SetPolicies(policies []RateLimitPolicy) error {
+	compiled := make([]*RateLimitPolicy, 0, len(policies))
+	names := make(map[string]bool, len(policies))
+	for i := range policies {
+		p := policies[i]
+		if err := p.compile(f.JWT); err != nil {
+			return fmt.Errorf("rate limit policy %d: %w", i, err)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("rate limit policy %d: duplicate name %q", i, p.Name)
+		}
+		names[p.Name] = true
+		if p.Action == RateLimitChallenge && f.Challenge == nil {
+			return fmt.Errorf("rate limit policy %q: challenge action needs a challenge handler", p.Name)
+		}
+		compiled = append(compiled, &p)
+	}
+	f.policies.Store(compiled)
+	return nil
+}
+
+// Policies returns the active rate limit policies.
+func (f *L7Filter) Policies() []*RateLimitPolicy {
+	policies, _ := f.policies.Load().([]*RateLimitPolicy)
+	return policies
+}
+
+// policyFor returns the first policy that selects r, or nil.
+func (f *L7Filter) policyFor(r *http.Request) *RateLimitPolicy {
+	for _, p := range f.Policies() {
+		if p.selects(r) {
+			return p
+		}
+	}
+	return nil
+}
+
+// applyPolicy enforces p for r. It reports whether it has dealt with the
+// request; if not, the caller carries on with the rest of the chain.
+func (f *L7Filter) applyPolicy(p *RateLimitPolicy, w http.ResponseWriter, r *http.Request, challenged http.Handler, rep *ReputationManager) bool {
+	if p.limiters == nil {
+		return false // exempt
+	}
+	host := util.GetRealIP(r)
+	key := p.key.Key(r)
+
+	if f.shadow.Load() {
+		f.recorder().requests.Add(1)
+		if !p.take(f.dist, key).allowed {
+			f.shadowHit(r, p.Name, key, p.Action)
+		}
+		return false
+	}
+	if p.Action == RateLimitTarpit && f.dist != nil {
+		st, ok := f.tarpitShared(p, r, key)
+		if !ok {
+			return true // the client went away
+		}
+		if st.allowed {
+			st.setHeaders(w.Header())
+			return false
+		}
+		f.reject(w, r, p.Name, key, st, rep)
+		return true
+	}
+	if p.Action == RateLimitTarpit {
+		res, st := p.limiters.reserve(key)
+		delay := res.Delay()
+		if delay <= maxRateLimitTarpit {
+			if delay > 0 {
+				f.countPolicy(p.Name, RateLimitTarpit)
+				logger.Warn("Rate limit policy exceeded, tarpitting", "policy", p.Name, "remote_addr", host, "key", key, "delay", delay, "path", r.URL.Path)
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					// The client went away: give the token back and drop the request
+					res.Cancel()
+					return true
+				}
+			}
+			st.setHeaders(w.Header())
+			return false
+		}
+		res.Cancel()
+		st.allowed, st.retryAfter = false, delay
+		f.reject(w, r, p.Name, key, st, rep)
+		return true
+	}
+
+	st := p.take(f.dist, key)
+	if st.allowed {
+		st.setHeaders(w.Header())
+		return false
+	}
+	if p.Action == RateLimitChallenge {
+		f.countPolicy(p.Name, RateLimitChallenge)
+		logger.Info("Rate limit policy exceeded, challenging", "policy", p.Name, "remote_addr", host, "key", key, "path", r.URL.Path)
+		st.setHeaders(w.Header())
+		challenged.ServeHTTP(w, r)
+		return true
+	}
+	f.reject(w, r, p.Name, key, st, rep)
+	return true
+}
+
+// tarpitShared is the tarpit action for buckets kept in the store, which
+// cannot reserve a future token: it sleeps until the store says one is
+// free and tries again. It gives up, returning the denial, if that would
+// take too long, and returns false if the client goes away meanwhile.
+func (f *L7Filter) tarpitShared(p *RateLimitPolicy, r *http.Request, key string) (rateLimitState, bool) {
+	deadline := time.Now().Add(maxRateLimitTarpit)
+	for waited := false; ; waited = true {
+		st := f.dist.allow("policy:"+p.Name+":"+key, p.perSecond, p.Burst)
+		if st.allowed || time.Now().Add(st.retryAfter).After(deadline) {
+			return st, true
+		}
+		if !waited {
+			f.countPolicy(p.Name, RateLimitTarpit)
+			logger.Warn("Rate limit policy exceeded, tarpitting", "policy", p.Name, "remote_addr", util.GetRealIP(r), "key", key, "delay", st.retryAfter, "path", r.URL.Path)
+		}
+		select {
+		case <-time.After(st.retryAfter):
+		case <-r.Context().Done():
+			return st, false
+		}
+	}
+}
+
+func (f *L7Filter) countPolicy(name, action string) {
+	if MetricsEnabled() {
+		RateLimitExceeded.WithLabelValues(name, action).Inc()
+	}
+}
@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitState is a bucket's state after a request was counted against
+// it, for the RateLimit-* response headers.
+type rateLimitState struct {
+	allowed    bool
+	limit      int           // bucket size
+	remaining  int           // tokens left
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // when denied, until a token is free
+}
+
+// limiterState reads l's state at now, after a request was allowed or not.
+func limiterState(l *rate.Limiter, now time.Time, allowed bool) rateLimitState {
+	tokens := l.TokensAt(now)
+	st := rateLimitState{allowed: allowed, limit: l.Burst(), remaining: max(0, int(tokens))}
+	if r := float64(l.Limit()); r > 0 && !math.IsInf(r, 1) {
+		st.reset = time.Duration(max(0, float64(l.Burst())-tokens) / r * float64(time.Second))
+		if !allowed {
+			st.retryAfter = time.Duration(max(0, 1-tokens) / r * float64(time.Second))
+		}
+	}
+	return st
+}
+
+// setHeaders adds the RateLimit-Limit, -Remaining and -Reset headers of
+// the IETF ratelimit-headers draft. Reset is in seconds from now.
+func (st rateLimitState) setHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(st.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(st.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(st.reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// writeRateLimited answers a request over its rate limit with 429, the
+// rate limit headers and Retry-After. Browsers get an HTML page, anything
+// else an RFC 9457 problem+json document.
+func writeRateLimited(w http.ResponseWriter, r *http.Request, st rateLimitState, policy string) {
+	retry := max(1, ceilSeconds(st.retryAfter))
+	st.setHeaders(w.Header())
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if prefersHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, rateLimitPage, retry, html.EscapeString(r.URL.Path))
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(rateLimitProblem{
+		Type:       "about:blank",
+		Title:      "Too Many Requests",
+		Status:     http.StatusTooManyRequests,
+		Detail:     fmt.Sprintf("Rate limit exceeded; retry in %d s.", retry),
+		Instance:   r.URL.Path,
+		Policy:     policy,
+		RetryAfter: retry,
+	})
+}
+
+// rateLimitProblem is the problem+json body of a rate limited request.
+type rateLimitProblem struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	Instance   string `json:"instance"`
+	Policy     string `json:"policy"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+const rateLimitPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <title>AegisEdge — Too many requests</title>
+    <meta http-equiv="refresh" content="%[1]d">
+    <style>
+      body { font-family: sans-serif; display:flex; align-items:center; justify-content:center; height:100vh; margin:0; background:#0d1117; color:#cdd9e5; }
+      .box { text-align:center; }
+      code { color:#8b949e; }
+    </style>
+  </head>
+  <body>
+    <div class="box">
+      <h2>Too many requests</h2>
+      <p>You are sending requests faster than this site allows.</p>
+      <p>This page will retry in %[1]d second(s). <code>%[2]s</code></p>
+    </div>
+  </body>
+</html>`
+
+// prefersHTML reports whether the client's Accept header ranks HTML above
+// JSON, which is how browsers ask.
+func prefersHTML(r *http.Request) bool {
+	var htmlQ, jsonQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			htmlQ = max(htmlQ, q)
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return htmlQ > jsonQ
+}
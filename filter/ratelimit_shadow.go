@@ -0,0 +1,225 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aegisedge/logger"
+	"aegisedge/util"
+)
+
+// RateLimitShadow is the action recorded for requests a limiter would have
+// acted on in shadow mode.
+const RateLimitShadow = "shadow"
+
+// maxShadowKeys bounds how many distinct offenders a report tracks, so a
+// flood of spoofed keys can't grow it without limit.
+const maxShadowKeys = 10000
+
+// RateLimitOffender is one bucket in a rate limit report.
+type RateLimitOffender struct {
+	Policy    string    `json:"policy"`
+	Key       string    `json:"key"`
+	IP        string    `json:"ip"` // last client seen on the key
+	Action    string    `json:"action"`
+	Limited   uint64    `json:"limited"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// RateLimitReport summarizes the requests a limiter would have rejected,
+// challenged or tarpitted, worst offenders first.
+type RateLimitReport struct {
+	Since     time.Time           `json:"since"`
+	Requests  uint64              `json:"requests"` // requests checked against a bucket
+	Limited   uint64              `json:"limited"`
+	Keys      int                 `json:"keys"`      // distinct offenders
+	Untracked uint64              `json:"untracked"` // limited requests past the offender cap
+	Offenders []RateLimitOffender `json:"offenders"`
+}
+
+// shadowRecorder tallies would-be rate limit actions per bucket.
+type shadowRecorder struct {
+	requests atomic.Uint64
+
+	mu        sync.Mutex
+	since     time.Time
+	limited   uint64
+	untracked uint64
+	offenders map[[2]string]*RateLimitOffender // policy, key
+}
+
+func newShadowRecorder(now time.Time) *shadowRecorder {
+	return &shadowRecorder{since: now, offenders: make(map[[2]string]*RateLimitOffender)}
+}
+
+func (s *shadowRecorder) record(policy, key, ip, action string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limited++
+	o, ok := s.offenders[[2]string{policy, key}]
+	if !ok {
+		if len(s.offenders) >= maxShadowKeys {
+			s.untracked++
+			return
+		}
+		o = &RateLimitOffender{Policy: policy, Key: key, Action: action, FirstSeen: at}
+		s.offenders[[2]string{policy, key}] = o
+	}
+	o.IP = ip
+	o.Limited++
+	o.LastSeen = at
+}
+
+// report returns the top offenders by limited requests; top <= 0 lists
+// them all.
+func (s *shadowRecorder) report(top int) RateLimitReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rep := RateLimitReport{
+		Since:     s.since,
+		Requests:  s.requests.Load(),
+		Limited:   s.limited,
+		Keys:      len(s.offenders),
+		Untracked: s.untracked,
+		Offenders: make([]RateLimitOffender, 0, len(s.offenders)),
+	}
+	for _, o := range s.offenders {
+		rep.Offenders = append(rep.Offenders, *o)
+	}
+	sort.Slice(rep.Offenders, func(i, j int) bool {
+		a, b := rep.Offenders[i], rep.Offenders[j]
+		if a.Limited != b.Limited {
+			return a.Limited > b.Limited
+		}
+		return a.Key < b.Key
+	})
+	if top > 0 && len(rep.Offenders) > top {
+		rep.Offenders = rep.Offenders[:top]
+	}
+	return rep
+}
+
+// SetShadow turns shadow mode on or off. In shadow mode the filter keeps
+// its buckets but never rejects, challenges or tarpits: requests over a
+// limit are only counted, for ShadowReport.
+func (f *L7Filter) SetShadow(on bool) {
+	f.shadow.Store(on)
+}
+
+// Shadow reports whether the filter is in shadow mode.
+func (f *L7Filter) Shadow() bool {
+	return f.shadow.Load()
+}
+
+// ShadowReport returns the top offenders recorded in shadow mode since the
+// last ResetShadowReport.
+func (f *L7Filter) ShadowReport(top int) RateLimitReport {
+	return f.recorder().report(top)
+}
+
+// ResetShadowReport starts a new shadow report.
+func (f *L7Filter) ResetShadowReport() {
+	f.shadowRec.Store(newShadowRecorder(time.Now()))
+}
+
+func (f *L7Filter) recorder() *shadowRecorder {
+	return f.shadowRec.Load().(*shadowRecorder)
+}
+
+// shadowHit records a request that policy would have acted on.
+func (f *L7Filter) shadowHit(r *http.Request, policy, key, action string) {
+	host := util.GetRealIP(r)
+	logger.Info("Rate limit exceeded (shadow mode)", "policy", policy, "remote_addr", host, "key", key, "path", r.URL.Path)
+	if MetricsEnabled() {
+		RateLimitExceeded.WithLabelValues(policy, RateLimitShadow).Inc()
+	}
+	f.recorder().record(policy, key, host, action, time.Now())
+}
+
+// RateLimitSimConfig is the limiter configuration a RateLimitSimulator
+// replays traffic through: the same settings as the L7 filter's.
+type RateLimitSimConfig struct {
+	Rate      float64
+	Burst     int
+	Key       string
+	Policies  []RateLimitPolicy
+	Whitelist []string
+	JWT       *JWTVerifier
+}
+
+// RateLimitSimulator replays recorded requests through a rate limit
+// configuration on the requests' own timestamps, and reports who would
+// have been limited. Reputation scaling is not simulated, and tarpitted
+// requests count as limited.
+type RateLimitSimulator struct {
+	def       *keyedLimiters
+	key       *RateLimitKey
+	policies  []*RateLimitPolicy
+	whitelist *IPSet
+	rec       *shadowRecorder
+}
+
+func NewRateLimitSimulator(cfg RateLimitSimConfig) (*RateLimitSimulator, error) {
+	key, err := ParseRateLimitKey(cfg.Key, cfg.JWT)
+	if err != nil {
+		return nil, err
+	}
+	// Policies compile exactly as SetPolicies does them
+	f := &L7Filter{JWT: cfg.JWT, Challenge: func(h http.Handler) http.Handler { return h }}
+	if err := f.SetPolicies(cfg.Policies); err != nil {
+		return nil, err
+	}
+	return &RateLimitSimulator{
+		def:       newKeyedLimiters(cfg.Rate, cfg.Burst),
+		key:       key,
+		policies:  f.Policies(),
+		whitelist: NewIPSet(cfg.Whitelist),
+	}, nil
+}
+
+// Replay runs r, made at, through the limiters and reports whether it
+// would have been let through. Requests must be replayed in time order.
+func (s *RateLimitSimulator) Replay(r *http.Request, at time.Time) bool {
+	if s.rec == nil {
+		s.rec = newShadowRecorder(at)
+	}
+	ip := util.GetRealIP(r)
+	if s.whitelist.Contains(ip) {
+		return true
+	}
+
+	policy, action, key, limiters := "default", RateLimitReject, s.key.Key(r), s.def
+	for _, p := range s.policies {
+		if p.selects(r) {
+			policy, action, key, limiters = p.Name, p.Action, p.key.Key(r), p.limiters
+			break
+		}
+	}
+	if limiters == nil {
+		return true // exempt
+	}
+	s.rec.requests.Add(1)
+	if limiters.takeAt(key, at).allowed {
+		return true
+	}
+	s.rec.record(policy, key, ip, action, at)
+	return false
+}
+
+// Report returns the top offenders of the requests replayed so far.
+func (s *RateLimitSimulator) Report(top int) RateLimitReport {
+	if s.rec == nil {
+		return RateLimitReport{}
+	}
+	return s.rec.report(top)
+}
+
+// String describes the simulated limits, for reports.
+func (s *RateLimitSimulator) String() string {
+	return fmt.Sprintf("%g/s burst %d, %d policies, key %s", s.def.rate, s.def.burst, len(s.policies), s.key)
+}
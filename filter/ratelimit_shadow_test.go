@@ -0,0 +1,113 @@
+package filter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestL7FilterShadowMode(t *testing.T) {
+	f := NewL7Filter(1, 2, nil)
+	defer f.Stop()
+	if err := f.SetPolicies([]RateLimitPolicy{{Name: "login", Path: "/login", Rate: 1, Window: "1m", Action: "tarpit"}}); err != nil {
+		t.Fatal(err)
+	}
+	f.SetShadow(true)
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil)
+
+	send := func(ip, path string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":5555"
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || time.Since(start) > 100*time.Millisecond {
+			t.Fatalf("shadow mode acted on %s %s: %d after %v", ip, path, rr.Code, time.Since(start))
+		}
+		if rr.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("shadow mode sent rate limit headers")
+		}
+	}
+	for i := 0; i < 6; i++ {
+		send("10.0.0.1", "/")
+	}
+	send("10.0.0.2", "/")
+	for i := 0; i < 3; i++ {
+		send("10.0.0.2", "/login")
+	}
+
+	rep := f.ShadowReport(0)
+	if rep.Requests != 10 || rep.Limited != 6 || rep.Keys != 2 {
+		t.Fatalf("got report %+v", rep)
+	}
+	want := []RateLimitOffender{
+		{Policy: "default", Key: "10.0.0.1", Action: "reject", Limited: 4},
+		{Policy: "login", Key: "10.0.0.2", Action: "tarpit", Limited: 2},
+	}
+	for i, o := range rep.Offenders {
+		if o.Policy != want[i].Policy || o.Key != want[i].Key || o.Action != want[i].Action || o.Limited != want[i].Limited {
+			t.Errorf("offender %d: got %+v, want %+v", i, o, want[i])
+		}
+	}
+	if top := f.ShadowReport(1); len(top.Offenders) != 1 || top.Keys != 2 {
+		t.Errorf("top 1: got %+v", top)
+	}
+
+	f.ResetShadowReport()
+	if rep := f.ShadowReport(0); rep.Limited != 0 || len(rep.Offenders) != 0 {
+		t.Errorf("report not reset: %+v", rep)
+	}
+
+	// Enforcing again
+	f.SetShadow(false)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("after shadow mode got %d, want 429", rr.Code)
+	}
+}
+
+func TestRateLimitSimulator(t *testing.T) {
+	sim, err := NewRateLimitSimulator(RateLimitSimConfig{
+		Rate:      2,
+		Burst:     2,
+		Whitelist: []string{"10.9.9.9"},
+		Policies:  []RateLimitPolicy{{Name: "static", Path: "/static/*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	replay := func(ip, path string, offset time.Duration) bool {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":0"
+		return sim.Replay(req, start.Add(offset))
+	}
+
+	// Recorded time drives the buckets: 2/s is fine, 10/s is not
+	for i := 0; i < 10; i++ {
+		if !replay("10.0.0.1", "/", time.Duration(i)*500*time.Millisecond) {
+			t.Fatalf("request %d at 2/s was limited", i)
+		}
+		replay("10.0.0.2", "/", time.Duration(i)*100*time.Millisecond)
+		replay("10.9.9.9", "/", time.Duration(i)*10*time.Millisecond)
+		replay("10.0.0.3", "/static/app.js", time.Duration(i)*10*time.Millisecond)
+	}
+
+	rep := sim.Report(10)
+	if rep.Requests != 20 {
+		t.Errorf("checked %d requests, want 20 (whitelisted and exempt ones skipped)", rep.Requests)
+	}
+	if len(rep.Offenders) != 1 || rep.Offenders[0].Key != "10.0.0.2" || rep.Offenders[0].Limited == 0 {
+		t.Fatalf("got offenders %+v", rep.Offenders)
+	}
+	if o := rep.Offenders[0]; !o.FirstSeen.After(start) || o.LastSeen.After(start.Add(time.Second)) {
+		t.Errorf("offender times %v..%v are not the recorded ones", o.FirstSeen, o.LastSeen)
+	}
+}
@@ -22,7 +22,12 @@ type ReputationManager struct {
 	store store.Storer
 }
 
+// NewReputationManager returns a manager backed by s. A nil store falls back
+// to a process-local store so the manager is always usable.
 func NewReputationManager(s store.Storer) *ReputationManager {
+	if s == nil {
+		s = store.NewLocalStore()
+	}
 	return &ReputationManager{store: s}
 }
 
@@ -0,0 +1,655 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"aegisedge/logger"
+	"aegisedge/util"
+)
+
+// Leak categories the response inspector looks for.
+const (
+	LeakStackTrace = "stack_trace"
+	LeakSQLError   = "sql_error"
+	LeakCreditCard = "credit_card"
+	LeakPrivateKey = "private_key"
+	LeakInternalIP = "internal_ip"
+)
+
+// Actions taken when a leak is found.
+const (
+	LeakActionMask  = "mask"  // replace the leaked text and deliver the rest
+	LeakActionBlock = "block" // withhold the response
+	LeakActionLog   = "log"   // record only
+	LeakActionOff   = "off"   // don't look for this category
+)
+
+// leakOverlap is how many trailing bytes of each streamed chunk are held
+// back and re-scanned with the next one, so a leak split across two reads
+// is still seen whole. It bounds the longest leak that can be caught while
+// streaming (a 4096-bit PEM key is ~3.3KB).
+const leakOverlap = 8 * 1024
+
+// leakChunkSize is the most read from the upstream per scan.
+const leakChunkSize = 32 * 1024
+
+// leakFlushDelay is how long a streamed response may go quiet before the
+// bytes held back for the overlap are released anyway, so event streams,
+// NDJSON and progressively rendered pages aren't stalled.
+const leakFlushDelay = 100 * time.Millisecond
+
+// errResponseBlocked aborts a streamed response once a blocking leak is
+// found after the headers were already sent.
+var errResponseBlocked = errors.New("response withheld: data leak detected")
+
+// ResponseInspectorConfig configures a ResponseInspector.
+type ResponseInspectorConfig struct {
+	// Actions maps a leak category to mask, block, log or off. Categories
+	// left out use DefaultLeakActions.
+	Actions map[string]string
+	// MaxBytes is how much of a body is inspected. Responses that declare a
+	// larger Content-Length are passed through untouched; streamed responses
+	// are inspected up to this point and the rest is passed through.
+	MaxBytes int64
+	// ContentTypes lists the media types inspected; anything else (images,
+	// archives, video) is never read.
+	ContentTypes []string
+}
+
+// DefaultLeakActions blocks private keys and masks everything else.
+func DefaultLeakActions() map[string]string {
+	return map[string]string{
+		LeakStackTrace: LeakActionMask,
+		LeakSQLError:   LeakActionMask,
+		LeakCreditCard: LeakActionMask,
+		LeakPrivateKey: LeakActionBlock,
+		LeakInternalIP: LeakActionMask,
+	}
+}
+
+// DefaultInspectedContentTypes are the textual types worth inspecting.
+var DefaultInspectedContentTypes = []string{
+	"text/html", "text/plain", "text/xml", "application/json",
+	"application/xml", "application/javascript", "application/problem+json",
+}
+
+// ResponseInspector scans upstream responses for leaked internals and
+// sensitive data. It plugs into httputil.ReverseProxy.ModifyResponse.
+type ResponseInspector struct {
+	actions      map[string]string
+	maxBytes     int64
+	contentTypes map[string]bool
+	detectors    []*leakDetector
+	canBlock     bool
+}
+
+// leakDetector finds one category of leak, with a regexp or, for the
+// digit-heavy categories where a regexp is slow, a hand-written scanner.
+type leakDetector struct {
+	category string
+	re       *regexp.Regexp
+	find     func([]byte) [][]int
+	valid    func([]byte) bool // optional second check on a regex match
+	mask     func([]byte) []byte
+	hints    [][]byte // if set, skip buffers containing none of these
+}
+
+// leakFinding is one leak located in a buffer.
+type leakFinding struct {
+	det        *leakDetector
+	start, end int
+}
+
+var redacted = []byte("[REDACTED]")
+
+func maskRedacted([]byte) []byte { return redacted }
+
+// leakDetectors lists every detector. Each pattern starts with a literal so
+// the regexp engine can skip straight to candidate positions; a single
+// alternation of them all scans at a small fraction of the speed.
+var leakDetectors = concatDetectors(
+	leakPatterns(LeakPrivateKey, maskRedacted, nil,
+		`-----BEGIN [A-Z ]*PRIVATE KEY-----(?:[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----)?`,
+	),
+	leakPatterns(LeakStackTrace, maskRedacted, nil,
+		`Traceback \(most recent call last\):`,                // Python
+		`File "[^"\n]+", line \d+, in [\w<>]+`,                // Python frame
+		`Exception in thread "[^"\n]*" [\w.$]+`,               // Java
+		`goroutine \d+ \[[\w ]+\]:`,                           // Go
+		`Fatal error: [^\n]{1,300}? in /\S+\.php on line \d+`, // PHP
+		`Parse error: [^\n]{1,300}? in /\S+\.php on line \d+`,
+		`Warning: [^\n]{1,300}? in /\S+\.php on line \d+`,
+		`Server Error in '[^'\n]*' Application`, // ASP.NET
+	),
+	// Frames start with the common word "at", so they only run when the
+	// body mentions a matching source file at all.
+	withHints(leakPatterns(LeakStackTrace, maskRedacted, nil,
+		`at [\w$.<>]+\([\w$.<>]*\.(?:java|kt|scala|groovy):\d+\)`, // JVM frame
+	), ".java:", ".kt:", ".scala:", ".groovy:"),
+	withHints(leakPatterns(LeakStackTrace, maskRedacted, nil,
+		`at (?:[\w$.<>\[\] ]+ \()?/[^\s():]+\.(?:js|mjs|cjs|ts):\d+:\d+`, // Node frame
+	), ".js:", ".mjs:", ".cjs:", ".ts:"),
+	withHints(leakPatterns(LeakStackTrace, maskRedacted, nil,
+		`at [\w.<>\[\]`+"`"+`,]+\([^)\n]*\) in [^\n]+:line \d+`, // .NET frame
+	), ":line "),
+	leakPatterns(LeakSQLError, maskRedacted, nil,
+		`You have an error in your SQL syntax[^\n<]*`,
+		`SQLSTATE\[\w+\][^\n<]*`,
+		`ORA-\d{5}:[^\n<]*`,
+		`PG::\w*Error:[^\n<]*`,
+		`pq: (?:syntax error|relation|column)[^\n<]*`,
+		`Unclosed quotation mark after the character string[^\n<]*`,
+		`Incorrect syntax near[^\n<]*`,
+		`Microsoft OLE DB Provider for (?:SQL Server|ODBC Drivers)[^\n<]*`,
+		`SQLite[^\n<]*Exception[^\n<]*`,
+		`sqlite3\.OperationalError[^\n<]*`,
+		`quoted string not properly terminated`,
+		`mysqli?_(?:query|fetch_\w+|connect|num_rows)\(\)[^\n<]*`,
+		`pg_(?:query|fetch_\w+|connect|num_rows)\(\)[^\n<]*`,
+	),
+	[]*leakDetector{
+		{category: LeakCreditCard, find: findCardNumbers, valid: isCardNumber, mask: maskCardNumber},
+		{category: LeakInternalIP, find: findIPv4, valid: isInternalIP, mask: maskRedacted},
+	},
+)
+
+func leakPatterns(category string, mask func([]byte) []byte, valid func([]byte) bool, patterns ...string) []*leakDetector {
+	detectors := make([]*leakDetector, len(patterns))
+	for i, p := range patterns {
+		detectors[i] = &leakDetector{category: category, re: regexp.MustCompile(p), valid: valid, mask: mask}
+	}
+	return detectors
+}
+
+// withHints makes detectors run only on buffers containing one of hints.
+func withHints(detectors []*leakDetector, hints ...string) []*leakDetector {
+	for _, d := range detectors {
+		for _, h := range hints {
+			d.hints = append(d.hints, []byte(h))
+		}
+	}
+	return detectors
+}
+
+func concatDetectors(groups ...[]*leakDetector) []*leakDetector {
+	var all []*leakDetector
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+// NewResponseInspector builds an inspector. Zero config values fall back
+// to the defaults.
+func NewResponseInspector(cfg ResponseInspectorConfig) (*ResponseInspector, error) {
+	ri := &ResponseInspector{
+		actions:      DefaultLeakActions(),
+		maxBytes:     cfg.MaxBytes,
+		contentTypes: make(map[string]bool),
+	}
+	if ri.maxBytes <= 0 {
+		ri.maxBytes = 1 << 20
+	}
+	for category, action := range cfg.Actions {
+		if _, ok := ri.actions[category]; !ok {
+			return nil, fmt.Errorf("unknown leak category %q", category)
+		}
+		switch action {
+		case LeakActionMask, LeakActionBlock, LeakActionLog, LeakActionOff:
+		default:
+			return nil, fmt.Errorf("leak category %s: unknown action %q", category, action)
+		}
+		ri.actions[category] = action
+	}
+
+	types := cfg.ContentTypes
+	if len(types) == 0 {
+		types = DefaultInspectedContentTypes
+	}
+	for _, t := range types {
+		ri.contentTypes[strings.ToLower(t)] = true
+	}
+
+	for _, d := range leakDetectors {
+		switch ri.actions[d.category] {
+		case LeakActionOff:
+			continue
+		case LeakActionBlock:
+			ri.canBlock = true
+		}
+		ri.detectors = append(ri.detectors, d)
+	}
+	return ri, nil
+}
+
+// ModifyResponse inspects resp. Small bodies with a known length are read
+// whole, so a blocking leak can still replace the response with a 502.
+// Everything else is wrapped in a streaming reader that masks as data
+// flows; a blocking leak found there cuts the response short, since the
+// status line has already been sent.
+func (ri *ResponseInspector) ModifyResponse(resp *http.Response) error {
+	if len(ri.detectors) == 0 || !ri.inspects(resp) {
+		return nil
+	}
+
+	if resp.ContentLength > ri.maxBytes {
+		return nil // large download: never buffered or scanned
+	}
+
+	if resp.ContentLength >= 0 && ri.canBlock {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, resp.ContentLength))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		out, _, blocked := ri.apply(resp, body, ri.findings(body), len(body))
+		if blocked != "" {
+			ri.block(resp, blocked)
+			return nil
+		}
+		ri.setBody(resp, out)
+		return nil
+	}
+
+	resp.Body = newLeakReader(ri, resp)
+	// Masking changes the length, so the body is re-framed as chunked.
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// inspects reports whether the response is a textual type we can read.
+func (ri *ResponseInspector) inspects(resp *http.Response) bool {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	// Compressed bodies are opaque here; the upstream must send identity.
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return ri.contentTypes[strings.ToLower(mediaType)]
+}
+
+// findings locates every leak in buf, ordered by position.
+func (ri *ResponseInspector) findings(buf []byte) []leakFinding {
+	var found []leakFinding
+	for _, d := range ri.detectors {
+		if len(d.hints) > 0 && !containsAny(buf, d.hints) {
+			continue
+		}
+		var locs [][]int
+		if d.find != nil {
+			locs = d.find(buf)
+		} else {
+			locs = d.re.FindAllIndex(buf, -1)
+		}
+		for _, loc := range locs {
+			if d.valid != nil && !d.valid(buf[loc[0]:loc[1]]) {
+				continue
+			}
+			found = append(found, leakFinding{det: d, start: loc[0], end: loc[1]})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].start < found[j].start })
+	return found
+}
+
+// apply masks the leaks that end before cut and returns the masked prefix
+// buf[:cut], or the category of the first blocking leak. Overlapping
+// findings are resolved in favour of the one that starts first.
+func (ri *ResponseInspector) apply(resp *http.Response, buf []byte, found []leakFinding, cut int) ([]byte, int, string) {
+	var out bytes.Buffer
+	pos := 0
+	for _, f := range found {
+		if f.start < pos || f.end > cut {
+			continue
+		}
+		action := ri.actions[f.det.category]
+		ri.record(resp, f.det.category, action, buf[f.start:f.end])
+		switch action {
+		case LeakActionBlock:
+			return nil, 0, f.det.category
+		case LeakActionMask:
+			out.Write(buf[pos:f.start])
+			out.Write(f.det.mask(buf[f.start:f.end]))
+			pos = f.end
+		}
+	}
+	out.Write(buf[pos:cut])
+	return out.Bytes(), cut, ""
+}
+
+func (ri *ResponseInspector) record(resp *http.Response, category, action string, leaked []byte) {
+	path, remote := "", ""
+	if resp.Request != nil {
+		path = resp.Request.URL.Path
+		remote = util.GetRealIP(resp.Request)
+	}
+	logger.Warn("Data leak detected in upstream response",
+		"category", category,
+		"action", action,
+		"status", resp.StatusCode,
+		"path", path,
+		"remote_addr", remote,
+		"length", len(leaked),
+	)
+	if MetricsEnabled() {
+		ResponseLeaks.WithLabelValues(category, action).Inc()
+		if action == LeakActionBlock {
+			BlockedRequests.WithLabelValues("L7", "leak:"+category).Inc()
+		}
+	}
+}
+
+func containsAny(buf []byte, hints [][]byte) bool {
+	for _, h := range hints {
+		if bytes.Contains(buf, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// block replaces a buffered response with a 502.
+func (ri *ResponseInspector) block(resp *http.Response, category string) {
+	resp.StatusCode = http.StatusBadGateway
+	resp.Status = strconv.Itoa(http.StatusBadGateway) + " " + http.StatusText(http.StatusBadGateway)
+	for _, h := range []string{"Content-Encoding", "Content-Disposition", "ETag", "Last-Modified"} {
+		resp.Header.Del(h)
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	ri.setBody(resp, []byte("Response blocked\n"))
+}
+
+func (ri *ResponseInspector) setBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// leakReader masks leaks while streaming a body. It keeps the last
+// leakOverlap bytes of each chunk back until more data arrives, the
+// upstream pauses for leakFlushDelay, or EOF.
+type leakReader struct {
+	ri        *ResponseInspector
+	resp      *http.Response
+	src       io.ReadCloser
+	chunks    chan leakChunk // filled by pump
+	done      chan struct{}
+	closeOnce sync.Once
+	pending   []byte // read but not yet inspected/emitted
+	out       []byte // inspected, ready to return
+	inspected int64
+	eof       bool
+	err       error
+}
+
+// leakChunk is one read from the upstream.
+type leakChunk struct {
+	data []byte
+	err  error
+}
+
+func newLeakReader(ri *ResponseInspector, resp *http.Response) *leakReader {
+	lr := &leakReader{
+		ri:     ri,
+		resp:   resp,
+		src:    resp.Body,
+		chunks: make(chan leakChunk),
+		done:   make(chan struct{}),
+	}
+	go lr.pump()
+	return lr
+}
+
+// pump reads the upstream in the background, so fill can tell a pause from
+// a slow read.
+func (lr *leakReader) pump() {
+	for {
+		buf := make([]byte, leakChunkSize)
+		n, err := lr.src.Read(buf)
+		select {
+		case lr.chunks <- leakChunk{data: buf[:n], err: err}:
+		case <-lr.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (lr *leakReader) Read(p []byte) (int, error) {
+	for len(lr.out) == 0 {
+		if lr.err != nil {
+			return 0, lr.err
+		}
+		if lr.eof && len(lr.pending) == 0 {
+			return 0, io.EOF
+		}
+		lr.fill()
+	}
+	n := copy(p, lr.out)
+	lr.out = lr.out[n:]
+	return n, nil
+}
+
+// receive records one chunk from the upstream in pending.
+func (lr *leakReader) receive(c leakChunk) {
+	lr.pending = append(lr.pending, c.data...)
+	if c.err != nil {
+		lr.eof = true
+		if c.err != io.EOF {
+			lr.err = c.err
+		}
+	}
+}
+
+func (lr *leakReader) fill() {
+	// Past the inspection limit: pass the rest through untouched.
+	if lr.inspected >= lr.ri.maxBytes {
+		if len(lr.pending) == 0 && !lr.eof {
+			lr.receive(<-lr.chunks)
+		}
+		lr.out, lr.pending = lr.pending, nil
+		return
+	}
+
+	paused := false
+	if !lr.eof {
+		if len(lr.pending) == 0 {
+			lr.receive(<-lr.chunks)
+		} else {
+			timer := time.NewTimer(leakFlushDelay)
+			select {
+			case c := <-lr.chunks:
+				lr.receive(c)
+			case <-timer.C:
+				paused = true
+			}
+			timer.Stop()
+		}
+	}
+
+	cut := len(lr.pending)
+	if !lr.eof && !paused {
+		cut -= leakOverlap
+		if cut <= 0 {
+			return // need more data before anything can be released
+		}
+	}
+	found := lr.ri.findings(lr.pending)
+	// Never split a leak: release only up to the start of one that straddles the cut.
+	for _, f := range found {
+		if f.start < cut && f.end > cut {
+			cut = f.start
+			break
+		}
+	}
+	out, n, blocked := lr.ri.apply(lr.resp, lr.pending, found, cut)
+	if blocked != "" {
+		lr.err = errResponseBlocked
+		lr.pending = nil
+		return
+	}
+	lr.out = out
+	lr.pending = lr.pending[n:]
+	lr.inspected += int64(n)
+}
+
+func (lr *leakReader) Close() error {
+	lr.closeOnce.Do(func() { close(lr.done) })
+	return lr.src.Close()
+}
+
+// findCardNumbers locates runs of 13-19 digits, optionally grouped by
+// single spaces or dashes, that are not part of a longer word or number.
+func findCardNumbers(buf []byte) [][]int {
+	var locs [][]int
+	for i := 0; i < len(buf); i++ {
+		if !isDigit(buf[i]) || i > 0 && isAlnum(buf[i-1]) {
+			continue
+		}
+		j, digits := i, 0
+		for j < len(buf) {
+			if isDigit(buf[j]) {
+				digits++
+				j++
+			} else if (buf[j] == ' ' || buf[j] == '-') && j+1 < len(buf) && isDigit(buf[j+1]) {
+				j++
+			} else {
+				break
+			}
+		}
+		if digits >= 13 && digits <= 19 && (j == len(buf) || !isAlnum(buf[j])) {
+			locs = append(locs, []int{i, j})
+		}
+		i = j
+	}
+	return locs
+}
+
+// findIPv4 locates dotted-quad addresses that are not part of a longer
+// dotted sequence such as a version number.
+func findIPv4(buf []byte) [][]int {
+	var locs [][]int
+	for i := 0; i < len(buf); i++ {
+		if !isDigit(buf[i]) || i > 0 && (isAlnum(buf[i-1]) || buf[i-1] == '.') {
+			continue
+		}
+		j, octets := i, 0
+		for octets < 4 {
+			start := j
+			for j < len(buf) && j-start < 3 && isDigit(buf[j]) {
+				j++
+			}
+			if j == start {
+				break
+			}
+			octets++
+			if octets < 4 && j+1 < len(buf) && buf[j] == '.' && isDigit(buf[j+1]) {
+				j++
+				continue
+			}
+			break
+		}
+		end := j
+		if octets == 4 && (end == len(buf) || !isAlnum(buf[end]) && !(buf[end] == '.' && end+1 < len(buf) && isDigit(buf[end+1]))) {
+			locs = append(locs, []int{i, end})
+		}
+		for j < len(buf) && (isDigit(buf[j]) || buf[j] == '.') {
+			j++
+		}
+		i = j
+	}
+	return locs
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || isASCIILetter(c)
+}
+
+// isCardNumber accepts digit runs that have a card network prefix and
+// length and pass the Luhn checksum, so order numbers and millisecond
+// timestamps are left alone.
+func isCardNumber(match []byte) bool {
+	digits := make([]byte, 0, 19)
+	for _, c := range match {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, c)
+		}
+	}
+	n := len(digits)
+	s := string(digits)
+	network := false
+	switch {
+	case s[0] == '4':
+		network = n == 13 || n == 16 || n == 19
+	case s[:2] >= "51" && s[:2] <= "55", s[:4] >= "2221" && s[:4] <= "2720":
+		network = n == 16
+	case s[:2] == "34" || s[:2] == "37":
+		network = n == 15
+	case strings.HasPrefix(s, "6011"), strings.HasPrefix(s, "65"), s[:3] >= "644" && s[:3] <= "649",
+		strings.HasPrefix(s, "35"):
+		network = n >= 16 && n <= 19
+	case strings.HasPrefix(s, "36"), strings.HasPrefix(s, "38"), strings.HasPrefix(s, "30"):
+		network = n == 14
+	}
+	return network && luhnValid(digits)
+}
+
+func luhnValid(digits []byte) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// maskCardNumber keeps the separators and the last four digits.
+func maskCardNumber(match []byte) []byte {
+	out := append([]byte(nil), match...)
+	keep := 4
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i] < '0' || out[i] > '9' {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		out[i] = '*'
+	}
+	return out
+}
+
+// isInternalIP accepts RFC 1918 and loopback addresses.
+func isInternalIP(match []byte) bool {
+	ip := net.ParseIP(string(match))
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback())
+}
@@ -0,0 +1,378 @@
+package filter
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"aegisedge/logger"
+)
+
+// SlowClientConfig configures a SlowClientDetector. A zero rate turns that
+// direction off.
+type SlowClientConfig struct {
+	MinRecvRate int // bytes/sec a client must send request headers and bodies at
+	MinSendRate int // bytes/sec a client must accept responses at
+	// Grace is how long a connection must have been waiting on the client
+	// before its rate is judged, and the window it is judged over.
+	Grace time.Duration
+	// Exempt reports peers that are never judged, such as trusted load
+	// balancers, which buffer for many clients. Behind ServeProxyProtocol,
+	// a connection whose header names a client is judged as that client.
+	Exempt func(ip string) bool
+}
+
+// SlowClientDetector cuts off clients that hold connections open by
+// trickling requests (slowloris) or by reading responses slowly (slow read).
+//
+// It only measures time the connection spends waiting on the client: time
+// blocked in a read while a request is being received, and time blocked in
+// a write. A keep-alive connection waiting for its next request, or a
+// stream whose upstream has nothing to send, is never judged slow.
+type SlowClientDetector struct {
+	cfg   SlowClientConfig
+	rep   *ReputationManager
+	conns sync.Map // *slowConn -> struct{}
+	stop  chan struct{}
+}
+
+func NewSlowClientDetector(cfg SlowClientConfig, rep *ReputationManager) *SlowClientDetector {
+	if cfg.Grace <= 0 {
+		cfg.Grace = 5 * time.Second
+	}
+	d := &SlowClientDetector{cfg: cfg, rep: rep, stop: make(chan struct{})}
+	if d.enabled() {
+		go d.loop()
+	}
+	return d
+}
+
+func (d *SlowClientDetector) enabled() bool {
+	return d.cfg.MinRecvRate > 0 || d.cfg.MinSendRate > 0
+}
+
+// Stop cancels the sweep goroutine.
+func (d *SlowClientDetector) Stop() {
+	close(d.stop)
+}
+
+// Serve wraps ln so the connections srv accepts from it are measured. It
+// chains srv's ConnState and ConnContext hooks, so install it after any
+// other listener wrapper that sets them (ConnTracker.Serve).
+func (d *SlowClientDetector) Serve(srv *http.Server, ln net.Listener) net.Listener {
+	if !d.enabled() {
+		return ln
+	}
+
+	prevState := srv.ConnState
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if sc := asSlowConn(c); sc != nil {
+			switch state {
+			case http.StateIdle:
+				sc.awaitRequest(true)
+			case http.StateHijacked:
+				sc.awaitRequest(false)
+			}
+		}
+		if prevState != nil {
+			prevState(c, state)
+		}
+	}
+	prevCtx := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if prevCtx != nil {
+			ctx = prevCtx(ctx, c)
+		}
+		if sc := asSlowConn(c); sc != nil {
+			ctx = context.WithValue(ctx, slowConnKey{}, sc)
+		}
+		return ctx
+	}
+	return &slowListener{Listener: ln, d: d}
+}
+
+// Middleware ends a request's receive phase once its headers, and any
+// body, have been read, so time spent waiting on the upstream is never
+// blamed on the client.
+func (d *SlowClientDetector) Middleware(next http.Handler) http.Handler {
+	if !d.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc, _ := r.Context().Value(slowConnKey{}).(*slowConn)
+		if sc == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer sc.setReceiving(false)
+		if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+			sc.setReceiving(false)
+		} else {
+			r.Body = &slowBody{ReadCloser: r.Body, c: sc}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Watch measures a proxied stream's writes to the client, attributing a
+// slow read to ip. Reads are not judged: an idle stream is legitimate.
+// Call the returned func when the stream ends.
+func (d *SlowClientDetector) Watch(c net.Conn, ip string) (net.Conn, func()) {
+	if d == nil || d.cfg.MinSendRate <= 0 || (d.cfg.Exempt != nil && d.cfg.Exempt(ip)) {
+		return c, func() {}
+	}
+	sc := d.track(c, ip, nil, "stream", false)
+	return sc, func() { d.conns.Delete(sc) }
+}
+
+func (d *SlowClientDetector) track(c net.Conn, ip string, pc *proxyConn, kind string, awaiting bool) *slowConn {
+	sc := &slowConn{Conn: c, d: d, ip: ip, pc: pc, kind: kind, awaiting: awaiting}
+	d.conns.Store(sc, struct{}{})
+	return sc
+}
+
+func (d *SlowClientDetector) loop() {
+	interval := min(max(d.cfg.Grace/4, 10*time.Millisecond), time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.conns.Range(func(k, _ any) bool {
+				k.(*slowConn).check(now)
+				return true
+			})
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// cutOff closes a slow connection and penalizes its client.
+func (d *SlowClientDetector) cutOff(c *slowConn, direction string, rate float64, minRate int) {
+	ip := c.client()
+	logger.Warn("Slow client disconnected", "ip", ip, "conn", c.kind, "direction", direction, "bytes_per_sec", int(rate), "min_bytes_per_sec", minRate)
+	if MetricsEnabled() {
+		BlockedRequests.WithLabelValues("L4", "slow_client").Inc()
+	}
+	if d.rep != nil {
+		d.rep.Penalize(ip)
+	}
+	c.Close()
+}
+
+type slowConnKey struct{}
+
+// asSlowConn finds the slowConn under c, which the server may have wrapped
+// in TLS.
+func asSlowConn(c net.Conn) *slowConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	sc, _ := c.(*slowConn)
+	return sc
+}
+
+type slowListener struct {
+	net.Listener
+	d *SlowClientDetector
+}
+
+func (l *slowListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ip := splitL4Host(c.RemoteAddr().String())
+	pc := asProxyConn(c)
+	if pc != nil && !pc.proxied() {
+		pc = nil
+	}
+	if pc == nil && l.d.cfg.Exempt != nil && l.d.cfg.Exempt(ip) {
+		return c, nil
+	}
+	return l.d.track(c, ip, pc, "http", true), nil
+}
+
+// rateMeter accumulates the time spent blocked on the client in one
+// direction and the bytes moved meanwhile.
+type rateMeter struct {
+	busy  time.Duration
+	bytes int64
+	since time.Time // start of the call in progress, zero if none
+
+	windowBusy  time.Duration
+	windowBytes int64
+}
+
+// busyAt returns the blocked time up to now, counting a call in progress.
+func (m *rateMeter) busyAt(now time.Time) time.Duration {
+	if m.since.IsZero() {
+		return m.busy
+	}
+	return m.busy + now.Sub(m.since)
+}
+
+// judge returns the rate over the current window once the connection has
+// been blocked for grace within it, and starts a new window.
+func (m *rateMeter) judge(now time.Time, grace time.Duration) (float64, bool) {
+	busy := m.busyAt(now) - m.windowBusy
+	if busy < grace {
+		return 0, false
+	}
+	rate := float64(m.bytes-m.windowBytes) / busy.Seconds()
+	m.windowBusy, m.windowBytes = m.busyAt(now), m.bytes
+	return rate, true
+}
+
+// slowConn measures how quickly its client sends and receives.
+type slowConn struct {
+	net.Conn
+	d    *SlowClientDetector
+	ip   string
+	kind string     // http or stream
+	pc   *proxyConn // a trusted balancer's, judged as the client it names
+
+	mu        sync.Mutex
+	awaiting  bool // idle: the next byte starts a request
+	receiving bool // a request is being read
+	rx, tx    rateMeter
+	closeOnce sync.Once
+}
+
+// client returns the IP the connection is judged as.
+func (c *slowConn) client() string {
+	if c.pc == nil {
+		return c.ip
+	}
+	return splitL4Host(c.pc.clientAddr().String())
+}
+
+func (c *slowConn) setReceiving(on bool) {
+	c.mu.Lock()
+	c.receiving = on
+	c.mu.Unlock()
+}
+
+// awaitRequest marks the connection idle between requests: waiting for
+// the next one is not the client's fault, but once its first byte arrives
+// the rest of the request must follow at the minimum rate.
+func (c *slowConn) awaitRequest(on bool) {
+	c.mu.Lock()
+	c.awaiting = on
+	c.receiving = false
+	c.mu.Unlock()
+}
+
+func (c *slowConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	metered := c.receiving && c.d.cfg.MinRecvRate > 0
+	if metered {
+		c.rx.since = time.Now()
+	}
+	c.mu.Unlock()
+
+	n, err := c.Conn.Read(p)
+
+	c.mu.Lock()
+	if metered && !c.rx.since.IsZero() {
+		c.rx.busy += time.Since(c.rx.since)
+		c.rx.since = time.Time{}
+	}
+	if metered || (c.awaiting && n > 0) {
+		c.rx.bytes += int64(n)
+	}
+	if c.awaiting && n > 0 {
+		c.awaiting, c.receiving = false, true
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// slowWriteChunk bounds each underlying write so a stalled client's
+// progress is visible to the sweep while a large write is in flight.
+const slowWriteChunk = 4096
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	if c.d.cfg.MinSendRate <= 0 {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), slowWriteChunk)]
+		c.mu.Lock()
+		c.tx.since = time.Now()
+		c.mu.Unlock()
+
+		n, err := c.Conn.Write(chunk)
+
+		c.mu.Lock()
+		c.tx.busy += time.Since(c.tx.since)
+		c.tx.since = time.Time{}
+		c.tx.bytes += int64(n)
+		c.mu.Unlock()
+
+		written += n
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *slowConn) Close() error {
+	c.closeOnce.Do(func() { c.d.conns.Delete(c) })
+	return c.Conn.Close()
+}
+
+// check judges both directions. It is called by the sweep.
+func (c *slowConn) check(now time.Time) {
+	cfg := c.d.cfg
+	// Until its header names a client, a balancer's connection is its own
+	if c.pc != nil && cfg.Exempt != nil && cfg.Exempt(c.client()) {
+		return
+	}
+	c.mu.Lock()
+	var direction string
+	var rate float64
+	var minRate int
+	if cfg.MinRecvRate > 0 && c.receiving {
+		if r, ok := c.rx.judge(now, cfg.Grace); ok && r < float64(cfg.MinRecvRate) {
+			direction, rate, minRate = "request", r, cfg.MinRecvRate
+		}
+	}
+	if direction == "" && cfg.MinSendRate > 0 {
+		if r, ok := c.tx.judge(now, cfg.Grace); ok && r < float64(cfg.MinSendRate) {
+			direction, rate, minRate = "response", r, cfg.MinSendRate
+		}
+	}
+	c.mu.Unlock()
+
+	if direction != "" {
+		c.d.cutOff(c, direction, rate, minRate)
+	}
+}
+
+// slowBody ends the receive phase when the request body is exhausted.
+type slowBody struct {
+	io.ReadCloser
+	c *slowConn
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.c.setReceiving(false)
+	}
+	return n, err
+}
+
+func (b *slowBody) Close() error {
+	b.c.setReceiving(false)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,153 @@
+package filter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startSlowDetected(t *testing.T, cfg SlowClientConfig, h http.Handler) (*httptest.Server, *ReputationManager) {
+	t.Helper()
+	rep := NewReputationManager(nil)
+	d := NewSlowClientDetector(cfg, rep)
+	srv := httptest.NewUnstartedServer(d.Middleware(h))
+	srv.Listener = d.Serve(srv.Config, srv.Listener)
+	srv.Start()
+	t.Cleanup(func() {
+		srv.Close()
+		d.Stop()
+	})
+	return srv, rep
+}
+
+func TestSlowClientSlowloris(t *testing.T) {
+	srv, rep := startSlowDetected(t, SlowClientConfig{MinRecvRate: 1000, Grace: 200 * time.Millisecond},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	c := dial(t, srv)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\n")
+	cut := false
+	for i := 0; i < 30 && !cut; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := io.WriteString(c, "X-a: b\r\n"); err != nil {
+			cut = true
+		}
+	}
+	if !cut && !closedByServer(t, c, 100*time.Millisecond) {
+		t.Fatal("header trickle should be cut off")
+	}
+	if rep.GetTrust("127.0.0.1") >= 0 {
+		t.Error("slow client should be penalized")
+	}
+}
+
+func TestSlowClientProxiedSlowloris(t *testing.T) {
+	rep := NewReputationManager(nil)
+	trusted := func(ip string) bool { return ip == "127.0.0.1" }
+	d := NewSlowClientDetector(SlowClientConfig{MinRecvRate: 1000, Grace: 200 * time.Millisecond, Exempt: trusted}, rep)
+	defer d.Stop()
+	srv := httptest.NewUnstartedServer(d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	srv.Listener = d.Serve(srv.Config, ServeProxyProtocol(srv.Config, srv.Listener, trusted))
+	srv.Start()
+	defer srv.Close()
+
+	// The balancer is exempt, but the client it names is judged
+	c := dial(t, srv)
+	io.WriteString(c, "PROXY TCP4 203.0.113.7 10.0.0.1 50000 80\r\nGET / HTTP/1.1\r\nHost: example.com\r\n")
+	cut := false
+	for i := 0; i < 30 && !cut; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := io.WriteString(c, "X-a: b\r\n"); err != nil {
+			cut = true
+		}
+	}
+	if !cut && !closedByServer(t, c, 100*time.Millisecond) {
+		t.Fatal("proxied header trickle should be cut off")
+	}
+	if rep.GetTrust("203.0.113.7") >= 0 {
+		t.Error("the proxied client should be penalized")
+	}
+	if rep.GetTrust("127.0.0.1") != 0 {
+		t.Error("the balancer should not be penalized")
+	}
+}
+
+func TestSlowClientIdleKeepAlive(t *testing.T) {
+	srv, rep := startSlowDetected(t, SlowClientConfig{MinRecvRate: 1000, MinSendRate: 1000, Grace: 100 * time.Millisecond},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			time.Sleep(300 * time.Millisecond) // a slow upstream isn't the client's fault
+			io.WriteString(w, "ok")
+		}))
+
+	c := dial(t, srv)
+	br := bufio.NewReader(c)
+	for i := 0; i < 2; i++ {
+		io.WriteString(c, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		time.Sleep(400 * time.Millisecond) // idle keep-alive
+	}
+	if rep.GetTrust("127.0.0.1") != 0 {
+		t.Error("a client waiting on the server must not be penalized")
+	}
+}
+
+func TestSlowClientSlowRead(t *testing.T) {
+	body := strings.Repeat("x", 16<<20)
+	srv, rep := startSlowDetected(t, SlowClientConfig{MinSendRate: 1 << 20, Grace: 200 * time.Millisecond},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}))
+
+	c := dial(t, srv)
+	c.(*net.TCPConn).SetReadBuffer(4096)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	// Never read; the server's writes stall once the socket buffers fill
+	deadline := time.Now().Add(5 * time.Second)
+	for rep.GetTrust("127.0.0.1") >= 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if rep.GetTrust("127.0.0.1") >= 0 {
+		t.Error("a client that stops reading should be cut off")
+	}
+}
+
+func TestSlowClientStream(t *testing.T) {
+	rep := NewReputationManager(nil)
+	d := NewSlowClientDetector(SlowClientConfig{MinSendRate: 1000, Grace: 100 * time.Millisecond}, rep)
+	defer d.Stop()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	watched, unwatch := d.Watch(server, "192.0.2.7")
+	defer unwatch()
+
+	// net.Pipe is unbuffered: with nobody reading, the write blocks
+	done := make(chan error, 1)
+	go func() {
+		_, err := watched.Write(make([]byte, 64<<10))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("write to a client that never reads should fail")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("stalled stream was not cut off")
+	}
+	if rep.GetTrust("192.0.2.7") >= 0 {
+		t.Error("stream client should be penalized")
+	}
+}
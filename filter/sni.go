@@ -0,0 +1,208 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"aegisedge/logger"
+)
+
+// SNIRoute sends TLS connections for a server name to a backend.
+type SNIRoute struct {
+	Host    string   `json:"host"`              // exact name or "*.example.com"
+	ALPN    []string `json:"alpn"`              // if set, only clients offering one of these protocols match
+	Backend string   `json:"backend"`           // host:port
+	PerIP   int      `json:"conn_limit"`        // open connections per client IP; 0 = unlimited
+	Global  int      `json:"global_conn_limit"` // open connections across all clients
+}
+
+// TLSPassthroughConfig routes a tcp_ports listener's TLS connections by the
+// server name in their ClientHello. TLS is not terminated: the backends
+// keep their certificates.
+type TLSPassthroughConfig struct {
+	Routes  []SNIRoute `json:"routes"`
+	Default string     `json:"default"` // backend for names no route matches; "" refuses them
+}
+
+// SNIRouter picks a backend for each connection from its ClientHello.
+// Exact host names are tried before wildcards, each in config order.
+type SNIRouter struct {
+	exact    []*sniRoute
+	wildcard []*sniRoute
+	def      *sniRoute // nil refuses unmatched names
+}
+
+// sniRoute is an SNIRoute with its open connection counts.
+type sniRoute struct {
+	SNIRoute
+
+	mu    sync.Mutex
+	open  int
+	perIP map[string]int
+}
+
+// clientHelloTimeout bounds how long a client may take to send its
+// ClientHello.
+const clientHelloTimeout = 5 * time.Second
+
+// NewSNIRouter validates cfg's hosts and backends.
+func NewSNIRouter(cfg TLSPassthroughConfig) (*SNIRouter, error) {
+	s := &SNIRouter{}
+	for _, r := range cfg.Routes {
+		r.Host = strings.TrimSuffix(strings.ToLower(r.Host), ".")
+		if r.Host == "" {
+			return nil, errors.New("tls passthrough route without a host")
+		}
+		if _, _, err := net.SplitHostPort(r.Backend); err != nil {
+			return nil, fmt.Errorf("tls passthrough route %s: bad backend %q: %v", r.Host, r.Backend, err)
+		}
+		route := &sniRoute{SNIRoute: r, perIP: make(map[string]int)}
+		if strings.HasPrefix(r.Host, "*") {
+			s.wildcard = append(s.wildcard, route)
+		} else {
+			s.exact = append(s.exact, route)
+		}
+	}
+	if cfg.Default != "" {
+		if _, _, err := net.SplitHostPort(cfg.Default); err != nil {
+			return nil, fmt.Errorf("tls passthrough: bad default backend %q: %v", cfg.Default, err)
+		}
+		s.def = &sniRoute{SNIRoute: SNIRoute{Host: "default", Backend: cfg.Default}, perIP: make(map[string]int)}
+	}
+	return s, nil
+}
+
+// route returns the route for a ClientHello, or nil if none takes it.
+func (s *SNIRouter) route(hello *ClientHello) *sniRoute {
+	for _, routes := range [][]*sniRoute{s.exact, s.wildcard} {
+		for _, r := range routes {
+			if matchHostPattern(r.Host, hello.ServerName) && r.offered(hello.ALPN) {
+				return r
+			}
+		}
+	}
+	return s.def
+}
+
+func (r *sniRoute) offered(alpn []string) bool {
+	if len(r.ALPN) == 0 {
+		return true
+	}
+	for _, p := range alpn {
+		if slices.Contains(r.ALPN, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire claims a connection slot for ip, or returns the limit in the way.
+func (r *sniRoute) acquire(ip string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Global > 0 && r.open >= r.Global {
+		return "sni_global_conn_limit"
+	}
+	if r.PerIP > 0 && r.perIP[ip] >= r.PerIP {
+		return "sni_conn_limit"
+	}
+	r.open++
+	r.perIP[ip]++
+	return ""
+}
+
+func (r *sniRoute) release(ip string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.open--
+	if r.perIP[ip]--; r.perIP[ip] <= 0 {
+		delete(r.perIP, ip)
+	}
+}
+
+// admit reads conn's ClientHello through rd, picks its route and claims a
+// slot on it. It returns the route, and a reader replaying the ClientHello
+// followed by the rest of rd; ok false means the connection was refused.
+// The caller releases the route's slot.
+func (s *SNIRouter) admit(conn net.Conn, rd io.Reader, ip string) (route *sniRoute, replay io.Reader, ok bool) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	hello, replay, err := PeekClientHello(rd)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logger.Warn("TLS passthrough: no ClientHello, dropping connection", "ip", ip, "err", err)
+		sniRefused("not_tls")
+		return nil, nil, false
+	}
+
+	route = s.route(hello)
+	if route == nil {
+		logger.Warn("TLS passthrough: no route for server name", "ip", ip, "sni", hello.ServerName, "alpn", hello.ALPN)
+		sniRefused("sni_no_route")
+		return nil, nil, false
+	}
+	if reason := route.acquire(ip); reason != "" {
+		logger.Warn("TLS passthrough: route connection limit exceeded", "ip", ip, "sni", hello.ServerName, "route", route.Host, "limit_type", reason)
+		sniRefused(reason)
+		return nil, nil, false
+	}
+	logger.Debug("TLS passthrough routed", "ip", ip, "sni", hello.ServerName, "alpn", hello.ALPN, "backend", route.Backend)
+	return route, replay, true
+}
+
+func sniRefused(reason string) {
+	if MetricsEnabled() {
+		BlockedRequests.WithLabelValues("L4", reason).Inc()
+	}
+}
+
+// ClientHello is what a TLS client announced in its ClientHello.
+type ClientHello struct {
+	ServerName string   // SNI, lower-case; "" if the client sent none
+	ALPN       []string // protocols offered, in the client's order
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// PeekClientHello reads a TLS ClientHello from r without answering it. It
+// returns the hello and a reader that replays the bytes consumed, then the
+// rest of r, for forwarding the connection untouched.
+func PeekClientHello(r io.Reader) (*ClientHello, io.Reader, error) {
+	var buf bytes.Buffer
+	var hello *ClientHello
+	// crypto/tls does the parsing; the handshake is abandoned as soon as
+	// the hello is in, and its alert goes nowhere.
+	err := tls.Server(helloConn{Reader: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &ClientHello{
+				ServerName: strings.TrimSuffix(strings.ToLower(h.ServerName), "."),
+				ALPN:       slices.Clone(h.SupportedProtos),
+			}
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, nil, err
+	}
+	return hello, io.MultiReader(&buf, r), nil
+}
+
+// helloConn is a read-only net.Conn for PeekClientHello.
+type helloConn struct {
+	io.Reader
+}
+
+func (helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (helloConn) Close() error                       { return nil }
+func (helloConn) LocalAddr() net.Addr                { return nil }
+func (helloConn) RemoteAddr() net.Addr               { return nil }
+func (helloConn) SetDeadline(t time.Time) error      { return nil }
+func (helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (helloConn) SetWriteDeadline(t time.Time) error { return nil }
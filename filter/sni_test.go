@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSNIRouter(t *testing.T) {
+	s, err := NewSNIRouter(TLSPassthroughConfig{
+		Routes: []SNIRoute{
+			{Host: "*.example.com", Backend: "10.0.0.1:443"},
+			{Host: "API.example.com.", Backend: "10.0.0.2:443"},
+			{Host: "grpc.example.com", ALPN: []string{"h2"}, Backend: "10.0.0.3:443"},
+		},
+		Default: "10.0.0.9:443",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sni  string
+		alpn []string
+		want string
+	}{
+		{"api.example.com", nil, "10.0.0.2:443"}, // exact beats an earlier wildcard
+		{"www.example.com", nil, "10.0.0.1:443"},
+		{"grpc.example.com", []string{"http/1.1", "h2"}, "10.0.0.3:443"},
+		{"grpc.example.com", []string{"http/1.1"}, "10.0.0.1:443"}, // no h2: falls to the wildcard
+		{"other.org", nil, "10.0.0.9:443"},
+		{"", nil, "10.0.0.9:443"},
+	}
+	for _, tt := range tests {
+		if got := s.route(&ClientHello{ServerName: tt.sni, ALPN: tt.alpn}); got == nil || got.Backend != tt.want {
+			t.Errorf("%q %v: got %+v, want %s", tt.sni, tt.alpn, got, tt.want)
+		}
+	}
+
+	noDefault, _ := NewSNIRouter(TLSPassthroughConfig{Routes: []SNIRoute{{Host: "a.example.com", Backend: "10.0.0.1:443"}}})
+	if r := noDefault.route(&ClientHello{ServerName: "b.example.com"}); r != nil {
+		t.Errorf("unmatched name routed to %s without a default", r.Backend)
+	}
+
+	for _, bad := range []TLSPassthroughConfig{
+		{Routes: []SNIRoute{{Backend: "10.0.0.1:443"}}},
+		{Routes: []SNIRoute{{Host: "a.example.com", Backend: "10.0.0.1"}}},
+		{Default: "nowhere"},
+	} {
+		if _, err := NewSNIRouter(bad); err == nil {
+			t.Errorf("%+v: expected an error", bad)
+		}
+	}
+}
+
+func TestSNIRouteLimits(t *testing.T) {
+	r := &sniRoute{SNIRoute: SNIRoute{PerIP: 1, Global: 2}, perIP: make(map[string]int)}
+	if reason := r.acquire("10.0.0.1"); reason != "" {
+		t.Fatalf("first connection refused: %s", reason)
+	}
+	if reason := r.acquire("10.0.0.1"); reason != "sni_conn_limit" {
+		t.Errorf("second from the same IP got %q", reason)
+	}
+	r.acquire("10.0.0.2")
+	if reason := r.acquire("10.0.0.3"); reason != "sni_global_conn_limit" {
+		t.Errorf("third client got %q", reason)
+	}
+	r.release("10.0.0.1")
+	if reason := r.acquire("10.0.0.3"); reason != "" {
+		t.Errorf("released slot not reusable: %s", reason)
+	}
+}
+
+func TestStreamProxyTLSPassthrough(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	a, b := backend("a"), backend("b")
+
+	router, err := NewSNIRouter(TLSPassthroughConfig{
+		Routes: []SNIRoute{
+			{Host: "a.example.com", Backend: a.Listener.Addr().String()},
+			{Host: "*.b.example.com", Backend: b.Listener.Addr().String()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go StreamProxy(ln, StreamConfig{L4: NewL4Filter(0, nil), SNI: router})
+
+	get := func(sni string) (string, error) {
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: "+sni+"\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// The backends' own certificates reach the client: TLS is end to end
+	for sni, want := range map[string]string{"a.example.com": "a", "x.b.example.com": "b"} {
+		if got, err := get(sni); err != nil || got != want {
+			t.Errorf("%s: got %q, %v; want %q", sni, got, err, want)
+		}
+	}
+	if got, err := get("c.example.com"); err == nil {
+		t.Errorf("unrouted name got %q", got)
+	}
+
+	// Plain text on a passthrough port is dropped
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n")
+	if got, _ := io.ReadAll(c); strings.Contains(string(got), "200") {
+		t.Errorf("plain text request answered: %q", got)
+	}
+}
@@ -61,16 +61,6 @@ func (d *StatisticalAnomalyDetector) Middleware(next http.Handler) http.Handler
 			count := d.RequestCount.Swap(0)
 			currentRPS := float64(count) / float64(d.WindowSize)
 
-			// Welford's Algorithm for online mean and variance (α=0.1 EMA approximation)
-			if d.MeanRPS == 0 {
-				d.MeanRPS = currentRPS
-			} else {
-				delta := currentRPS - d.MeanRPS
-				d.MeanRPS += 0.1 * delta
-				// Update variance with EMA logic
-				d.VarianceRPS = (0.9 * d.VarianceRPS) + (0.1 * delta * (currentRPS - d.MeanRPS))
-			}
-
 			// Compute true standard deviation from the tracked variance.
 			// VarianceRPS is maintained via an EMA-weighted Welford approximation.
 			// We use a floor of 1.0 to avoid zero variance on dormant/static sites.
@@ -80,12 +70,24 @@ func (d *StatisticalAnomalyDetector) Middleware(next http.Handler) http.Handler
 			}
 
 			// Z-Score Detection: trigger when currentRPS > Mean + 3*Sigma.
+			// The threshold is taken from the baseline BEFORE this window is folded
+			// in, otherwise a single spike always lands exactly on its own threshold.
 			// Hard floor of 10 RPS prevents false-positives on traffic-less sites.
 			threshold := d.MeanRPS + (3 * stdDev)
 			if threshold < 10 {
 				threshold = 10
 			}
 
+			// Welford's Algorithm for online mean and variance (α=0.1 EMA approximation)
+			if d.MeanRPS == 0 {
+				d.MeanRPS = currentRPS
+			} else {
+				delta := currentRPS - d.MeanRPS
+				d.MeanRPS += 0.1 * delta
+				// Update variance with EMA logic
+				d.VarianceRPS = (0.9 * d.VarianceRPS) + (0.1 * delta * (currentRPS - d.MeanRPS))
+			}
+
 			if currentRPS > threshold {
 				if !d.underAttack.Load() {
 					logger.Warn("⚠️  STATISTICAL ANOMALY DETECTED (Z-Score) — forcing global challenge mode",
@@ -46,6 +46,31 @@ func TestStatisticalDetector(t *testing.T) {
 	}
 }
 
+func TestStatisticalDetectorScoresSpikeAgainstPriorBaseline(t *testing.T) {
+	d := NewStatisticalAnomalyDetector(1)
+	handler := d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// window closes a one-second window that saw n requests
+	window := func(n int) {
+		d.RequestCount.Store(uint64(n - 1))
+		d.LastReset = time.Now().Add(-time.Second)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	d.MeanRPS = 20 // an established baseline, past the 10 RPS floor
+	for i := 0; i < 3; i++ {
+		window(20)
+	}
+	if d.IsUnderAttack() {
+		t.Fatal("steady traffic flagged as an attack")
+	}
+	// 30 RPS is past 20 + 3σ (σ floored at 1). Folding the spike into the
+	// baseline first would raise the threshold to exactly 30 and miss it.
+	window(30)
+	if !d.IsUnderAttack() {
+		t.Errorf("spike not detected: mean %.2f, variance %.2f", d.MeanRPS, d.VarianceRPS)
+	}
+}
+
 func TestReputationManager(t *testing.T) {
 	m := NewReputationManager(nil)
 	ip := "2.2.2.2"
@@ -62,8 +87,9 @@ func TestReputationManager(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		m.Penalize(ip)
 	}
-	if m.GetTrust(ip) != -4 {
-		t.Errorf("Expected trust -4, got %d", m.GetTrust(ip))
+	want := TrustReward + 5*TrustPenalty
+	if m.GetTrust(ip) != want {
+		t.Errorf("Expected trust %d, got %d", want, m.GetTrust(ip))
 	}
 
 	mult := m.GetMultiplier(ip)
@@ -71,3 +97,15 @@ func TestReputationManager(t *testing.T) {
 		t.Errorf("Expected multiplier < 1.0 for negative trust, got %f", mult)
 	}
 }
+
+func TestReputationManagerNilStore(t *testing.T) {
+	// Callers without a shared store still get working trust tracking
+	a, b := NewReputationManager(nil), NewReputationManager(nil)
+	a.Penalize("3.3.3.3")
+	if got := a.GetTrust("3.3.3.3"); got != TrustPenalty {
+		t.Errorf("trust = %d, want %d", got, TrustPenalty)
+	}
+	if got := b.GetTrust("3.3.3.3"); got != 0 {
+		t.Errorf("managers without a store share scores: got %d", got)
+	}
+}
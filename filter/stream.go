@@ -2,21 +2,41 @@ package filter
 
 import (
 	"bufio"
-	"fmt"
 	"io"
 	"net"
 	"runtime"
-	"strings"
 	"syscall"
 	"time"
 
 	"aegisedge/logger"
 )
 
-// StreamProxy provides L4 protection for non-HTTP protocols.
-// It supports PROXY Protocol v1 so that the real client IP is used
-// for connection limiting when behind a TCP load balancer (HAProxy, AWS NLB).
-func StreamProxy(ln net.Listener, targetAddr string, l4 *L4Filter) {
+// StreamConfig configures a StreamProxy listener.
+type StreamConfig struct {
+	Target string // upstream host:port
+	L4     *L4Filter
+	Slow   *SlowClientDetector // cuts off clients that stop reading; nil disables
+	// TrustProxy reports peers, such as a TCP load balancer, whose PROXY
+	// protocol header (v1 or v2) is believed. Connections from anyone else
+	// are proxied untouched, so a client can't spoof its address; nil
+	// trusts nobody.
+	TrustProxy func(ip string) bool
+	// SendProxy, when 1 or 2, opens each upstream connection with a PROXY
+	// protocol header of that version, so the backend sees the client.
+	SendProxy int
+	// SNI, when set, routes TLS connections by server name instead of to
+	// Target, without terminating TLS.
+	SNI *SNIRouter
+	// Routes, when set, replaces Target: load-balanced upstreams, chosen
+	// by sniffed protocol if it sniffs.
+	Routes *StreamRouter
+	Port   int // listen port, for metrics
+}
+
+// StreamProxy provides L4 protection for non-HTTP protocols. Behind a TCP
+// load balancer (HAProxy, AWS NLB) it reads the PROXY protocol header so
+// the real client IP is used for connection limiting.
+func StreamProxy(ln net.Listener, cfg StreamConfig) {
 	for {
 		clientConn, err := ln.Accept()
 		if err != nil {
@@ -24,24 +44,69 @@ func StreamProxy(ln net.Listener, targetAddr string, l4 *L4Filter) {
 			return
 		}
 
-		go handleStream(clientConn, targetAddr, l4)
+		go handleStream(clientConn, cfg)
 	}
 }
 
-func handleStream(conn net.Conn, targetAddr string, l4 *L4Filter) {
+// proxyHeaderTimeout bounds how long a trusted balancer may take to send
+// its PROXY header.
+const proxyHeaderTimeout = 2 * time.Second
+
+func handleStream(conn net.Conn, cfg StreamConfig) {
 	defer conn.Close()
 
-	// Peek at the first line to detect a PROXY Protocol v1 header.
-	// Use a buffered reader so bytes consumed for detection can be replayed.
+	// Buffered so bytes peeked while looking for a PROXY header are replayed
 	br := bufio.NewReader(conn)
-	realAddr, reader := resolveProxyProtocol(br, conn)
-
-	if !l4.AllowConnection(realAddr) {
-		logger.Warn("L4 stream connection rejected", "addr", realAddr)
+	h, ok := resolveProxyProtocol(br, conn, cfg.TrustProxy, time.Time{})
+	if !ok {
+		return
+	}
+	var reader io.Reader = br
+	realAddr := h.ClientAddr(conn.RemoteAddr()).String()
+
+	l4 := cfg.L4
+	if reason := l4.Admit(realAddr); reason != "" {
+		logger.Warn("L4 stream connection rejected", "addr", realAddr, "reason", reason)
+		if MetricsEnabled() {
+			BlockedRequests.WithLabelValues("L4", reason).Inc()
+		}
 		return
 	}
 	defer l4.ReleaseConnection(realAddr)
 
+	ip := splitL4Host(realAddr)
+	proto := "unsniffed"
+	target, pool := cfg.Target, (*upstreamPool)(nil)
+	if r := cfg.Routes; r != nil {
+		if r.sniff {
+			if proto, ok = r.sniffProtocol(conn, br); !ok {
+				return
+			}
+		}
+		if r.reject[proto] {
+			logger.Warn("Stream connection rejected by protocol", "addr", realAddr, "protocol", proto, "port", cfg.Port)
+			streamOutcome(cfg.Port, proto, "rejected")
+			return
+		}
+		target, pool = "", r.pool(proto)
+	}
+
+	// TLS goes to the SNI router; a port without sniffing only takes TLS
+	if cfg.SNI != nil && (cfg.Routes == nil || !cfg.Routes.sniff || proto == ProtoTLS) {
+		route, replay, ok := cfg.SNI.admit(conn, reader, ip)
+		if !ok {
+			streamOutcome(cfg.Port, proto, "rejected")
+			return
+		}
+		defer route.release(ip)
+		target, pool, reader = route.Backend, nil, replay
+	}
+	if target == "" && pool == nil {
+		logger.Warn("Stream connection rejected, no upstream for protocol", "addr", realAddr, "protocol", proto, "port", cfg.Port)
+		streamOutcome(cfg.Port, proto, "rejected")
+		return
+	}
+
 	dialer := &net.Dialer{
 		Timeout: 5 * time.Second,
 		Control: func(network, address string, c syscall.RawConn) error {
@@ -54,13 +119,41 @@ func handleStream(conn net.Conn, targetAddr string, l4 *L4Filter) {
 		},
 	}
 
-	targetConn, err := dialer.Dial("tcp", targetAddr)
+	var targetConn net.Conn
+	var err error
+	if pool != nil {
+		var u *upstream
+		if targetConn, u, err = pool.dial(dialer, ip); err == nil {
+			target = u.addr
+			u.active.Add(1)
+			defer u.active.Add(-1)
+		} else {
+			target = "all upstreams"
+		}
+	} else {
+		targetConn, err = dialer.Dial("tcp", target)
+	}
 	if err != nil {
-		logger.Error("Stream proxy dial error", "addr", targetAddr, "err", err)
+		logger.Error("Stream proxy dial error", "addr", target, "protocol", proto, "err", err)
+		streamOutcome(cfg.Port, proto, "upstream_error")
 		return
 	}
+	logger.Debug("Stream connection forwarded", "addr", realAddr, "protocol", proto, "upstream", target)
+	streamOutcome(cfg.Port, proto, "forwarded")
 	defer targetConn.Close()
 
+	if cfg.SendProxy != 0 {
+		err := WriteProxyHeader(targetConn, cfg.SendProxy, h.ClientAddr(conn.RemoteAddr()), h.ServerAddr(conn.LocalAddr()))
+		if err != nil {
+			logger.Error("Stream proxy PROXY header write error", "addr", target, "err", err)
+			return
+		}
+	}
+
+	// Writes to the client go through the slow-read detector
+	clientConn, unwatch := cfg.Slow.Watch(conn, splitL4Host(realAddr))
+	defer unwatch()
+
 	// Bidirectional copy — reader may have buffered bytes consumed during peeking.
 	done := make(chan bool, 2)
 	go func() {
@@ -68,38 +161,44 @@ func handleStream(conn net.Conn, targetAddr string, l4 *L4Filter) {
 		done <- true
 	}()
 	go func() {
-		io.Copy(conn, targetConn)
+		io.Copy(clientConn, targetConn)
 		done <- true
 	}()
 	<-done
 }
 
-// resolveProxyProtocol peeks at the connection for a PROXY Protocol v1 header.
-// Format: "PROXY TCP4 <src-ip> <dst-ip> <src-port> <dst-port>\r\n"
-// Returns the resolved address string and an io.Reader that replays all bytes.
-func resolveProxyProtocol(br *bufio.Reader, conn net.Conn) (string, io.Reader) {
-	fallback := conn.RemoteAddr().String()
-
-	// Peek enough bytes to read the first line without blocking indefinitely.
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	defer conn.SetReadDeadline(time.Time{}) // clear deadline after peek
-
-	line, err := br.ReadString('\n')
-	if err != nil || !strings.HasPrefix(line, "PROXY ") {
-		// Not a PROXY protocol header; replay the peeked bytes.
-		return fallback, io.MultiReader(strings.NewReader(line), br)
+// resolveProxyProtocol reads the PROXY header of conn through br when the
+// peer is trusted to send one. It returns nil if there is none, including
+// when a trusted peer stays silent until the deadline, and false only if a
+// trusted peer sent bytes that start a header but don't parse, so the
+// connection must be dropped. The read deadline is put back to restore
+// afterwards.
+func resolveProxyProtocol(br *bufio.Reader, conn net.Conn, trust func(string) bool, restore time.Time) (*ProxyHeader, bool) {
+	peer := conn.RemoteAddr()
+	if trust == nil || !trust(splitL4Host(peer.String())) {
+		return nil, true
 	}
 
-	// Parse: PROXY TCP4 203.0.113.5 10.0.0.1 1234 22
-	parts := strings.Fields(line)
-	if len(parts) < 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
-		return fallback, br
+	deadline := time.Now().Add(proxyHeaderTimeout)
+	if !restore.IsZero() && restore.Before(deadline) {
+		deadline = restore
 	}
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(restore)
 
-	srcIP := parts[2]
-	srcPort := parts[4]
-	realAddr := fmt.Sprintf("%s:%s", srcIP, srcPort)
+	h, err := ReadProxyHeader(br)
+	if err != nil {
+		logger.Warn("PROXY Protocol: invalid header from trusted proxy, dropping connection", "proxy_addr", peer, "err", err)
+		if MetricsEnabled() {
+			BlockedRequests.WithLabelValues("L4", "proxy_protocol").Inc()
+		}
+		return nil, false
+	}
+	if h == nil {
+		return nil, true // trusted, but sent none
+	}
 
-	logger.Info("PROXY Protocol: resolved real client IP", "real_addr", realAddr, "proxy_addr", conn.RemoteAddr())
-	return realAddr, br
+	logger.Info("PROXY Protocol: resolved real client IP", "real_addr", h.ClientAddr(peer), "proxy_addr", peer,
+		"version", h.Version, "local", h.Local, "network", h.Network, "authority", h.Authority, "vpce_id", h.AWSVPCEID)
+	return h, true
 }
@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"aegisedge/logger"
+)
+
+// Stream protocols told apart by a connection's first bytes.
+const (
+	ProtoSSH      = "ssh"
+	ProtoTLS      = "tls"
+	ProtoHTTP     = "http"
+	ProtoRDP      = "rdp"
+	ProtoPostgres = "postgres"
+	// ProtoServerFirst is a client that sent nothing before the sniff
+	// timeout because it waits for the server to speak: MySQL, SMTP, FTP.
+	ProtoServerFirst = "server_first"
+	ProtoUnknown     = "unknown"
+)
+
+var streamProtocols = []string{ProtoSSH, ProtoTLS, ProtoHTTP, ProtoRDP, ProtoPostgres, ProtoServerFirst, ProtoUnknown}
+
+// Stream upstream balancing strategies.
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceSourceHash = "source_hash" // a client IP sticks to one upstream
+)
+
+// StreamRouteConfig says where a tcp_ports listener forwards connections.
+type StreamRouteConfig struct {
+	Upstreams []string `json:"upstreams"` // host:port; several are load balanced
+	Balance   string   `json:"balance"`   // round_robin (default), least_conn or source_hash
+	// Sniff detects each connection's protocol from its first bytes, for
+	// Protocols, Reject and metrics.
+	Sniff          bool                `json:"sniff"`
+	SniffTimeoutMs int                 `json:"sniff_timeout_ms"` // wait for a silent client; default 500
+	Protocols      map[string][]string `json:"protocols"`        // upstreams by protocol, instead of Upstreams
+	Reject         []string            `json:"reject"`           // protocols refused
+}
+
+// StreamRouter picks the upstream of each stream connection.
+type StreamRouter struct {
+	def          *upstreamPool // nil: only Protocols are served
+	protocols    map[string]*upstreamPool
+	reject       map[string]bool
+	sniff        bool
+	sniffTimeout time.Duration
+}
+
+type upstreamPool struct {
+	balance   string
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+type upstream struct {
+	addr      string
+	active    atomic.Int64
+	downUntil atomic.Int64 // unix nanos; set when a dial fails
+}
+
+const (
+	defaultSniffTimeout = 500 * time.Millisecond
+	// upstreamDownFor is how long an upstream that refused a dial is
+	// tried only after the others.
+	upstreamDownFor = 10 * time.Second
+	sniffBytes      = 8
+)
+
+// NewStreamRouter validates cfg's upstreams and protocol names.
+func NewStreamRouter(cfg StreamRouteConfig) (*StreamRouter, error) {
+	switch cfg.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceSourceHash:
+	default:
+		return nil, fmt.Errorf("unknown balance %q, want round_robin, least_conn or source_hash", cfg.Balance)
+	}
+	if !cfg.Sniff && (len(cfg.Protocols) > 0 || len(cfg.Reject) > 0) {
+		return nil, errors.New("protocols and reject need sniff")
+	}
+	s := &StreamRouter{
+		protocols:    make(map[string]*upstreamPool),
+		reject:       make(map[string]bool),
+		sniff:        cfg.Sniff,
+		sniffTimeout: defaultSniffTimeout,
+	}
+	if cfg.SniffTimeoutMs > 0 {
+		s.sniffTimeout = time.Duration(cfg.SniffTimeoutMs) * time.Millisecond
+	}
+
+	var err error
+	if len(cfg.Upstreams) > 0 {
+		if s.def, err = newUpstreamPool(cfg.Balance, cfg.Upstreams); err != nil {
+			return nil, err
+		}
+	}
+	for proto, addrs := range cfg.Protocols {
+		if !slices.Contains(streamProtocols, proto) {
+			return nil, fmt.Errorf("unknown protocol %q", proto)
+		}
+		if s.protocols[proto], err = newUpstreamPool(cfg.Balance, addrs); err != nil {
+			return nil, fmt.Errorf("protocol %s: %v", proto, err)
+		}
+	}
+	for _, proto := range cfg.Reject {
+		if !slices.Contains(streamProtocols, proto) {
+			return nil, fmt.Errorf("unknown protocol %q", proto)
+		}
+		s.reject[proto] = true
+	}
+	if s.def == nil && len(s.protocols) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	return s, nil
+}
+
+func newUpstreamPool(balance string, addrs []string) (*upstreamPool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	p := &upstreamPool{balance: balance}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("bad upstream %q: %v", addr, err)
+		}
+		p.upstreams = append(p.upstreams, &upstream{addr: addr})
+	}
+	return p, nil
+}
+
+// pool returns the upstreams for proto, or nil if none serve it.
+func (s *StreamRouter) pool(proto string) *upstreamPool {
+	if p, ok := s.protocols[proto]; ok {
+		return p
+	}
+	return s.def
+}
+
+// sniffProtocol peeks at the first bytes of conn through br. It returns
+// false if the client hung up without sending anything.
+func (s *StreamRouter) sniffProtocol(conn net.Conn, br *bufio.Reader) (string, bool) {
+	conn.SetReadDeadline(time.Now().Add(s.sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if _, err := br.Peek(1); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return ProtoServerFirst, true
+		}
+		return "", false
+	}
+	b, _ := br.Peek(sniffBytes) // whatever arrived before the deadline
+	return SniffProtocol(b), true
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "), []byte("PRI * "),
+}
+
+// SniffProtocol names the protocol a client's first bytes belong to, or
+// ProtoUnknown. Eight bytes are enough to tell them all apart.
+func SniffProtocol(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return ProtoSSH
+	case len(b) >= 3 && b[0] == 0x16 && b[1] == 0x03 && b[2] <= 0x04: // handshake record
+		return ProtoTLS
+	case len(b) >= 6 && b[0] == 0x03 && b[1] == 0x00 && b[5]&0xF0 == 0xE0: // TPKT + X.224 connection request
+		return ProtoRDP
+	case len(b) >= 8 && isPostgresStartup(b):
+		return ProtoPostgres
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return ProtoHTTP
+		}
+	}
+	return ProtoUnknown
+}
+
+// isPostgresStartup matches a StartupMessage (protocol 3.0) or an SSL,
+// GSS or cancel request: a length, then a well-known code.
+func isPostgresStartup(b []byte) bool {
+	n, code := binary.BigEndian.Uint32(b[0:4]), binary.BigEndian.Uint32(b[4:8])
+	if n < 8 || n > 10000 {
+		return false
+	}
+	switch code {
+	case 196608, 80877102, 80877103, 80877104:
+		return true
+	}
+	return false
+}
+
+// dial connects to the pool's preferred upstream for ip, falling back to
+// the others in turn. Upstreams that recently failed are tried last.
+func (p *upstreamPool) dial(d *net.Dialer, ip string) (net.Conn, *upstream, error) {
+	n := len(p.upstreams)
+	var start int
+	switch p.balance {
+	case BalanceLeastConn:
+		for i, u := range p.upstreams {
+			if u.active.Load() < p.upstreams[start].active.Load() {
+				start = i
+			}
+		}
+	case BalanceSourceHash:
+		h := fnv.New32a()
+		h.Write([]byte(ip))
+		start = int(h.Sum32() % uint32(n))
+	default:
+		start = int((p.next.Add(1) - 1) % uint64(n))
+	}
+
+	now := time.Now().UnixNano()
+	order := make([]*upstream, 0, n)
+	var down []*upstream
+	for i := range n {
+		u := p.upstreams[(start+i)%n]
+		if u.downUntil.Load() > now {
+			down = append(down, u)
+		} else {
+			order = append(order, u)
+		}
+	}
+
+	var err error
+	for _, u := range append(order, down...) {
+		var c net.Conn
+		if c, err = d.Dial("tcp", u.addr); err == nil {
+			u.downUntil.Store(0)
+			return c, u, nil
+		}
+		u.downUntil.Store(time.Now().Add(upstreamDownFor).UnixNano())
+		logger.Warn("Stream upstream unreachable", "addr", u.addr, "err", err)
+	}
+	return nil, nil, err
+}
+
+// streamOutcome counts a stream connection in aegisedge_stream_connections_total.
+func streamOutcome(port int, proto, outcome string) {
+	if MetricsEnabled() {
+		StreamConnections.WithLabelValues(fmt.Sprint(port), proto, outcome).Inc()
+	}
+}
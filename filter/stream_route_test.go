@@ -0,0 +1,168 @@
+package filter
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte("SSH-2.0-OpenSSH_9.6\r\n"), ProtoSSH},
+		{[]byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01}, ProtoTLS},
+		{[]byte("GET / HTTP/1.1\r\n"), ProtoHTTP},
+		{[]byte("OPTIONS * HTTP/1.1"), ProtoHTTP},
+		{[]byte("PRI * HTTP/2.0\r\n"), ProtoHTTP},
+		{[]byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xe0, 0x00, 0x00}, ProtoRDP},
+		{[]byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}, ProtoPostgres}, // SSLRequest
+		{[]byte{0x00, 0x00, 0x00, 0x29, 0x00, 0x03, 0x00, 0x00}, ProtoPostgres}, // StartupMessage 3.0
+		{[]byte{0x16, 0x03}, ProtoUnknown},                                      // too short to tell
+		{[]byte("hello there"), ProtoUnknown},
+		{[]byte("GETX / "), ProtoUnknown},
+	}
+	for _, tt := range tests {
+		if got := SniffProtocol(tt.in); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// greeter is an upstream that writes its name to every connection, as a
+// server-first protocol would.
+func greeter(t *testing.T, name string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, name)
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startStreamRoutes(t *testing.T, cfg StreamRouteConfig) string {
+	t.Helper()
+	router, err := NewStreamRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go StreamProxy(ln, StreamConfig{L4: NewL4Filter(0, nil), Routes: router})
+	return ln.Addr().String()
+}
+
+// greeting connects to addr, sends first (if any) and returns what the
+// upstream said, "" if the connection was refused.
+func greeting(t *testing.T, addr, first string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if first != "" {
+		io.WriteString(c, first)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, _ := c.Read(buf)
+	return string(buf[:n])
+}
+
+func TestStreamRoutesByProtocol(t *testing.T) {
+	addr := startStreamRoutes(t, StreamRouteConfig{
+		Upstreams:      []string{greeter(t, "default")},
+		Sniff:          true,
+		SniffTimeoutMs: 100,
+		Protocols: map[string][]string{
+			ProtoSSH:         {greeter(t, "ssh")},
+			ProtoServerFirst: {greeter(t, "mysql")},
+		},
+		Reject: []string{ProtoRDP},
+	})
+
+	tests := []struct {
+		name, first, want string
+	}{
+		{"ssh", "SSH-2.0-test\r\n", "ssh"},
+		{"silent client", "", "mysql"},
+		{"http", "GET / HTTP/1.1\r\n\r\n", "default"},
+		{"rdp rejected", "\x03\x00\x00\x13\x0e\xe0\x00\x00\x00\x00\x00", ""},
+	}
+	for _, tt := range tests {
+		if got := greeting(t, addr, tt.first); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Without a default pool, protocols no route takes are refused
+	only := startStreamRoutes(t, StreamRouteConfig{Sniff: true, Protocols: map[string][]string{ProtoSSH: {greeter(t, "ssh")}}})
+	if got := greeting(t, only, "GET / HTTP/1.1\r\n\r\n"); got != "" {
+		t.Errorf("unrouted protocol got %q", got)
+	}
+}
+
+func TestStreamRoutesBalance(t *testing.T) {
+	a, b := greeter(t, "a"), greeter(t, "b")
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	rr := startStreamRoutes(t, StreamRouteConfig{Upstreams: []string{a, b}})
+	seen := map[string]int{}
+	for range 4 {
+		seen[greeting(t, rr, "x")]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Errorf("round robin spread %v", seen)
+	}
+
+	// A dead upstream fails over, then is skipped
+	failover := startStreamRoutes(t, StreamRouteConfig{Upstreams: []string{deadAddr, a}})
+	for i := range 3 {
+		if got := greeting(t, failover, "x"); got != "a" {
+			t.Errorf("request %d: got %q, want failover to a", i, got)
+		}
+	}
+
+	// A client sticks to one upstream
+	hashed := startStreamRoutes(t, StreamRouteConfig{Upstreams: []string{a, b}, Balance: BalanceSourceHash})
+	first := greeting(t, hashed, "x")
+	for range 3 {
+		if got := greeting(t, hashed, "x"); got != first {
+			t.Errorf("source_hash moved the client from %q to %q", first, got)
+		}
+	}
+
+	for _, bad := range []StreamRouteConfig{
+		{},
+		{Upstreams: []string{"nowhere"}},
+		{Upstreams: []string{a}, Balance: "random"},
+		{Upstreams: []string{a}, Reject: []string{ProtoSSH}}, // needs sniff
+		{Upstreams: []string{a}, Sniff: true, Protocols: map[string][]string{"gopher": {a}}},
+	} {
+		if _, err := NewStreamRouter(bad); err == nil {
+			t.Errorf("%+v: expected an error", bad)
+		}
+	}
+}
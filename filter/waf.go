@@ -1,97 +1,381 @@
 package filter
 
 import (
-	"bytes"
-	"io"
+	"fmt"
 	"net/http"
-	"regexp"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"aegisedge/logger"
+	"aegisedge/util"
 )
 
-var (
-	// Expanded SQLi: looking for tautologies, comments, and dangerous keywords
-	sqliRegex = regexp.MustCompile(`(?i)(union.*select|insert.*into|drop.*table|delete.*from|update.*set|' or '1'='1|--|/\*|;.*--|exec\(|sp_executesql|information_schema|sysdatabases|waitfor delay)`)
-	
-	// Expanded XSS: looking for event handlers, javascript pseudo-protocol, and script tags
-	xssRegex = regexp.MustCompile(`(?i)(<script|alert\(|onerror=|onload=|onmouseover=|javascript:|eval\(|unescape\(|String\.fromCharCode|<iframe|document\.(cookie|location)|window\.(location|open)|src=.*javascript:)`)
-	
-	// Command Injection: looking for shell operators and dangerous commands
-	cmdInjRegex = regexp.MustCompile(`(?i)(;|\||&&|>|<|\x60|\$\(.*\)|python|perl|bash|sh|cmd|powershell|curl|wget|nc -e|/bin/sh|/bin/bash)`)
-	
-	// Path Traversal and Sensitive File Access
-	traversal = regexp.MustCompile(`(?i)(\.\./|\.\.\\|/etc/passwd|/windows/system32|boot\.ini|windows/win\.ini|/var/www/html/.*\.env)`)
+// WAF evaluation modes.
+const (
+	// WAFModeImmediate blocks on the first matching rule.
+	WAFModeImmediate = "immediate"
+	// WAFModeAnomaly sums the weight of every matching rule and blocks only
+	// once the total reaches the inbound threshold (OWASP CRS style).
+	WAFModeAnomaly = "anomaly"
 )
 
-func WAFMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// 1. Scan Query Parameters and Path
-		query := r.URL.RawQuery
-		path := r.URL.Path
-
-		// 2. Scan Body (POST/PUT only, capped at 4KB to prevent memory exhaustion)
-		var bodySample string
-		if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
-			buf := make([]byte, 4096)
-			n, _ := io.ReadFull(r.Body, buf)
-			if n > 0 {
-				bodySample = string(buf[:n])
-				// Restore body so proxy can still read it
-				r.Body = struct {
-					io.Reader
-					io.Closer
-				}{
-					Reader: io.MultiReader(bytes.NewReader(buf[:n]), r.Body),
-					Closer: r.Body,
-				}
-			}
-		}
+// DefaultInboundThreshold blocks on a single critical match in anomaly mode.
+const DefaultInboundThreshold = 5
+
+// WAF evaluates requests against a declarative rule set. Rules live behind an
+// atomic.Value so a reload swaps the whole set without locking the hot path.
+type WAF struct {
+	path      string
+	rules     atomic.Value // stores []*WAFRule
+	excl      atomic.Value // stores []*WAFExclusion
+	anomaly   atomic.Bool  // true = anomaly scoring, false = immediate
+	detect    atomic.Bool  // true = log verdicts but never block
+	paranoia  atomic.Int32
+	threshold atomic.Int32
+	limits    atomic.Value // stores WAFLimits
+	modTime   time.Time
+	mu        sync.Mutex // guards Reload() and modTime
+	stop      chan struct{}
+}
+
+// wafVar is a single value extracted from the request for inspection.
+type wafVar struct {
+	target string
+	name   string
+	value  string
+}
+
+// wafMatch records a rule that fired, the value it fired on and that
+// value after the rule's transformations.
+type wafMatch struct {
+	rule    *WAFRule
+	v       *wafVar
+	matched string
+}
+
+// wafVerdict is the outcome of evaluating one request. Matches of
+// detect-only rules are kept apart so they never influence the block.
+type wafVerdict struct {
+	matches  []wafMatch
+	detected []wafMatch
+	score    int
+	blocked  bool
+}
+
+// NewWAF loads rules from rulesPath and re-checks the file for changes on the
+// given interval. An empty path, or a file that fails to load, leaves the
+// built-in rule set active. Pass interval=0 to disable background reloads.
+func NewWAF(rulesPath string, interval time.Duration) *WAF {
+	w := &WAF{
+		path: rulesPath,
+		stop: make(chan struct{}),
+	}
+	w.rules.Store(DefaultWAFRules())
+	w.excl.Store([]*WAFExclusion(nil))
+	w.paranoia.Store(1)
+	w.threshold.Store(DefaultInboundThreshold)
+	w.limits.Store(DefaultWAFLimits())
+
+	if rulesPath == "" {
+		return w
+	}
+	if err := w.Reload(); err != nil {
+		logger.Warn("WAF rules file could not be loaded, using built-in rules", "path", rulesPath, "err", err)
+	}
+	if interval > 0 {
+		go w.loop(interval)
+	}
+	return w
+}
+
+// Rules returns the currently active rule set.
+func (w *WAF) Rules() []*WAFRule {
+	rules, _ := w.rules.Load().([]*WAFRule)
+	return rules
+}
+
+// Exclusions returns the currently active exclusion policies.
+func (w *WAF) Exclusions() []*WAFExclusion {
+	excl, _ := w.excl.Load().([]*WAFExclusion)
+	return excl
+}
+
+// SetMode switches between immediate and anomaly scoring evaluation.
+func (w *WAF) SetMode(mode string) error {
+	switch mode {
+	case WAFModeImmediate, "":
+		w.anomaly.Store(false)
+	case WAFModeAnomaly:
+		w.anomaly.Store(true)
+	default:
+		return fmt.Errorf("unknown WAF mode %q", mode)
+	}
+	return nil
+}
+
+// Mode returns the active evaluation mode.
+func (w *WAF) Mode() string {
+	if w.anomaly.Load() {
+		return WAFModeAnomaly
+	}
+	return WAFModeImmediate
+}
+
+// SetDetectOnly switches the whole engine to log-only: verdicts are logged
+// and counted as usual but requests are never blocked.
+func (w *WAF) SetDetectOnly(enabled bool) {
+	w.detect.Store(enabled)
+}
+
+// DetectOnly reports whether the engine is in log-only mode.
+func (w *WAF) DetectOnly() bool {
+	return w.detect.Load()
+}
+
+// SetParanoiaLevel activates every rule at or below level (clamped to 1..4).
+func (w *WAF) SetParanoiaLevel(level int) {
+	if level < 1 {
+		level = 1
+	}
+	if level > MaxParanoiaLevel {
+		level = MaxParanoiaLevel
+	}
+	w.paranoia.Store(int32(level))
+}
+
+// ParanoiaLevel returns the active paranoia level.
+func (w *WAF) ParanoiaLevel() int {
+	return int(w.paranoia.Load())
+}
+
+// SetInboundThreshold sets the anomaly score at which a request is blocked.
+func (w *WAF) SetInboundThreshold(threshold int) {
+	if threshold <= 0 {
+		threshold = DefaultInboundThreshold
+	}
+	w.threshold.Store(int32(threshold))
+}
+
+// InboundThreshold returns the active anomaly score threshold.
+func (w *WAF) InboundThreshold() int {
+	return int(w.threshold.Load())
+}
+
+// SetLimits sets the body size, JSON depth and field count limits. Zero
+// values keep the defaults.
+func (w *WAF) SetLimits(limits WAFLimits) {
+	w.limits.Store(limits.withDefaults())
+}
+
+// Limits returns the active parsing limits.
+func (w *WAF) Limits() WAFLimits {
+	limits, _ := w.limits.Load().(WAFLimits)
+	return limits
+}
+
+// Reload re-reads the rules file. On error the previous rule set stays active.
+func (w *WAF) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	rules, exclusions, err := parseWAFRulesFile(data)
+	if err != nil {
+		return err
+	}
+	w.excl.Store(exclusions)
+	w.rules.Store(rules)
+	w.modTime = info.ModTime()
+	logger.Info("WAF rules loaded", "path", w.path, "rules", len(rules), "exclusions", len(exclusions))
+	return nil
+}
 
-		// Combined check
-		payloads := []string{query, path, bodySample}
+// Stop cancels the background reload goroutine.
+func (w *WAF) Stop() {
+	close(w.stop)
+}
 
-		for _, p := range payloads {
-			if p == "" {
+func (w *WAF) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(w.path)
+			if err != nil {
 				continue
 			}
-
-			if sqliRegex.MatchString(p) {
-				logger.Warn("Blocked SQLi attempt", "remote_addr", r.RemoteAddr, "payload", p)
-				if MetricsEnabled() {
-					BlockedRequests.WithLabelValues("L7", "sqli").Inc()
+			w.mu.Lock()
+			changed := !info.ModTime().Equal(w.modTime)
+			w.mu.Unlock()
+			if changed {
+				if err := w.Reload(); err != nil {
+					logger.Error("WAF rules reload failed, keeping previous rules", "path", w.path, "err", err)
 				}
-				http.Error(w, "Malicious request detected", http.StatusBadRequest)
-				return
 			}
+		case <-w.stop:
+			return
+		}
+	}
+}
 
-			if xssRegex.MatchString(p) {
-				logger.Warn("Blocked XSS attempt", "remote_addr", r.RemoteAddr, "payload", p)
-				if MetricsEnabled() {
-					BlockedRequests.WithLabelValues("L7", "xss").Inc()
-				}
-				http.Error(w, "Malicious request detected", http.StatusBadRequest)
-				return
-			}
+// WAFMiddleware inspects requests against the built-in rule set.
+// Use NewWAF to load (and hot-reload) rules from a file instead.
+func WAFMiddleware(next http.Handler) http.Handler {
+	return NewWAF("", 0).Middleware(next)
+}
 
-			if cmdInjRegex.MatchString(p) {
-				logger.Warn("Blocked Command Injection attempt", "remote_addr", r.RemoteAddr, "payload", p)
-				if MetricsEnabled() {
-					BlockedRequests.WithLabelValues("L7", "cmd_injection").Inc()
-				}
-				http.Error(w, "Malicious request detected", http.StatusBadRequest)
-				return
+func (w *WAF) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		verdict := w.evaluate(collectWAFVars(r, w.Limits()), matchingExclusions(w.Exclusions(), r))
+
+		for _, m := range verdict.detected {
+			logger.Warn("WAF detect-only rule matched", wafMatchFields(r, m)...)
+			w.countDetectOnly(m)
+		}
+
+		if !verdict.blocked {
+			if len(verdict.matches) > 0 {
+				logger.Info("WAF rules matched below anomaly threshold",
+					"rule_ids", matchedRuleIDs(verdict.matches),
+					"score", verdict.score,
+					"threshold", w.InboundThreshold(),
+					"remote_addr", util.GetRealIP(r),
+				)
 			}
+			next.ServeHTTP(rw, r)
+			return
+		}
 
-			if traversal.MatchString(p) {
-				logger.Warn("Blocked path traversal attempt", "remote_addr", r.RemoteAddr, "payload", p)
-				if MetricsEnabled() {
-					BlockedRequests.WithLabelValues("L7", "traversal").Inc()
-				}
-				http.Error(w, "Malicious request detected", http.StatusBadRequest)
-				return
+		// The first match is the heaviest one; it names the block.
+		top := verdict.matches[0]
+		fields := append(wafMatchFields(r, top),
+			"rule_ids", matchedRuleIDs(verdict.matches),
+			"score", verdict.score,
+			"mode", w.Mode(),
+		)
+
+		if w.DetectOnly() {
+			logger.Warn("WAF detect-only: request would have been blocked", fields...)
+			for _, m := range verdict.matches {
+				w.countDetectOnly(m)
 			}
+			next.ServeHTTP(rw, r)
+			return
 		}
 
-		next.ServeHTTP(w, r)
+		logger.Warn("WAF blocked request", fields...)
+		if MetricsEnabled() {
+			BlockedRequests.WithLabelValues("L7", "waf:"+top.rule.ID).Inc()
+		}
+		http.Error(rw, "Malicious request detected", http.StatusBadRequest)
 	})
 }
+
+func (w *WAF) countDetectOnly(m wafMatch) {
+	if MetricsEnabled() {
+		WAFDetectOnlyMatches.WithLabelValues(m.rule.ID).Inc()
+	}
+}
+
+// wafMatchFields is the log context identifying a match.
+func wafMatchFields(r *http.Request, m wafMatch) []any {
+	return []any{
+		"rule_id", m.rule.ID,
+		"severity", m.rule.Severity,
+		"tags", m.rule.Tags,
+		"target", m.v.target,
+		"name", m.v.name,
+		"method", r.Method,
+		"host", r.Host,
+		"path", r.URL.Path,
+		"remote_addr", util.GetRealIP(r),
+		"asn", util.GetASN(r),
+		"payload", m.v.value,
+		"matched_value", m.matched,
+	}
+}
+
+// evaluate runs every rule active at the current paranoia level. In
+// immediate mode it stops at the first blocking match; in anomaly mode each
+// matching rule adds its weight once and the request is blocked when the
+// total reaches the inbound threshold. A matching "allow" rule ends
+// inspection and lets the request through. Detect-only rules are recorded
+// but never score or block. Rules removed by an exclusion are skipped for
+// the values the exclusion covers.
+func (w *WAF) evaluate(vars []wafVar, exclusions []*WAFExclusion) wafVerdict {
+	var verdict wafVerdict
+	paranoia := w.ParanoiaLevel()
+	anomaly := w.anomaly.Load()
+
+	// Transformed values are computed lazily, once per distinct chain, and
+	// shared by every rule that asks for the same chain.
+	transformed := make(map[string][]*string)
+
+	for _, rule := range w.Rules() {
+		if rule.Paranoia > paranoia {
+			continue
+		}
+		values := transformed[rule.transformKey]
+		if values == nil {
+			values = make([]*string, len(vars))
+			transformed[rule.transformKey] = values
+		}
+		for i := range vars {
+			v := &vars[i]
+			if v.value == "" || !rule.AppliesTo(v.target, v.name) {
+				continue
+			}
+			if len(exclusions) > 0 && excluded(exclusions, rule, v) {
+				continue
+			}
+			if values[i] == nil {
+				t := applyTransforms(rule.transforms, v.value)
+				values[i] = &t
+			}
+			if !rule.Match(*values[i]) {
+				continue
+			}
+			if rule.Action == "allow" {
+				return wafVerdict{}
+			}
+			if rule.DetectOnly {
+				verdict.detected = append(verdict.detected, wafMatch{rule: rule, v: v, matched: *values[i]})
+				break
+			}
+			verdict.matches = append(verdict.matches, wafMatch{rule: rule, v: v, matched: *values[i]})
+			verdict.score += rule.Weight()
+			break // a rule scores at most once per request
+		}
+		if !anomaly && len(verdict.matches) > 0 {
+			verdict.blocked = true
+			return verdict
+		}
+	}
+
+	if anomaly && len(verdict.matches) > 0 {
+		sort.SliceStable(verdict.matches, func(i, j int) bool {
+			return verdict.matches[i].rule.Weight() > verdict.matches[j].rule.Weight()
+		})
+		verdict.blocked = verdict.score >= w.InboundThreshold()
+	}
+	return verdict
+}
+
+func matchedRuleIDs(matches []wafMatch) []string {
+	ids := make([]string, len(matches))
+	for i, m := range matches {
+		ids[i] = m.rule.ID
+	}
+	return ids
+}
@@ -0,0 +1,279 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"aegisedge/util"
+)
+
+// WAFLimits bounds how much of a request the WAF parses. Anything beyond a
+// limit is still inspected, but only as one raw value.
+type WAFLimits struct {
+	MaxBodyBytes int // bytes of body buffered for inspection
+	MaxDepth     int // JSON nesting depth walked
+	MaxFields    int // values extracted per source (query args, body fields)
+}
+
+// DefaultWAFLimits returns the limits used when none are configured.
+func DefaultWAFLimits() WAFLimits {
+	return WAFLimits{
+		MaxBodyBytes: 64 * 1024,
+		MaxDepth:     32,
+		MaxFields:    256,
+	}
+}
+
+// withDefaults fills unset limits from DefaultWAFLimits.
+func (l WAFLimits) withDefaults() WAFLimits {
+	d := DefaultWAFLimits()
+	if l.MaxBodyBytes <= 0 {
+		l.MaxBodyBytes = d.MaxBodyBytes
+	}
+	if l.MaxDepth <= 0 {
+		l.MaxDepth = d.MaxDepth
+	}
+	if l.MaxFields <= 0 {
+		l.MaxFields = d.MaxFields
+	}
+	return l
+}
+
+// wafInternalHeaders are set by earlier layers, replacing any copy the
+// client sent, so they carry nothing of the client's to inspect. Other
+// X-Aegis-* headers are client input like any header.
+var wafInternalHeaders = map[string]bool{
+	"X-Aegis-Real-Ip":  true,
+	"X-Aegis-Port":     true,
+	util.CountryHeader: true,
+	util.ASNHeader:     true,
+}
+
+// wafCollector accumulates inspection values for one request.
+type wafCollector struct {
+	vars   []wafVar
+	limits WAFLimits
+}
+
+// collectWAFVars extracts every inspectable value from the request: the
+// path, each query argument, each body field (parsed according to the
+// Content-Type), each header and each cookie.
+func collectWAFVars(r *http.Request, limits WAFLimits) []wafVar {
+	c := &wafCollector{limits: limits}
+	c.add(TargetPath, "", r.URL.Path)
+	c.addQuery(r.URL.RawQuery)
+
+	if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
+		c.addBody(r)
+	}
+
+	for name, values := range r.Header {
+		// Cookies are inspected individually below
+		if name == "Cookie" || wafInternalHeaders[name] {
+			continue
+		}
+		for _, val := range values {
+			c.add(TargetHeader, name, val)
+		}
+	}
+
+	for _, ck := range r.Cookies() {
+		c.add(TargetCookie, ck.Name, ck.Value)
+	}
+
+	return c.vars
+}
+
+func (c *wafCollector) add(target, name, value string) {
+	c.vars = append(c.vars, wafVar{target: target, name: name, value: value})
+}
+
+// addQuery adds each query argument value separately. A query string that
+// cannot be parsed, or has more arguments than allowed, is inspected raw.
+func (c *wafCollector) addQuery(raw string) {
+	if raw == "" {
+		return
+	}
+	args, err := url.ParseQuery(raw)
+	if err != nil || !c.addArgs(TargetQuery, args) {
+		c.add(TargetQuery, "", raw)
+	}
+}
+
+// addArgs adds form-style arguments in a stable order, each argument name
+// followed by its values. It returns false if the field limit was hit
+// before everything was added.
+func (c *wafCollector) addArgs(target string, args url.Values) bool {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	count := 0
+	for _, name := range names {
+		if !c.addField(target, name, name, &count) {
+			return false
+		}
+		for _, val := range args[name] {
+			if !c.addField(target, name, val, &count) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addBody buffers up to MaxBodyBytes of the body, restores it for the
+// upstream, and extracts fields according to the Content-Type.
+func (c *wafCollector) addBody(r *http.Request) {
+	if r.Body == nil {
+		return
+	}
+	// Read one byte past the limit to tell a body that fits exactly from one
+	// that was cut short. ReadAll grows the buffer with the body, so small
+	// requests don't pay for the whole limit.
+	buf, _ := io.ReadAll(io.LimitReader(r.Body, int64(c.limits.MaxBodyBytes)+1))
+	n := len(buf)
+	if n == 0 {
+		return
+	}
+
+	// Restore body so proxy can still read it
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(buf[:n]), r.Body),
+		Closer: r.Body,
+	}
+
+	// Structured parsing of a truncated body would fail or miss the tail, so
+	// an oversized body is inspected as a raw prefix instead.
+	complete := n <= c.limits.MaxBodyBytes
+	body := buf[:min(n, c.limits.MaxBodyBytes)]
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	parsed := false
+	if complete {
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			parsed = c.addJSON(body)
+		case mediaType == "application/x-www-form-urlencoded":
+			if args, err := url.ParseQuery(string(body)); err == nil {
+				parsed = c.addArgs(TargetBody, args)
+			}
+		case mediaType == "multipart/form-data" && params["boundary"] != "":
+			parsed = c.addMultipart(body, params["boundary"])
+		}
+	}
+
+	if !parsed {
+		c.add(TargetBody, "", string(body))
+	}
+}
+
+// addJSON adds every leaf value of a JSON document, named by its path
+// (user.tags[1]). Object keys are inspected too, since they are just as
+// attacker-controlled. It returns false if the document is invalid or a
+// depth/field limit was exceeded.
+func (c *wafCollector) addJSON(body []byte) bool {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return false
+	}
+	count := 0
+	return c.walkJSON("", doc, 0, &count)
+}
+
+func (c *wafCollector) walkJSON(path string, v any, depth int, count *int) bool {
+	if depth > c.limits.MaxDepth {
+		return false
+	}
+	switch val := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			if !c.addField(TargetBody, child, k, count) || !c.walkJSON(child, val[k], depth+1, count) {
+				return false
+			}
+		}
+	case []any:
+		for i, item := range val {
+			if !c.walkJSON(path+"["+strconv.Itoa(i)+"]", item, depth+1, count) {
+				return false
+			}
+		}
+	case string:
+		return c.addField(TargetBody, path, val, count)
+	case json.Number:
+		return c.addField(TargetBody, path, val.String(), count)
+	case bool:
+		return c.addField(TargetBody, path, strconv.FormatBool(val), count)
+	}
+	return true
+}
+
+// addField adds one structured value, counting it against MaxFields.
+func (c *wafCollector) addField(target, name, value string, count *int) bool {
+	if *count >= c.limits.MaxFields {
+		return false
+	}
+	*count++
+	c.add(target, name, value)
+	return true
+}
+
+// addMultipart adds each form field value and each uploaded file name.
+// File contents are not inspected. It returns false if the payload is
+// malformed or the field limit was exceeded.
+func (c *wafCollector) addMultipart(body []byte, boundary string) bool {
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	count := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+
+		// Read the raw filename: part.FileName() strips directories and would
+		// hide traversal attempts like ../../etc/cron.d/x.
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		name := params["name"]
+		if filename, isFile := params["filename"]; isFile {
+			if !c.addField(TargetFilename, name, filename, &count) {
+				return false
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return false
+		}
+		if !c.addField(TargetBody, name, string(value), &count) {
+			return false
+		}
+	}
+}
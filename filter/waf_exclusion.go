@@ -0,0 +1,106 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// WAFExclusion switches rules off for the requests it matches, like the CRS
+// ctl:ruleRemoveById / ctl:ruleRemoveTargetById actions. A CMS that posts
+// HTML from its admin pages can drop the XSS rules for one field there
+// instead of disabling the whole WAF.
+//
+// Host, PathPrefix and Methods select requests; an empty field matches
+// anything. RuleIDs and Tags select the rules to remove. Targets narrows the
+// removal to specific values (body:content, header:Referer); without it the
+// rules are removed for the whole request.
+type WAFExclusion struct {
+	Host       string   `json:"host,omitempty"` // exact, or *.example.com for any subdomain
+	PathPrefix string   `json:"path_prefix,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	RuleIDs    []string `json:"rule_ids,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Targets    []string `json:"targets,omitempty"`
+
+	methods map[string]bool
+	ruleIDs map[string]bool
+	tags    map[string]bool
+	targets map[string]bool
+}
+
+// compile validates the exclusion and prepares it for matching.
+func (e *WAFExclusion) compile() error {
+	if len(e.RuleIDs) == 0 && len(e.Tags) == 0 {
+		return fmt.Errorf("no rule_ids or tags to remove")
+	}
+	e.Host = strings.ToLower(e.Host)
+
+	e.methods = make(map[string]bool, len(e.Methods))
+	for _, m := range e.Methods {
+		e.methods[strings.ToUpper(m)] = true
+	}
+	e.ruleIDs = make(map[string]bool, len(e.RuleIDs))
+	for _, id := range e.RuleIDs {
+		e.ruleIDs[id] = true
+	}
+	e.tags = make(map[string]bool, len(e.Tags))
+	for _, tag := range e.Tags {
+		e.tags[tag] = true
+	}
+
+	targets, err := compileTargets(e.Targets)
+	if err != nil {
+		return err
+	}
+	e.targets = targets
+	return nil
+}
+
+// MatchesRequest reports whether the exclusion applies to r.
+func (e *WAFExclusion) MatchesRequest(r *http.Request) bool {
+	if len(e.methods) > 0 && !e.methods[r.Method] {
+		return false
+	}
+	if e.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, e.PathPrefix) {
+		return false
+	}
+	return hostMatches(e.Host, r)
+}
+
+// removes reports whether the exclusion switches rule off for value v.
+func (e *WAFExclusion) removes(rule *WAFRule, v *wafVar) bool {
+	if !e.ruleIDs[rule.ID] && !e.hasTag(rule) {
+		return false
+	}
+	return len(e.targets) == 0 || selectsTarget(e.targets, v.target, v.name)
+}
+
+func (e *WAFExclusion) hasTag(rule *WAFRule) bool {
+	for _, tag := range rule.Tags {
+		if e.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingExclusions returns the exclusions that apply to r.
+func matchingExclusions(exclusions []*WAFExclusion, r *http.Request) []*WAFExclusion {
+	var matched []*WAFExclusion
+	for _, e := range exclusions {
+		if e.MatchesRequest(r) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+func excluded(exclusions []*WAFExclusion, rule *WAFRule, v *wafVar) bool {
+	for _, e := range exclusions {
+		if e.removes(rule, v) {
+			return true
+		}
+	}
+	return false
+}
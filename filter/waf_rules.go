@@ -0,0 +1,377 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Inspection targets a WAF rule can be bound to.
+const (
+	TargetPath   = "path"
+	TargetQuery  = "query"
+	TargetBody   = "body"
+	TargetHeader = "header"
+	TargetCookie = "cookie"
+
+	// TargetFilename is the client-supplied file name of a multipart upload.
+	TargetFilename = "filename"
+)
+
+// MaxParanoiaLevel is the strictest paranoia level a rule can belong to.
+const MaxParanoiaLevel = 4
+
+// severityWeights maps rule severity to its anomaly score contribution
+// (same scale as the OWASP Core Rule Set).
+var severityWeights = map[string]int{
+	"critical": 5,
+	"error":    4,
+	"warning":  3,
+	"notice":   2,
+}
+
+var validTargets = map[string]bool{
+	TargetPath:     true,
+	TargetQuery:    true,
+	TargetBody:     true,
+	TargetHeader:   true,
+	TargetCookie:   true,
+	TargetFilename: true,
+}
+
+// WAFRule is a single declarative inspection rule. Rules are loaded from a
+// JSON rules file so false positives can be fixed without a rebuild.
+type WAFRule struct {
+	ID string `json:"id"`
+
+	// Targets selects what the rule inspects: a whole target (query) or a
+	// single named value within it (header:User-Agent, cookie:session,
+	// body:user.email). Names are matched case-insensitively.
+	Targets  []string `json:"targets"`
+	Operator string   `json:"operator"`          // regex (default), contains, equals, prefix, suffix, detect_sqli, detect_xss
+	Pattern  string   `json:"pattern,omitempty"` // unused by detect_sqli and detect_xss
+	Severity string   `json:"severity"`          // critical, error, warning, notice
+	Action   string   `json:"action"`            // block (default) or allow
+	Tags     []string `json:"tags"`
+	Paranoia int      `json:"paranoia_level"` // 1 (default) to 4; higher levels are stricter and noisier
+
+	// DetectOnly logs and counts matches without blocking or adding to the
+	// anomaly score, so a new rule can be measured before it is enforced.
+	DetectOnly bool `json:"detect_only,omitempty"`
+
+	// Transforms normalize each value before matching, in order:
+	// url_decode, html_entity_decode, js_decode, lowercase,
+	// compress_whitespace, remove_comments, normalize_path.
+	Transforms []string `json:"transforms,omitempty"`
+
+	re           *regexp.Regexp
+	targets      map[string]bool
+	transforms   []wafTransform
+	transformKey string // identifies the chain so results can be shared between rules
+}
+
+// wafRulesFile is the on-disk layout of a rules file.
+type wafRulesFile struct {
+	Rules      []*WAFRule      `json:"rules"`
+	Exclusions []*WAFExclusion `json:"exclusions,omitempty"`
+}
+
+// compile validates the rule and prepares it for matching.
+func (r *WAFRule) compile() error {
+	if r.ID == "" {
+		return fmt.Errorf("rule is missing an id")
+	}
+	if r.Pattern == "" && r.Operator != "detect_sqli" && r.Operator != "detect_xss" {
+		return fmt.Errorf("rule %s: empty pattern", r.ID)
+	}
+	if len(r.Targets) == 0 {
+		return fmt.Errorf("rule %s: no targets", r.ID)
+	}
+
+	targets, err := compileTargets(r.Targets)
+	if err != nil {
+		return fmt.Errorf("rule %s: %v", r.ID, err)
+	}
+	r.targets = targets
+
+	switch r.Operator {
+	case "", "regex":
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %s: %v", r.ID, err)
+		}
+		r.Operator = "regex"
+		r.re = re
+	case "contains", "equals", "prefix", "suffix", "detect_sqli", "detect_xss":
+	default:
+		return fmt.Errorf("rule %s: unknown operator %q", r.ID, r.Operator)
+	}
+
+	chain, err := compileTransforms(r.Transforms)
+	if err != nil {
+		return fmt.Errorf("rule %s: %v", r.ID, err)
+	}
+	r.transforms = chain
+	r.transformKey = strings.Join(r.Transforms, ",")
+
+	switch r.Action {
+	case "":
+		r.Action = "block"
+	case "block", "allow":
+	default:
+		return fmt.Errorf("rule %s: unknown action %q", r.ID, r.Action)
+	}
+
+	if r.Severity == "" {
+		r.Severity = "critical"
+	}
+	if _, ok := severityWeights[r.Severity]; !ok {
+		return fmt.Errorf("rule %s: unknown severity %q", r.ID, r.Severity)
+	}
+
+	if r.Paranoia == 0 {
+		r.Paranoia = 1
+	}
+	if r.Paranoia < 1 || r.Paranoia > MaxParanoiaLevel {
+		return fmt.Errorf("rule %s: paranoia_level must be between 1 and %d", r.ID, MaxParanoiaLevel)
+	}
+	return nil
+}
+
+// Weight is the anomaly score a match of this rule contributes.
+func (r *WAFRule) Weight() int {
+	return severityWeights[r.Severity]
+}
+
+// AppliesTo reports whether the rule inspects the named value of the given
+// target, either because it selects the whole target or that name.
+func (r *WAFRule) AppliesTo(target, name string) bool {
+	return selectsTarget(r.targets, target, name)
+}
+
+// compileTargets validates target selectors ("query", "header:User-Agent")
+// and indexes them for selectsTarget.
+func compileTargets(selectors []string) (map[string]bool, error) {
+	targets := make(map[string]bool, len(selectors))
+	for _, t := range selectors {
+		target, name, named := strings.Cut(t, ":")
+		if !validTargets[target] {
+			return nil, fmt.Errorf("unknown target %q", t)
+		}
+		if named {
+			if name == "" || target == TargetPath {
+				return nil, fmt.Errorf("invalid target selector %q", t)
+			}
+			t = target + ":" + strings.ToLower(name)
+		}
+		targets[t] = true
+	}
+	return targets, nil
+}
+
+func selectsTarget(targets map[string]bool, target, name string) bool {
+	if targets[target] {
+		return true
+	}
+	return name != "" && targets[target+":"+strings.ToLower(name)]
+}
+
+// Match runs the rule operator against a single value.
+func (r *WAFRule) Match(value string) bool {
+	switch r.Operator {
+	case "regex":
+		return r.re.MatchString(value)
+	case "contains":
+		return strings.Contains(value, r.Pattern)
+	case "equals":
+		return value == r.Pattern
+	case "prefix":
+		return strings.HasPrefix(value, r.Pattern)
+	case "suffix":
+		return strings.HasSuffix(value, r.Pattern)
+	case "detect_sqli":
+		return DetectSQLi(value)
+	case "detect_xss":
+		return DetectXSS(value)
+	}
+	return false
+}
+
+// ParseWAFRules decodes and compiles a rules document. Duplicate IDs are
+// rejected so every block can be traced back to exactly one rule.
+func ParseWAFRules(data []byte) ([]*WAFRule, error) {
+	rules, _, err := parseWAFRulesFile(data)
+	return rules, err
+}
+
+// parseWAFRulesFile decodes and compiles both the rules and the exclusions
+// of a rules document.
+func parseWAFRulesFile(data []byte) ([]*WAFRule, []*WAFExclusion, error) {
+	var doc wafRulesFile
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("invalid rules document: %v", err)
+	}
+
+	seen := make(map[string]bool, len(doc.Rules))
+	for _, r := range doc.Rules {
+		if err := r.compile(); err != nil {
+			return nil, nil, err
+		}
+		if seen[r.ID] {
+			return nil, nil, fmt.Errorf("duplicate rule id %s", r.ID)
+		}
+		seen[r.ID] = true
+	}
+	for i, e := range doc.Exclusions {
+		if err := e.compile(); err != nil {
+			return nil, nil, fmt.Errorf("exclusion %d: %v", i, err)
+		}
+	}
+	return doc.Rules, doc.Exclusions, nil
+}
+
+// LoadWAFRules reads and compiles the rules file at path.
+func LoadWAFRules(path string) ([]*WAFRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWAFRules(data)
+}
+
+// DefaultWAFRules returns the built-in rule set used when no rules file is
+// configured or the configured file cannot be loaded.
+func DefaultWAFRules() []*WAFRule {
+	rules := []*WAFRule{
+		{
+			// SQL injection by token fingerprint; catches obfuscation the
+			// regexes below miss without tripping on prose
+			ID:         "942101",
+			Targets:    []string{TargetQuery, TargetBody, TargetCookie},
+			Operator:   "detect_sqli",
+			Severity:   "critical",
+			Tags:       []string{"attack-sqli"},
+			Transforms: []string{"url_decode"},
+		},
+		{
+			// XSS by parsing the value as HTML
+			ID:         "941101",
+			Targets:    []string{TargetQuery, TargetBody, TargetCookie},
+			Operator:   "detect_xss",
+			Severity:   "critical",
+			Tags:       []string{"attack-xss"},
+			Transforms: []string{"url_decode"},
+		},
+		{
+			// Dangerous SQL keywords and catalog access
+			ID:         "942100",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody},
+			Pattern:    `(union.*select|insert.*into|drop.*table|delete.*from|exec\s*\(|sp_executesql|xp_cmdshell|information_schema|sysdatabases|waitfor\s+delay)`,
+			Severity:   "critical",
+			Tags:       []string{"attack-sqli"},
+			Transforms: []string{"url_decode", "html_entity_decode", "remove_comments", "compress_whitespace", "lowercase"},
+		},
+		{
+			// Quoted tautologies: ' or '1'='1
+			ID:         "942130",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody},
+			Pattern:    `['"]\s*or\s*['"]?\w+['"]?\s*=\s*['"]?\w+`,
+			Severity:   "critical",
+			Tags:       []string{"attack-sqli"},
+			Transforms: []string{"url_decode", "html_entity_decode", "remove_comments", "compress_whitespace", "lowercase"},
+		},
+		{
+			// SQL comment sequences used to truncate queries
+			ID:         "942440",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody},
+			Pattern:    `(--|/\*|;.*--)`,
+			Severity:   "warning",
+			Tags:       []string{"attack-sqli"},
+			Paranoia:   2,
+			Transforms: []string{"url_decode", "html_entity_decode"},
+		},
+		{
+			// UPDATE ... SET — common in prose ("update your settings")
+			ID:         "942200",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody},
+			Pattern:    `update\s.*\bset\b`,
+			Severity:   "notice",
+			Tags:       []string{"attack-sqli"},
+			Paranoia:   2,
+			Transforms: []string{"url_decode", "compress_whitespace", "lowercase"},
+		},
+		{
+			// Event handlers, javascript pseudo-protocol, and script tags
+			ID:         "941100",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody},
+			Pattern:    `(<script|alert\s*\(|on(error|load|mouseover)\s*=|javascript:|eval\s*\(|unescape\s*\(|string\.fromcharcode|<iframe|document\.(cookie|location)|window\.(location|open)|src\s*=.*javascript:)`,
+			Severity:   "critical",
+			Tags:       []string{"attack-xss"},
+			Transforms: []string{"url_decode", "html_entity_decode", "js_decode", "lowercase"},
+		},
+		{
+			// Command chaining into well-known binaries and shell substitution
+			ID:         "932100",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody},
+			Pattern:    `(?i)(\$\(.*\)|\x60.*\x60|/bin/(ba)?sh|nc -e|(;|\||&&)\s*(cat|ls|id|whoami|uname|wget|curl|nc|bash|sh|python|perl|powershell)\b)`,
+			Severity:   "critical",
+			Tags:       []string{"attack-rce"},
+			Transforms: []string{"url_decode", "compress_whitespace"},
+		},
+		{
+			// Interpreter and download tool names on their own
+			ID:         "932150",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody},
+			Pattern:    `(?i)\b(python|perl|bash|powershell|curl|wget|cmd)\b`,
+			Severity:   "warning",
+			Tags:       []string{"attack-rce"},
+			Paranoia:   3,
+			Transforms: []string{"url_decode"},
+		},
+		{
+			// Bare shell metacharacters — extremely noisy on real traffic
+			ID:         "932160",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody},
+			Pattern:    `(;|\||&&|>|<|\x60)`,
+			Severity:   "notice",
+			Tags:       []string{"attack-rce"},
+			Paranoia:   4,
+			Transforms: []string{"url_decode"},
+		},
+		{
+			// Path traversal and sensitive file access
+			ID:         "930100",
+			Targets:    []string{TargetPath, TargetQuery, TargetBody, TargetFilename},
+			Pattern:    `(?i)(\.\./|\.\.\\|/etc/passwd|/windows/system32|boot\.ini|windows/win\.ini|/var/www/html/.*\.env)`,
+			Severity:   "critical",
+			Tags:       []string{"attack-lfi"},
+			Transforms: []string{"url_decode", "html_entity_decode"},
+		},
+		{
+			// Restricted files, matched on the canonical path so /./.git//config
+			// and /static/../.env cannot slip past
+			ID:         "930130",
+			Targets:    []string{TargetPath},
+			Pattern:    `/(\.git|\.svn|\.env|\.htaccess|\.htpasswd|wp-config\.php)(/|$)`,
+			Severity:   "critical",
+			Tags:       []string{"attack-lfi"},
+			Transforms: []string{"url_decode", "normalize_path", "lowercase"},
+		},
+		{
+			// Shellshock function definitions smuggled in header values
+			ID:       "932170",
+			Targets:  []string{TargetHeader, TargetCookie},
+			Pattern:  `^\(\s*\)\s*\{`,
+			Severity: "critical",
+			Tags:     []string{"attack-rce"},
+		},
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			panic(err) // built-in rules are static; a failure here is a programming error
+		}
+	}
+	return rules
+}
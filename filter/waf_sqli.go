@@ -0,0 +1,306 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+)
+
+// SQL injection detection in the style of libinjection: the value is
+// tokenized as SQL, each token is reduced to a one-letter type, and the
+// resulting fingerprint is matched against shapes that only make sense as an
+// injection. Prose such as "update your settings" or "wait -- what" tokenizes
+// to harmless fingerprints, while obfuscated payloads (UNION/**/SELECT,
+// /*!50000UNION*/, mixed case, ||) collapse to the same fingerprint as the
+// plain ones.
+
+// SQL token types, as they appear in a fingerprint.
+const (
+	sqlString    = 's'
+	sqlNumber    = '1'
+	sqlBareword  = 'n'
+	sqlKeyword   = 'k'
+	sqlStatement = 'E'
+	sqlUnion     = 'U'
+	sqlLogic     = '&'
+	sqlOperator  = 'o'
+	sqlFunction  = 'f'
+	sqlVariable  = 'v'
+	sqlComment   = 'c'
+	sqlUnknown   = 'x'
+)
+
+// maxSQLTokens is how much of a value the fingerprint covers. Injections
+// reveal themselves within the first few tokens after the break-out point.
+const maxSQLTokens = 8
+
+var sqlWords = map[string]byte{
+	"and": sqlLogic, "or": sqlLogic, "xor": sqlLogic,
+
+	"union": sqlUnion,
+
+	"select": sqlStatement, "insert": sqlStatement, "update": sqlStatement,
+	"delete": sqlStatement, "drop": sqlStatement, "create": sqlStatement,
+	"alter": sqlStatement, "truncate": sqlStatement, "exec": sqlStatement,
+	"execute": sqlStatement, "declare": sqlStatement, "shutdown": sqlStatement,
+	"grant": sqlStatement, "revoke": sqlStatement, "waitfor": sqlStatement,
+
+	"not": sqlOperator, "like": sqlOperator, "rlike": sqlOperator,
+	"regexp": sqlOperator, "is": sqlOperator, "in": sqlOperator,
+	"between": sqlOperator, "div": sqlOperator, "mod": sqlOperator,
+
+	"null": sqlNumber, "true": sqlNumber, "false": sqlNumber,
+
+	"from": sqlKeyword, "where": sqlKeyword, "into": sqlKeyword,
+	"table": sqlKeyword, "database": sqlKeyword, "values": sqlKeyword,
+	"set": sqlKeyword, "all": sqlKeyword, "distinct": sqlKeyword,
+	"order": sqlKeyword, "group": sqlKeyword, "by": sqlKeyword,
+	"having": sqlKeyword, "limit": sqlKeyword, "offset": sqlKeyword,
+	"top": sqlKeyword, "join": sqlKeyword, "as": sqlKeyword,
+	"case": sqlKeyword, "when": sqlKeyword, "then": sqlKeyword,
+	"else": sqlKeyword, "end": sqlKeyword, "delay": sqlKeyword,
+	"procedure": sqlKeyword, "outfile": sqlKeyword, "dumpfile": sqlKeyword,
+}
+
+// sqlFunctions are recognised as calls even with whitespace before the
+// parenthesis; any other word needs the parenthesis to follow immediately.
+var sqlFunctions = map[string]bool{
+	"sleep": true, "benchmark": true, "pg_sleep": true, "load_file": true,
+	"extractvalue": true, "updatexml": true, "char": true, "chr": true,
+	"concat": true, "concat_ws": true, "group_concat": true, "ascii": true,
+	"substring": true, "substr": true, "mid": true, "version": true,
+	"database": true, "user": true, "current_user": true, "if": true,
+	"ifnull": true, "count": true, "hex": true, "unhex": true, "cast": true,
+	"convert": true, "dbms_pipe.receive_message": true,
+}
+
+// sqliFingerprints are the token shapes reported as injections. The quoted
+// contexts start with the string the attacker broke out of ('s').
+var sqliFingerprints = regexp.MustCompile(strings.Join([]string{
+	// ' or 1=1 / ' and 'a'='a / ') or (x=x
+	`^s\)*&\(*[1snv]o`,
+	// ' or 1-- / ' or 'x
+	`^s\)*&\(*[1snv]c`,
+	`^s\)*&\(*[1s]$`,
+	// ' and sleep(5) / '+benchmark(...)+'
+	`^s\)*[&o]\(*f\(`,
+	// ' ; drop table users / '); exec xp_cmdshell
+	`^s\)*;E`,
+	// admin'-- / admin')#
+	`^s\)*c`,
+	// '||(select ...)
+	`^s\)*[&o]\(E`,
+	// numeric context: 1 or 1=1 / -1) and sleep(5) / 1; drop table
+	`^o?1\)*&\(*[1snv]o`,
+	`^o?1\)*&\(*[1snv]c`,
+	`^o?1\)*&\(*f\(`,
+	`^o?1\)*;E`,
+	// union [all|distinct] select, anywhere
+	`Uk?\(*E`,
+}, "|"))
+
+// DetectSQLi reports whether value looks like an SQL injection. The value is
+// fingerprinted as-is and as if it had been placed inside a single- or
+// double-quoted SQL string.
+func DetectSQLi(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, quote := range []byte{0, '\'', '"'} {
+		if quote != 0 && strings.IndexByte(value, quote) < 0 {
+			continue // can't break out of a quote it doesn't contain
+		}
+		if sqliFingerprints.MatchString(sqlFingerprint(value, quote)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlFingerprint tokenizes value and returns the types of its first
+// maxSQLTokens tokens. A non-zero quote starts inside a string literal
+// delimited by that character.
+func sqlFingerprint(value string, quote byte) string {
+	fp := make([]byte, 0, maxSQLTokens)
+	t := sqlTokenizer{s: value}
+	if quote != 0 {
+		t.readString(quote)
+		fp = append(fp, sqlString)
+	}
+	for len(fp) < maxSQLTokens {
+		typ, ok := t.next()
+		if !ok {
+			break
+		}
+		fp = append(fp, typ)
+	}
+	return string(fp)
+}
+
+type sqlTokenizer struct {
+	s   string
+	pos int
+}
+
+// next returns the type of the next token, skipping whitespace and inline
+// comments (which SQL treats as whitespace, so UNION/**/SELECT is UNION SELECT).
+func (t *sqlTokenizer) next() (byte, bool) {
+	for t.pos < len(t.s) {
+		c := t.s[t.pos]
+		switch {
+		case isSQLSpace(c):
+			t.pos++
+		case strings.HasPrefix(t.s[t.pos:], "/*!"):
+			// MySQL executable comment: the body is code
+			t.pos += 3
+			for t.pos < len(t.s) && isDigit(t.s[t.pos]) {
+				t.pos++
+			}
+		case strings.HasPrefix(t.s[t.pos:], "/*"):
+			end := strings.Index(t.s[t.pos+2:], "*/")
+			if end < 0 {
+				t.pos = len(t.s)
+				return sqlComment, true
+			}
+			t.pos += end + 4
+		case strings.HasPrefix(t.s[t.pos:], "*/"):
+			t.pos += 2 // end of an executable comment
+		case strings.HasPrefix(t.s[t.pos:], "--") || c == '#':
+			end := strings.IndexByte(t.s[t.pos:], '\n')
+			if end < 0 {
+				t.pos = len(t.s)
+			} else {
+				t.pos += end + 1
+			}
+			return sqlComment, true
+		case c == '\'' || c == '"':
+			t.pos++
+			t.readString(c)
+			return sqlString, true
+		case c == '`':
+			t.pos++
+			t.readString(c)
+			return sqlBareword, true
+		case isDigit(c) || c == '.' && t.pos+1 < len(t.s) && isDigit(t.s[t.pos+1]):
+			t.readNumber()
+			return sqlNumber, true
+		case c == '@':
+			t.pos++
+			for t.pos < len(t.s) && (t.s[t.pos] == '@' || isSQLWordChar(t.s[t.pos])) {
+				t.pos++
+			}
+			return sqlVariable, true
+		case isSQLWordStart(c):
+			return t.readWord(), true
+		case c == '(' || c == ')' || c == ',' || c == ';':
+			t.pos++
+			return c, true
+		default:
+			return t.readOperator(), true
+		}
+	}
+	return 0, false
+}
+
+// readString consumes a string body up to and including the closing quote.
+// Doubled quotes and backslash escapes do not close it; neither does the
+// end of the value, which leaves the string unterminated.
+func (t *sqlTokenizer) readString(quote byte) {
+	for t.pos < len(t.s) {
+		c := t.s[t.pos]
+		switch {
+		case c == '\\' && quote != '`':
+			t.pos += 2
+		case c == quote && t.pos+1 < len(t.s) && t.s[t.pos+1] == quote:
+			t.pos += 2
+		case c == quote:
+			t.pos++
+			return
+		default:
+			t.pos++
+		}
+	}
+	if t.pos > len(t.s) {
+		t.pos = len(t.s)
+	}
+}
+
+func (t *sqlTokenizer) readNumber() {
+	if strings.HasPrefix(t.s[t.pos:], "0x") || strings.HasPrefix(t.s[t.pos:], "0X") {
+		t.pos += 2
+		for t.pos < len(t.s) && isHex(t.s[t.pos:t.pos+1]) {
+			t.pos++
+		}
+		return
+	}
+	for t.pos < len(t.s) {
+		c := t.s[t.pos]
+		switch {
+		case isDigit(c) || c == '.':
+			t.pos++
+		case (c == 'e' || c == 'E') && t.pos+1 < len(t.s) && (isDigit(t.s[t.pos+1]) || t.s[t.pos+1] == '-' || t.s[t.pos+1] == '+'):
+			t.pos += 2
+		default:
+			return
+		}
+	}
+}
+
+func (t *sqlTokenizer) readWord() byte {
+	start := t.pos
+	for t.pos < len(t.s) && isSQLWordChar(t.s[t.pos]) {
+		t.pos++
+	}
+	word := strings.ToLower(t.s[start:t.pos])
+
+	// A word followed by "(" is a call; known functions may have
+	// whitespace in between.
+	if t.pos < len(t.s) && t.s[t.pos] == '(' {
+		return sqlFunction
+	}
+	if sqlFunctions[word] {
+		rest := strings.TrimLeft(t.s[t.pos:], " \t\r\n")
+		if strings.HasPrefix(rest, "(") {
+			return sqlFunction
+		}
+	}
+	if typ, ok := sqlWords[word]; ok {
+		return typ
+	}
+	return sqlBareword
+}
+
+var sqlOperators = []string{"<=>", "<>", "!=", "<=", ">=", ":=", "<<", ">>", "||", "&&"}
+
+func (t *sqlTokenizer) readOperator() byte {
+	for _, op := range sqlOperators {
+		if strings.HasPrefix(t.s[t.pos:], op) {
+			t.pos += len(op)
+			if op == "||" || op == "&&" {
+				return sqlLogic
+			}
+			return sqlOperator
+		}
+	}
+	c := t.s[t.pos]
+	t.pos++
+	if strings.IndexByte("=<>!+-*/%|&^~", c) >= 0 {
+		return sqlOperator
+	}
+	return sqlUnknown
+}
+
+func isSQLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f' || c == 0xa0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSQLWordStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || c >= 0x80 && c != 0xa0
+}
+
+func isSQLWordChar(c byte) bool {
+	return isSQLWordStart(c) || isDigit(c) || c == '.'
+}
@@ -0,0 +1,102 @@
+package filter
+
+import (
+	"regexp"
+	"testing"
+)
+
+// sqliCorpus mixes real payloads, obfuscated payloads and benign input the
+// old regexes tripped on.
+var sqliCorpus = []struct {
+	value string
+	want  bool
+}{
+	{"1' OR '1'='1", true},
+	{"admin'--", true},
+	{"admin')#", true},
+	{"' or 1=1--", true},
+	{"\" or \"\"=\"", true},
+	{"1 or 1=1", true},
+	{"-1) or (1=1", true},
+	{"1 UNION SELECT username, password FROM users", true},
+	{"1 UnIoN/**/aLl/**/SeLeCt 1,2,3", true},
+	{"1 /*!50000UNION*/ /*!50000SELECT*/ 1", true},
+	{"x'||(select version())||'", true},
+	{"1' and sleep(5)#", true},
+	{"1 and benchmark (5000000, md5(1))", true},
+	{"'; DROP TABLE users; --", true},
+	{"1; exec xp_cmdshell('dir')", true},
+	{"' or true--", true},
+
+	{"update your settings", false},
+	{"please update the set list", false},
+	{"wait -- what happened?", false},
+	{"it's a nice day, isn't it", false},
+	{"O'Reilly", false},
+	{"rock 'n' roll", false},
+	{"select your plan from the list below", false},
+	{"cats or dogs", false},
+	{"he said \"hi\" and left", false},
+	{"1990-2000", false},
+	{"user@example.com", false},
+	{"", false},
+}
+
+func TestDetectSQLi(t *testing.T) {
+	for _, tt := range sqliCorpus {
+		if got := DetectSQLi(tt.value); got != tt.want {
+			t.Errorf("DetectSQLi(%q) = %v, want %v (fingerprints %q %q %q)", tt.value, got, tt.want,
+				sqlFingerprint(tt.value, 0), sqlFingerprint(tt.value, '\''), sqlFingerprint(tt.value, '"'))
+		}
+	}
+}
+
+// legacySQLiRegexes are the SQLi patterns the WAF shipped with before the
+// tokenizer, kept for comparison.
+var legacySQLiRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(union.*select|insert.*into|drop.*table|delete.*from|update.*set|exec\s*\(|sp_executesql|xp_cmdshell|information_schema|sysdatabases|waitfor\s+delay)`),
+	regexp.MustCompile(`(?i)(\-\-|\/\*|;.*\-\-|'\s*or\s*'?\w+'?\s*=\s*'?\w+)`),
+}
+
+func legacySQLi(value string) bool {
+	for _, re := range legacySQLiRegexes {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func BenchmarkDetectSQLi(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, tt := range sqliCorpus {
+			DetectSQLi(tt.value)
+		}
+	}
+}
+
+func BenchmarkLegacySQLiRegex(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, tt := range sqliCorpus {
+			legacySQLi(tt.value)
+		}
+	}
+}
+
+// TestDetectSQLiAgainstLegacyRegex documents where the tokenizer improves on
+// the regexes: it must never be less accurate on the corpus.
+func TestDetectSQLiAgainstLegacyRegex(t *testing.T) {
+	var detector, legacy int
+	for _, tt := range sqliCorpus {
+		if DetectSQLi(tt.value) == tt.want {
+			detector++
+		}
+		if legacySQLi(tt.value) == tt.want {
+			legacy++
+		}
+	}
+	if detector < legacy {
+		t.Errorf("tokenizer classified %d/%d correctly, legacy regexes %d", detector, len(sqliCorpus), legacy)
+	}
+	t.Logf("correct: tokenizer %d/%d, legacy regexes %d/%d", detector, len(sqliCorpus), legacy, len(sqliCorpus))
+}
@@ -1,10 +1,14 @@
 package filter
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestWAFMiddleware(t *testing.T) {
@@ -20,14 +24,19 @@ func TestWAFMiddleware(t *testing.T) {
 		wantStatus int
 	}{
 		{"Clean GET", "GET", "/", "", http.StatusOK},
-		{"SQLi in Query", "GET", "/?id=1' OR '1'='1", "", http.StatusBadRequest},
+		{"SQLi in Query", "GET", "/?id=1'+UNION+SELECT+password+FROM+users--", "", http.StatusBadRequest},
 		{"XSS in Query", "GET", "/?q=<script>alert(1)</script>", "", http.StatusBadRequest},
-		{"CMDi in Query", "GET", "/?exec=;cat /etc/passwd", "", http.StatusBadRequest},
+		{"CMDi in Query", "GET", "/?exec=;cat+/etc/passwd", "", http.StatusBadRequest},
 		{"Traversal in Path", "GET", "/../../etc/passwd", "", http.StatusBadRequest},
 		{"Clean POST", "POST", "/", "foo=bar", http.StatusOK},
 		{"SQLi in Body", "POST", "/", "id=1' OR '1'='1", http.StatusBadRequest},
 		{"XSS in Body", "POST", "/", "<script>alert(1)</script>", http.StatusBadRequest},
 		{"CMDi in Body", "POST", "/", "ping -c 1 8.8.8.8; cat /etc/passwd", http.StatusBadRequest},
+		{"Obfuscated SQLi", "GET", "/?id=1+/*!50000UnIoN*/+/*!50000SeLeCt*/+1", "", http.StatusBadRequest},
+		{"SQLi tautology without spaces", "GET", "/?u=admin'||'1'='1", "", http.StatusBadRequest},
+		{"XSS via event handler", "GET", "/?q=<svg/onload=confirm(1)>", "", http.StatusBadRequest},
+		{"XSS attribute breakout", "GET", "/?q=%22+autofocus+onfocus=%22confirm(1)", "", http.StatusBadRequest},
+		{"Prose with SQL words", "GET", "/?q=update+your+settings+--+thanks", "", http.StatusOK},
 	}
 
 	for _, tt := range tests {
@@ -42,3 +51,434 @@ func TestWAFMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestWAFRulesFileAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeRules(`{"rules": [
+		{"id": "100", "targets": ["query"], "pattern": "(?i)forbidden", "tags": ["custom"]},
+		{"id": "101", "targets": ["header"], "operator": "contains", "pattern": "evilbot"}
+	]}`)
+
+	waf := NewWAF(path, 0)
+	defer waf.Stop()
+	handler := waf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(url, ua string) int {
+		req := httptest.NewRequest("GET", url, nil)
+		if ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if got := serve("/?q=FORBIDDEN", ""); got != http.StatusBadRequest {
+		t.Errorf("query rule: got %d, want 400", got)
+	}
+	if got := serve("/", "evilbot/1.0"); got != http.StatusBadRequest {
+		t.Errorf("header rule: got %d, want 400", got)
+	}
+	// Built-in rules are replaced by the file, so the default SQLi rule is gone.
+	if got := serve("/?id=1+UNION+SELECT+1", ""); got != http.StatusOK {
+		t.Errorf("rule from built-in set should not apply: got %d", got)
+	}
+
+	// A broken file keeps the previous rule set active.
+	writeRules(`{"rules": [{"id": "200", "targets": ["nowhere"], "pattern": "x"}]}`)
+	if err := waf.Reload(); err == nil {
+		t.Error("expected reload of invalid rules to fail")
+	}
+	if got := serve("/?q=forbidden", ""); got != http.StatusBadRequest {
+		t.Errorf("previous rules should survive a failed reload: got %d", got)
+	}
+
+	writeRules(`{"rules": [{"id": "300", "targets": ["path"], "operator": "prefix", "pattern": "/admin"}]}`)
+	if err := waf.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if got := serve("/?q=forbidden", ""); got != http.StatusOK {
+		t.Errorf("old rule should be gone after reload: got %d", got)
+	}
+	if got := serve("/admin/login", ""); got != http.StatusBadRequest {
+		t.Errorf("new rule should apply after reload: got %d", got)
+	}
+}
+
+func TestWAFWatchesRulesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(path, []byte(`{"rules": [{"id": "1", "targets": ["path"], "pattern": "a"}]}`), 0644)
+
+	waf := NewWAF(path, 20*time.Millisecond)
+	defer waf.Stop()
+
+	os.WriteFile(path, []byte(`{"rules": [{"id": "1", "targets": ["path"], "pattern": "a"}, {"id": "2", "targets": ["path"], "pattern": "b"}]}`), 0644)
+	// Ensure the modification time moves even on coarse-grained filesystems.
+	future := time.Now().Add(2 * time.Second)
+	os.Chtimes(path, future, future)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(waf.Rules()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("rules file change was not picked up, have %d rules", len(waf.Rules()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseWAFRulesRejectsDuplicates(t *testing.T) {
+	_, err := ParseWAFRules([]byte(`{"rules": [
+		{"id": "1", "targets": ["path"], "pattern": "a"},
+		{"id": "1", "targets": ["query"], "pattern": "b"}
+	]}`))
+	if err == nil {
+		t.Error("expected duplicate rule ids to be rejected")
+	}
+}
+
+func TestWAFAnomalyScoring(t *testing.T) {
+	waf := NewWAF("", 0)
+	waf.SetMode(WAFModeAnomaly)
+	handler := waf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(url string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		return rr.Code
+	}
+
+	// Paranoia level 1: bare shell metacharacters and prose are not inspected.
+	if got := serve("/?q=fish;chips|peas"); got != http.StatusOK {
+		t.Errorf("PL1 should ignore bare metacharacters: got %d", got)
+	}
+	if got := serve("/?msg=please+update+the+set+list--thanks"); got != http.StatusOK {
+		t.Errorf("PL1 should ignore update...set and comments: got %d", got)
+	}
+	// A single critical match reaches the default threshold of 5.
+	if got := serve("/?id=1+UNION+SELECT+password"); got != http.StatusBadRequest {
+		t.Errorf("critical match should block: got %d", got)
+	}
+
+	// At PL2 the comment rule (3) and update...set rule (2) add up to 5.
+	waf.SetParanoiaLevel(2)
+	if got := serve("/?msg=please+update+the+set+list--thanks"); got != http.StatusBadRequest {
+		t.Errorf("PL2 combined score should block: got %d", got)
+	}
+	// A single warning stays below the threshold.
+	if got := serve("/?msg=well--ok"); got != http.StatusOK {
+		t.Errorf("single warning should pass: got %d", got)
+	}
+
+	waf.SetInboundThreshold(10)
+	if got := serve("/?msg=please+update+the+set+list--thanks"); got != http.StatusOK {
+		t.Errorf("raised threshold should pass: got %d", got)
+	}
+}
+
+func TestWAFNormalization(t *testing.T) {
+	handler := WAFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"URL-encoded tautology", "/?id=1%27%20OR%20%271%27=%271"},
+		{"Double URL-encoded tautology", "/?id=1%2527%2520OR%2520%25271%2527%253D%25271"},
+		{"Plus as space", "/?id=1'+or+'a'='a"},
+		{"Unicode %u escapes", "/?id=1%u0027%u0020or%u0020%u00271%u0027=%u00271"},
+		{"HTML entities", "/?q=%26lt;script%26gt;alert(1)"},
+		{"JS unicode escapes", "/?q=%5Cu003cscript%5Cu003ealert(1)"},
+		{"Comment splitting", "/?id=1+UN/**/ION+SEL/**/ECT+password"},
+		{"Tab separated keywords", "/?id=1%09UNION%09%0ASELECT%09password"},
+		{"Restricted file via dot segments", "/static/./..//.git/config"},
+		{"Encoded traversal", "/?file=..%252f..%252fetc%252fpasswd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.url, nil))
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: got status %d, want 400", tt.url, rr.Code)
+			}
+		})
+	}
+}
+
+func TestWAFTransforms(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   wafTransform
+		in   string
+		want string
+	}{
+		{"url_decode recursive", urlDecodeRecursive, "%252e%252e%252f", "../"},
+		{"url_decode malformed", urlDecodeRecursive, "100%zz", "100%zz"},
+		{"html_entity_decode", htmlEntityDecode, "&lt;a&#39;&#x27;&gt;", "<a''>"},
+		{"js_decode", jsDecode, `a\x62\'c`, "ab'c"},
+		{"compress_whitespace", compressWhitespace, "a \t\n  b", "a b"},
+		{"remove_comments", removeComments, "SEL/*x*/ECT 1 -- tail\nnext /* open", "SELECT 1 \nnext "},
+		{"normalize_path", normalizePath, `/a\b//./c/../d/`, "/a/b/d/"},
+	}
+	for _, tt := range tests {
+		if got := tt.fn(tt.in); got != tt.want {
+			t.Errorf("%s(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := ParseWAFRules([]byte(`{"rules": [{"id": "1", "targets": ["path"], "pattern": "a", "transforms": ["rot13"]}]}`)); err == nil {
+		t.Error("expected unknown transform to be rejected")
+	}
+}
+
+func TestWAFStructuredBodies(t *testing.T) {
+	waf := NewWAF("", 0)
+	waf.SetLimits(WAFLimits{MaxDepth: 4, MaxFields: 8})
+	handler := waf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	multipartBody := func(filename, comment string) string {
+		return "--XYZ\r\n" +
+			"Content-Disposition: form-data; name=\"comment\"\r\n\r\n" + comment + "\r\n" +
+			"--XYZ\r\n" +
+			"Content-Disposition: form-data; name=\"upload\"; filename=\"" + filename + "\"\r\n" +
+			"Content-Type: application/octet-stream\r\n\r\n" +
+			"file contents; cat /etc/passwd are not inspected\r\n" +
+			"--XYZ--\r\n"
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"Clean JSON", "application/json", `{"user": {"name": "alice", "tags": ["a", "b"]}, "age": 30}`, http.StatusOK},
+		{"SQLi in JSON leaf", "application/json", `{"user": {"tags": ["a", "1' or '1'='1"]}}`, http.StatusBadRequest},
+		{"XSS in JSON key", "application/json", `{"<script>alert(1)</script>": 1}`, http.StatusBadRequest},
+		{"JSON escapes decoded", "application/json", `{"q": "\u003cscript\u003ealert(1)"}`, http.StatusBadRequest},
+		{"Clean form", "application/x-www-form-urlencoded", "name=alice&city=paris", http.StatusOK},
+		{"SQLi in form field", "application/x-www-form-urlencoded", "name=alice&id=1%27+OR+%271%27%3D%271", http.StatusBadRequest},
+		{"Clean multipart", "multipart/form-data; boundary=XYZ", multipartBody("avatar.png", "hello"), http.StatusOK},
+		{"Traversal in filename", "multipart/form-data; boundary=XYZ", multipartBody("../../etc/cron.d/job", "hello"), http.StatusBadRequest},
+		{"XSS in multipart field", "multipart/form-data; boundary=XYZ", multipartBody("avatar.png", "<script>alert(1)</script>"), http.StatusBadRequest},
+		{"Too deep falls back to raw", "application/json", `{"a":{"b":{"c":{"d":{"e":"<script>"}}}}}`, http.StatusBadRequest},
+		{"Too many fields falls back to raw", "application/x-www-form-urlencoded", "a=1&b=2&c=3&d=4&e=5&f=6&g=<script>", http.StatusBadRequest},
+		{"Malformed JSON falls back to raw", "application/json", `{"q": "<script>"`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("%s: got status %d, want %d", tt.name, rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWAFBodyLimitAndRestore(t *testing.T) {
+	waf := NewWAF("", 0)
+	waf.SetLimits(WAFLimits{MaxBodyBytes: 32})
+
+	var upstream string
+	handler := waf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstream = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// The payload sits past the limit, so only the clean prefix is inspected,
+	// but the upstream still receives the whole body.
+	body := `{"padding": "` + strings.Repeat("x", 64) + `", "q": "<script>"}`
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("got status %d, want 200", rr.Code)
+	}
+	if upstream != body {
+		t.Errorf("upstream body = %q, want %q", upstream, body)
+	}
+}
+
+func TestWAFTargetSelectors(t *testing.T) {
+	rules, err := ParseWAFRules([]byte(`{"rules": [
+		{"id": "200", "targets": ["header:User-Agent"], "operator": "contains", "pattern": "sqlmap"},
+		{"id": "203", "targets": ["header:X-Aegis-Foo"], "operator": "contains", "pattern": "<script>"},
+		{"id": "201", "targets": ["cookie:role"], "operator": "equals", "pattern": "admin"},
+		{"id": "202", "targets": ["body:user.role"], "operator": "equals", "pattern": "admin"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waf := NewWAF("", 0)
+	waf.rules.Store(rules)
+	handler := waf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		body       string
+		wantStatus int
+	}{
+		{"Selected header", "user-agent", "sqlmap/1.7", "", http.StatusBadRequest},
+		{"Other header ignored", "Referer", "sqlmap", "", http.StatusOK},
+		{"Client X-Aegis header inspected", "X-Aegis-Foo", "<script>", "", http.StatusBadRequest},
+		{"Selected cookie", "Cookie", "theme=dark; role=admin", "", http.StatusBadRequest},
+		{"Other cookie ignored", "Cookie", "theme=admin", "", http.StatusOK},
+		{"Selected JSON field", "", "", `{"user": {"role": "admin"}}`, http.StatusBadRequest},
+		{"Other JSON field ignored", "", "", `{"role": "admin"}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("%s: got status %d, want %d", tt.name, rr.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	if _, err := ParseWAFRules([]byte(`{"rules": [{"id": "1", "targets": ["path:x"], "pattern": "a"}]}`)); err == nil {
+		t.Error("expected named path selector to be rejected")
+	}
+}
+
+func TestWAFDetectOnly(t *testing.T) {
+	rules, err := ParseWAFRules([]byte(`{"rules": [
+		{"id": "300", "targets": ["query"], "operator": "contains", "pattern": "enforced"},
+		{"id": "301", "targets": ["query"], "operator": "contains", "pattern": "trial", "detect_only": true}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waf := NewWAF("", 0)
+	waf.rules.Store(rules)
+	handler := waf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(url string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		return rr.Code
+	}
+
+	for _, mode := range []string{WAFModeImmediate, WAFModeAnomaly} {
+		waf.SetMode(mode)
+		if got := serve("/?q=trial"); got != http.StatusOK {
+			t.Errorf("%s: detect-only rule: got %d, want 200", mode, got)
+		}
+		if got := serve("/?q=trial+enforced"); got != http.StatusBadRequest {
+			t.Errorf("%s: detect-only rule must not mask an enforced rule: got %d, want 400", mode, got)
+		}
+	}
+
+	waf.SetDetectOnly(true)
+	if got := serve("/?q=enforced"); got != http.StatusOK {
+		t.Errorf("global detect-only: got %d, want 200", got)
+	}
+	waf.SetDetectOnly(false)
+	if got := serve("/?q=enforced"); got != http.StatusBadRequest {
+		t.Errorf("after leaving detect-only: got %d, want 400", got)
+	}
+
+	verdict := waf.evaluate([]wafVar{{target: TargetQuery, name: "q", value: "trial"}}, nil)
+	if verdict.score != 0 || len(verdict.detected) != 1 {
+		t.Errorf("detect-only match scored %d with %d detections, want 0 and 1", verdict.score, len(verdict.detected))
+	}
+}
+
+func TestWAFExclusions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `{
+		"rules": [
+			{"id": "941100", "targets": ["body", "query"], "pattern": "<script", "tags": ["attack-xss"]},
+			{"id": "942100", "targets": ["body", "query"], "pattern": "union.*select", "tags": ["attack-sqli"]}
+		],
+		"exclusions": [
+			{"host": "cms.example.com", "path_prefix": "/admin/", "methods": ["POST"], "tags": ["attack-xss"], "targets": ["body:content"]},
+			{"path_prefix": "/reports", "rule_ids": ["942100"]}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waf := NewWAF(path, 0)
+	defer waf.Stop()
+	if got := len(waf.Exclusions()); got != 2 {
+		t.Fatalf("loaded %d exclusions, want 2", got)
+	}
+	handler := waf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		method     string
+		host       string
+		url        string
+		body       string
+		wantStatus int
+	}{
+		{"Excluded field", "POST", "cms.example.com", "/admin/pages", "content=<script>track()</script>", http.StatusOK},
+		{"Host with port", "POST", "CMS.example.com:8443", "/admin/pages", "content=<script>track()</script>", http.StatusOK},
+		{"Other field still inspected", "POST", "cms.example.com", "/admin/pages", "title=<script>x</script>", http.StatusBadRequest},
+		{"Other tags still inspected", "POST", "cms.example.com", "/admin/pages", "content=1 union select 2", http.StatusBadRequest},
+		{"Other host", "POST", "www.example.com", "/admin/pages", "content=<script>x</script>", http.StatusBadRequest},
+		{"Other path", "POST", "cms.example.com", "/blog", "content=<script>x</script>", http.StatusBadRequest},
+		{"Other method", "PUT", "cms.example.com", "/admin/pages", "content=<script>x</script>", http.StatusBadRequest},
+		{"Rule removed for whole request", "GET", "any.example.com", "/reports?q=union+select", "", http.StatusOK},
+		{"Unrelated rule on same route", "GET", "any.example.com", "/reports?q=<script>", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			req.Host = tt.host
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("%s: got status %d, want %d", tt.name, rr.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	if _, _, err := parseWAFRulesFile([]byte(`{"rules": [], "exclusions": [{"path_prefix": "/admin"}]}`)); err == nil {
+		t.Error("expected exclusion without rule_ids or tags to be rejected")
+	}
+}
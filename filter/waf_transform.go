@@ -0,0 +1,231 @@
+package filter
+
+import (
+	"fmt"
+	"html"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// wafTransform normalizes a value before a rule operator sees it.
+type wafTransform func(string) string
+
+// wafTransforms lists the transformations a rule may request, applied in the
+// order the rule declares them.
+var wafTransforms = map[string]wafTransform{
+	"url_decode":          urlDecodeRecursive,
+	"html_entity_decode":  htmlEntityDecode,
+	"js_decode":           jsDecode,
+	"lowercase":           strings.ToLower,
+	"compress_whitespace": compressWhitespace,
+	"remove_comments":     removeComments,
+	"normalize_path":      normalizePath,
+}
+
+// maxDecodePasses bounds recursive decoding of nested encodings (%2527 → %27 → ').
+const maxDecodePasses = 4
+
+// compileTransforms resolves transformation names to their implementations.
+func compileTransforms(names []string) ([]wafTransform, error) {
+	chain := make([]wafTransform, 0, len(names))
+	for _, name := range names {
+		t, ok := wafTransforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+// applyTransforms runs value through the chain in order.
+func applyTransforms(chain []wafTransform, value string) string {
+	for _, t := range chain {
+		value = t(value)
+	}
+	return value
+}
+
+// urlDecodeRecursive percent-decodes until the value stops changing, so
+// double and triple encoding collapse to the same payload. It understands
+// '+' as a space and the non-standard %uXXXX form, and leaves malformed
+// escapes untouched instead of failing.
+func urlDecodeRecursive(s string) string {
+	for i := 0; i < maxDecodePasses; i++ {
+		if !strings.ContainsAny(s, "%+") {
+			return s
+		}
+		decoded := urlDecode(s)
+		if decoded == s {
+			return s
+		}
+		s = decoded
+	}
+	return s
+}
+
+func urlDecode(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && i+5 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U') && isHex(s[i+2:i+6]):
+			b.WriteRune(rune(hexValue(s[i+2 : i+6])))
+			i += 5
+		case c == '%' && i+2 < len(s) && isHex(s[i+1:i+3]):
+			b.WriteByte(byte(hexValue(s[i+1 : i+3])))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// htmlEntityDecode resolves named (&lt;), decimal (&#39;) and hex (&#x27;)
+// character references.
+func htmlEntityDecode(s string) string {
+	if !strings.Contains(s, "&") {
+		return s
+	}
+	return html.UnescapeString(s)
+}
+
+// jsDecode resolves JavaScript/JSON escapes: \uXXXX, \xHH and the common
+// single-character escapes.
+func jsDecode(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 >= len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		next := s[i+1]
+		switch {
+		case next == 'u' && i+5 < len(s) && isHex(s[i+2:i+6]):
+			b.WriteRune(rune(hexValue(s[i+2 : i+6])))
+			i += 5
+		case next == 'x' && i+3 < len(s) && isHex(s[i+2:i+4]):
+			b.WriteByte(byte(hexValue(s[i+2 : i+4])))
+			i += 3
+		case next == 'n':
+			b.WriteByte('\n')
+			i++
+		case next == 't':
+			b.WriteByte('\t')
+			i++
+		case next == 'r':
+			b.WriteByte('\r')
+			i++
+		default:
+			// \' \" \\ \/ and unknown escapes decode to the escaped character
+			b.WriteByte(next)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// compressWhitespace collapses every run of whitespace (including tabs,
+// newlines and non-breaking spaces) into a single space.
+func compressWhitespace(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inSpace := false
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == ' ' {
+			if !inSpace {
+				b.WriteByte(' ')
+				inSpace = true
+			}
+			continue
+		}
+		inSpace = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// removeComments strips SQL/C style /* ... */ blocks (including an
+// unterminated trailing one) and "--" line comments, so keyword splitting
+// like UN/**/ION SEL/**/ECT is rejoined.
+func removeComments(s string) string {
+	if !strings.Contains(s, "/*") && !strings.Contains(s, "--") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 3
+		case strings.HasPrefix(s[i:], "--"):
+			end := strings.IndexByte(s[i:], '\n')
+			if end < 0 {
+				return b.String()
+			}
+			i += end - 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// normalizePath canonicalizes a path: backslashes become slashes, duplicate
+// slashes collapse and "." / ".." segments are resolved.
+func normalizePath(s string) string {
+	if s == "" {
+		return s
+	}
+	p := strings.ReplaceAll(s, `\`, "/")
+	cleaned := path.Clean(p)
+	// path.Clean drops a meaningful trailing slash
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func hexValue(s string) int {
+	v := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			v = v<<4 | int(c-'0')
+		case c >= 'a' && c <= 'f':
+			v = v<<4 | int(c-'a'+10)
+		case c >= 'A' && c <= 'F':
+			v = v<<4 | int(c-'A'+10)
+		}
+	}
+	if v > utf8.MaxRune {
+		return utf8.RuneError
+	}
+	return v
+}
@@ -0,0 +1,209 @@
+package filter
+
+import (
+	"html"
+	"strings"
+)
+
+// XSS detection in the style of libinjection: instead of grepping for
+// "<script" the value is parsed as HTML and only constructs that execute
+// script are reported — dangerous elements, event handler attributes and
+// script URLs in URL-valued attributes. Mentions of "javascript" or
+// "onload" in plain text pass, while <svg/onload=...> and entity-encoded
+// href="&#106;avascript:..." are caught.
+
+// xssContexts are the places a reflected value may land: element content,
+// or an unquoted, single-, double- or back-quoted attribute value. A payload
+// like `" onmouseover="alert(1)` only becomes dangerous in the third one.
+var xssContexts = []string{"", "<x a=", "<x a='", `<x a="`, "<x a=`"}
+
+// xssTags are elements that run script or change how the page loads it.
+var xssTags = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "embed": true, "applet": true, "base": true,
+	"style": true, "xml": true, "import": true, "vmlframe": true,
+	"meta": true, "link": true,
+}
+
+// xssURLAttrs are attributes whose value is loaded or navigated to.
+var xssURLAttrs = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true,
+	"data": true, "xlink:href": true, "background": true, "lowsrc": true,
+	"dynsrc": true, "poster": true, "codebase": true, "to": true,
+	"from": true, "values": true,
+}
+
+var xssSchemes = []string{"javascript:", "vbscript:", "livescript:", "data:text/html", "data:image/svg"}
+
+// xssEvents are event handler names without the "on" prefix.
+var xssEvents = map[string]bool{}
+
+func init() {
+	for _, e := range strings.Fields(`abort activate afterprint animationend
+		animationiteration animationstart auxclick beforecopy beforecut
+		beforeinput beforepaste beforeprint beforeunload begin blur canplay
+		canplaythrough change click close contextmenu copy cuechange cut
+		dblclick drag dragend dragenter dragleave dragover dragstart drop
+		durationchange end ended error focus focusin focusout formdata
+		fullscreenchange hashchange input invalid keydown keypress keyup load
+		loadeddata loadedmetadata loadend loadstart message mousedown
+		mouseenter mouseleave mousemove mouseout mouseover mouseup mousewheel
+		offline online pagehide pageshow paste pause play playing pointerdown
+		pointerenter pointerleave pointermove pointerout pointerover
+		pointerrawupdate pointerup popstate progress ratechange
+		readystatechange repeat reset resize scroll scrollend search seeked
+		seeking select selectionchange selectstart show start stalled storage
+		submit suspend timeupdate toggle touchend touchmove touchstart
+		transitionend unload volumechange waiting wheel`) {
+		xssEvents[e] = true
+	}
+}
+
+// DetectXSS reports whether value contains markup that would execute script
+// if reflected into a page.
+func DetectXSS(value string) bool {
+	// Script needs either a tag or an attribute assignment
+	if !strings.ContainsAny(value, "<=") {
+		return false
+	}
+	for _, prefix := range xssContexts {
+		if quote := strings.TrimPrefix(prefix, "<x a="); quote != "" && !strings.Contains(value, quote) {
+			continue // can't break out of a quote it doesn't contain
+		}
+		if xssInHTML(prefix + value) {
+			return true
+		}
+	}
+	return false
+}
+
+// xssInHTML walks the tags of an HTML fragment.
+func xssInHTML(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '<' || i+1 >= len(s) {
+			continue
+		}
+		rest := s[i+1:]
+		switch {
+		case strings.HasPrefix(rest, "!--"):
+			end := strings.Index(rest[3:], "-->")
+			if end < 0 {
+				return false
+			}
+			i += end + 6
+		case isASCIILetter(rest[0]):
+			dangerous, consumed := xssTag(rest)
+			if dangerous {
+				return true
+			}
+			i += consumed
+		}
+	}
+	return false
+}
+
+// xssTag parses one start tag (without the leading '<') and reports whether
+// it is dangerous, along with how many bytes it spans.
+func xssTag(s string) (bool, int) {
+	i := 0
+	for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '/' && s[i] != '>' {
+		i++
+	}
+	if xssTags[strings.ToLower(s[:i])] {
+		return true, i
+	}
+
+	for i < len(s) {
+		// Slashes separate attributes like whitespace: <svg/onload=...>
+		for i < len(s) && (isHTMLSpace(s[i]) || s[i] == '/') {
+			i++
+		}
+		if i >= len(s) || s[i] == '>' {
+			return false, i
+		}
+
+		start := i
+		for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '/' && s[i] != '>' && s[i] != '=' {
+			i++
+		}
+		name := strings.ToLower(s[start:i])
+		if i == start {
+			i++ // stray '=' with no name
+			continue
+		}
+
+		for i < len(s) && isHTMLSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) || s[i] != '=' {
+			continue // attribute without a value
+		}
+		i++
+		for i < len(s) && isHTMLSpace(s[i]) {
+			i++
+		}
+
+		var value string
+		if i < len(s) && (s[i] == '"' || s[i] == '\'' || s[i] == '`') {
+			quote := s[i]
+			end := strings.IndexByte(s[i+1:], quote)
+			if end < 0 {
+				value, i = s[i+1:], len(s)
+			} else {
+				value, i = s[i+1:i+1+end], i+end+2
+			}
+		} else {
+			start := i
+			for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '>' {
+				i++
+			}
+			value = s[start:i]
+		}
+
+		if xssAttribute(name, value) {
+			return true, i
+		}
+	}
+	return false, i
+}
+
+// xssAttribute reports whether an attribute runs script.
+func xssAttribute(name, value string) bool {
+	if strings.HasPrefix(name, "on") && xssEvents[name[2:]] {
+		return true
+	}
+	switch {
+	case xssURLAttrs[name]:
+		url := strings.ToLower(stripHTMLControl(html.UnescapeString(value)))
+		for _, scheme := range xssSchemes {
+			if strings.HasPrefix(url, scheme) {
+				return true
+			}
+		}
+	case name == "style":
+		css := strings.ToLower(stripHTMLControl(removeComments(html.UnescapeString(value))))
+		return strings.Contains(css, "expression(") || strings.Contains(css, "javascript:")
+	case name == "srcdoc":
+		return xssInHTML(html.UnescapeString(value))
+	}
+	return false
+}
+
+// stripHTMLControl drops whitespace and control characters, which browsers
+// ignore inside a URL scheme: "java\tscript:" is "javascript:".
+func stripHTMLControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,80 @@
+package filter
+
+import (
+	"regexp"
+	"testing"
+)
+
+var xssCorpus = []struct {
+	value string
+	want  bool
+}{
+	{"<script>alert(1)</script>", true},
+	{"<ScRiPt src=//evil.example/x.js>", true},
+	{"<img src=x onerror=alert(1)>", true},
+	{"<svg/onload=alert(1)>", true},
+	{"<body onload =alert(1)>", true},
+	{`<a href="&#106;avascript:alert(1)">x</a>`, true},
+	{"<a href=\"java\tscript:alert(1)\">x</a>", true},
+	{`<iframe srcdoc="<img src=x onerror=alert(1)>">`, true},
+	{`<div style="width: expression(alert(1))">`, true},
+	{`" onmouseover="alert(1)`, true},
+	{`' autofocus onfocus='alert(1)`, true},
+	{"x onerror=alert(1)", true},
+	{`"><img src=x onerror=alert(1)>`, true},
+
+	{"javascript is fun", false},
+	{"the onload event fires after the page loads", false},
+	{"a < b and b > c", false},
+	{"<b>bold</b> and <i>italic</i>", false},
+	{`<a href="https://example.com/">link</a>`, false},
+	{"x = 1; y = 2", false},
+	{"he said \"hello\" and left", false},
+	{"online=true", false},
+	{"<!-- <script> -->", false},
+	{"", false},
+}
+
+func TestDetectXSS(t *testing.T) {
+	for _, tt := range xssCorpus {
+		if got := DetectXSS(tt.value); got != tt.want {
+			t.Errorf("DetectXSS(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+// legacyXSSRegex is the XSS pattern the WAF shipped with before the HTML
+// parser, kept for comparison.
+var legacyXSSRegex = regexp.MustCompile(`(?i)(<script|alert\s*\(|on(error|load|mouseover)\s*=|javascript:|eval\s*\(|unescape\s*\(|string\.fromcharcode|<iframe|document\.(cookie|location)|window\.(location|open)|src\s*=.*javascript:)`)
+
+func BenchmarkDetectXSS(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, tt := range xssCorpus {
+			DetectXSS(tt.value)
+		}
+	}
+}
+
+func BenchmarkLegacyXSSRegex(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, tt := range xssCorpus {
+			legacyXSSRegex.MatchString(tt.value)
+		}
+	}
+}
+
+func TestDetectXSSAgainstLegacyRegex(t *testing.T) {
+	var detector, legacy int
+	for _, tt := range xssCorpus {
+		if DetectXSS(tt.value) == tt.want {
+			detector++
+		}
+		if legacyXSSRegex.MatchString(tt.value) == tt.want {
+			legacy++
+		}
+	}
+	if detector < legacy {
+		t.Errorf("parser classified %d/%d correctly, legacy regex %d", detector, len(xssCorpus), legacy)
+	}
+	t.Logf("correct: parser %d/%d, legacy regex %d/%d", detector, len(xssCorpus), legacy, len(xssCorpus))
+}
@@ -10,6 +10,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
@@ -66,23 +67,134 @@ func main() {
 	rep := filter.NewReputationManager(activeStore)
 
 	// Initialize Filters
-	l3 := filter.NewL3Filter(cfg.L3Blacklist, cfg.Whitelist)
-	l4 := filter.NewL4Filter(cfg.L4ConnLimit, 5*time.Minute, activeStore, cfg.Whitelist)
-	l7 := filter.NewL7Filter(cfg.L7RateLimit, cfg.L7BurstLimit, cfg.Whitelist)
-	geoip := filter.NewGeoIPFilter(cfg.GeoIPDBPath, cfg.BlockedCountries)
+	// One whitelist for every layer, so L3, L4 and L7 agree on who bypasses them
+	whitelist := filter.NewIPSet(cfg.Whitelist)
+	l3 := filter.NewL3Filter(cfg.L3Blacklist, whitelist)
+	l4 := filter.NewL4Filter(cfg.L4ConnLimit, whitelist)
+	l4.SetLimits(filter.L4Limits{
+		PerIP:      cfg.L4ConnLimit,
+		PerSubnet:  cfg.L4SubnetConnLimit,
+		Global:     cfg.L4GlobalConnLimit,
+		IPv4Prefix: cfg.L4IPv4Prefix,
+		IPv6Prefix: cfg.L4IPv6Prefix,
+	})
+	// Ports with their own limits count their connections apart from the rest
+	l4Ports := make(map[int]*filter.L4Filter)
+	for portStr, limits := range cfg.L4PortLimits {
+		var pNum int
+		fmt.Sscanf(portStr, "%d", &pNum)
+		if pNum == 0 {
+			logger.Warn("Ignoring l4_port_limits entry with invalid port", "port", portStr)
+			continue
+		}
+		l4Ports[pNum] = l4.ForPort(pNum, limits)
+		logger.Info("L4 port limits", "port", pNum, "limits", l4Ports[pNum].Limits())
+	}
+	l4For := func(port int) *filter.L4Filter {
+		if f, ok := l4Ports[port]; ok {
+			return f
+		}
+		return l4
+	}
+	jwtVerifier, err := filter.NewJWTVerifier(cfg.RateLimitJWT)
+	if err != nil {
+		logger.Error("Invalid rate_limit_jwt config", "err", err)
+		os.Exit(1)
+	}
+	l7Key, err := filter.ParseRateLimitKey(cfg.L7RateLimitKey, jwtVerifier)
+	if err != nil {
+		logger.Error("Invalid l7_rate_limit_key", "err", err)
+		os.Exit(1)
+	}
+	anomalyKey, err := filter.ParseRateLimitKey(cfg.AnomalyKey, jwtVerifier)
+	if err != nil {
+		logger.Error("Invalid anomaly_key", "err", err)
+		os.Exit(1)
+	}
+	l7 := filter.NewL7Filter(cfg.L7RateLimit, cfg.L7BurstLimit, whitelist)
+	l7.Challenge = func(next http.Handler) http.Handler {
+		return middleware.ProgressiveChallenge(next, rep)
+	}
+	l7.Key = l7Key
+	l7.JWT = jwtVerifier
+	if err := l7.SetPolicies(cfg.RateLimitPolicies); err != nil {
+		logger.Error("Invalid rate limit policy config", "err", err)
+		os.Exit(1)
+	}
+	if redisAddr != "" {
+		// Share rate limit buckets across the cluster
+		l7.UseStore(activeStore)
+	}
+	l7.SetShadow(cfg.Toggles.RateLimitShadow)
+	if l7.Shadow() {
+		logger.Info("L7 rate limits in shadow mode: counting, not enforcing")
+	}
+	feeds, err := filter.NewThreatFeeds(l3, cfg.ThreatFeeds)
+	if err != nil {
+		logger.Error("Invalid threat feed config", "err", err)
+		os.Exit(1)
+	}
+	feeds.Start()
+	geoip, err := filter.NewGeoIPFilter(cfg.GeoIPDBPath, filter.GeoIPConfig{
+		Blocked:   cfg.BlockedCountries,
+		Allowed:   cfg.AllowedCountries,
+		Action:    cfg.GeoIPAction,
+		Rate:      cfg.GeoIPRateLimit,
+		Burst:     cfg.GeoIPBurstLimit,
+		Rules:     cfg.GeoRules,
+		Whitelist: whitelist,
+		Challenge: func(next http.Handler) http.Handler {
+			return middleware.ProgressiveChallenge(next, rep)
+		},
+	})
+	if err != nil {
+		logger.Error("Invalid GeoIP config", "err", err)
+		os.Exit(1)
+	}
+	asn, err := filter.NewASNFilter(cfg.ASNDBPath, filter.ASNConfig{
+		Blocked:    cfg.BlockedASNs,
+		Allowed:    cfg.AllowedASNs,
+		RateLimits: cfg.ASNRateLimits,
+		Whitelist:  whitelist,
+	})
+	if err != nil {
+		logger.Error("Invalid ASN config", "err", err)
+		os.Exit(1)
+	}
 	fingerprinter := filter.NewFingerprinter()
 	anomaly := filter.NewAnomalyDetector([]string{"/search", "/api/heavy-export"}, 20, activeStore)
+	anomaly.Key = anomalyKey
 	stats := filter.NewStatisticalAnomalyDetector(60)
+	waf := filter.NewWAF(cfg.WAFRulesPath, 30*time.Second)
+	if err := waf.SetMode(cfg.WAFMode); err != nil {
+		logger.Error("Invalid WAF mode", "err", err)
+		os.Exit(1)
+	}
+	waf.SetParanoiaLevel(cfg.WAFParanoiaLevel)
+	waf.SetInboundThreshold(cfg.WAFThreshold)
+	waf.SetLimits(filter.WAFLimits{
+		MaxBodyBytes: cfg.WAFMaxBodyBytes,
+		MaxDepth:     cfg.WAFMaxJSONDepth,
+		MaxFields:    cfg.WAFMaxFields,
+	})
+	waf.SetDetectOnly(cfg.Toggles.WAFDetectOnly)
+	logger.Info("WAF engine ready", "mode", waf.Mode(), "paranoia_level", waf.ParanoiaLevel(), "inbound_threshold", waf.InboundThreshold(), "detect_only", waf.DetectOnly())
 
 	// LiveToggles: reads toggle state at request time (not at startup),
 	// so PATCH /api/config changes take effect immediately without restart.
 	toggles := manager.NewLiveToggles(
 		cfg.Toggles.WAF,
+		cfg.Toggles.WAFDetectOnly,
 		cfg.Toggles.GeoIP,
 		cfg.Toggles.Challenge,
 		cfg.Toggles.Anomaly,
 		cfg.Toggles.Stats,
+		cfg.Toggles.ResponseInspection,
+		cfg.Toggles.RateLimitShadow,
 	)
+	// The WAF and L7 filter keep their own flags; keep them following the toggles
+	toggles.OnChange("waf_detect_only", waf.SetDetectOnly)
+	toggles.OnChange("rate_limit_shadow", l7.SetShadow)
 
 	// wrapToggle applies a middleware layer with a live-switchable toggle.
 	// The middleware is pre-built at startup (wrapped and bypass), selected per request.
@@ -140,13 +252,91 @@ func main() {
 		}
 	}
 
+	// Response inspection: masks or withholds leaked internals in upstream
+	// responses. Built once; the toggle is read per response.
+	leaks, err := filter.NewResponseInspector(filter.ResponseInspectorConfig{
+		Actions:      cfg.ResponseLeakActions,
+		MaxBytes:     cfg.ResponseMaxBytes,
+		ContentTypes: cfg.ResponseContentTypes,
+	})
+	if err != nil {
+		logger.Error("Invalid response inspection config", "err", err)
+		os.Exit(1)
+	}
+	responseFilter := func(resp *http.Response) error {
+		if !toggles.IsEnabled("response_inspection") {
+			return nil
+		}
+		return leaks.ModifyResponse(resp)
+	}
+	defaultProxy.SetResponseFilter(responseFilter)
+	for _, prx := range proxies {
+		prx.SetResponseFilter(responseFilter)
+	}
+
+	// PROXY protocol towards upstreams, so they see the client's address
+	for _, v := range []int{cfg.SendProxyProtocol, cfg.TCPSendProxyProtocol} {
+		if v < 0 || v > 2 {
+			logger.Error("Invalid PROXY protocol version, want 0 (off), 1 or 2", "version", v)
+			os.Exit(1)
+		}
+	}
+	if cfg.SendProxyProtocol != 0 {
+		if err := defaultProxy.SendProxyProtocol(cfg.SendProxyProtocol); err != nil {
+			logger.Error("Failed to enable PROXY protocol to upstreams", "err", err)
+			os.Exit(1)
+		}
+		for port, prx := range proxies {
+			if err := prx.SendProxyProtocol(cfg.SendProxyProtocol); err != nil {
+				logger.Error("Failed to enable PROXY protocol to upstreams", "port", port, "err", err)
+				os.Exit(1)
+			}
+		}
+		logger.Info("Sending PROXY protocol to HTTP upstreams", "version", cfg.SendProxyProtocol)
+	}
+
+	// Country/ASN enrichment headers are internal unless the upstream asked for them
+	if !cfg.GeoIPUpstreamHeaders {
+		defaultProxy.StripHeaders(util.CountryHeader, util.ASNHeader)
+		for _, prx := range proxies {
+			prx.StripHeaders(util.CountryHeader, util.ASNHeader)
+		}
+	}
+
 	// ProxyWatcher: auto-discovers from CSF/cPHulk/iptables and merges with
 	// the manual AEGISEDGE_TRUSTED_PROXY env var. Refreshes every 5 minutes.
 	proxyWatcher := util.NewProxyWatcher(os.Getenv("AEGISEDGE_TRUSTED_PROXY"), 5*time.Minute)
 	logger.Info("Trusted proxy watcher started", "refresh_interval", "5m")
 
+	// Each HTTP listener counts real TCP connections (keep-alive and idle
+	// included) against its port's L4 limits, and bounds how long a client
+	// may take to send headers
+	connTrackers := make(map[int]*filter.ConnTracker)
+	for _, port := range cfg.ListenPorts {
+		connTrackers[port] = filter.NewConnTracker(l4For(port), filter.ConnTrackerConfig{
+			Rate:          cfg.L4ConnRate,
+			Burst:         cfg.L4ConnBurst,
+			HeaderTimeout: time.Duration(cfg.HTTPHeaderTimeout) * time.Second,
+			Exempt:        proxyWatcher.IsTrusted, // load balancers carry many clients
+		})
+	}
+
+	// Slowloris / slow-read detection on HTTP listeners and TCP streams
+	slow := filter.NewSlowClientDetector(filter.SlowClientConfig{
+		MinRecvRate: cfg.SlowClientRecvRate,
+		MinSendRate: cfg.SlowClientSendRate,
+		Grace:       time.Duration(cfg.SlowClientGrace) * time.Second,
+		Exempt:      proxyWatcher.IsTrusted,
+	}, rep)
+
 	// Management API Instance
 	mgmt := manager.NewManagementAPI(activeStore, toggles, proxyWatcher)
+	mgmt.WAF = waf
+	mgmt.Feeds = feeds
+	mgmt.GeoIP = geoip
+	mgmt.ASN = asn
+	mgmt.L7 = l7
+	mgmt.Connections = connTrackers
 
 	// finalHandler: L3/L4 gate + Prometheus metrics + upstream proxy
 	finalHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -161,7 +351,7 @@ func main() {
 
 		// Layer 3 (Centralized Block Check)
 		if activeStore.IsBlocked(host) {
-			logger.Warn("Blocked request: IP is in active block list", "remote_addr", host)
+			logger.Warn("Blocked request: IP is in active block list", "remote_addr", host, "asn", util.GetASN(r))
 			if toggles.IsEnabled("stats") {
 				filter.BlockedRequests.WithLabelValues("L3", "active_block").Inc()
 			}
@@ -169,24 +359,17 @@ func main() {
 			return
 		}
 
-		if l3.IsBlacklisted(host) {
-			logger.Warn("Blocked request: IP is blacklisted", "remote_addr", host)
+		if source, blocked := l3.Lookup(host); blocked {
+			logger.Warn("Blocked request: IP is blacklisted", "remote_addr", host, "source", source, "asn", util.GetASN(r))
 			if toggles.IsEnabled("stats") {
-				filter.BlockedRequests.WithLabelValues("L3", "blacklist").Inc()
+				filter.BlockedRequests.WithLabelValues("L3", source).Inc()
 			}
 			http.Error(w, "Access Denied", http.StatusForbidden)
 			return
 		}
 
-		// Layer 4
-		if !l4.AllowConnection(r.RemoteAddr) {
-			if toggles.IsEnabled("stats") {
-				filter.BlockedRequests.WithLabelValues("L4", "conn_limit").Inc()
-			}
-			http.Error(w, "Too many connections", http.StatusServiceUnavailable)
-			return
-		}
-		defer l4.ReleaseConnection(r.RemoteAddr)
+		// Layer 4 connection limits are enforced by each listener's
+		// ConnTracker, before the request is read.
 
 	proceedToProxy:
 		// Dynamic Routing: Choose the upstream based on the port in the context
@@ -206,7 +389,7 @@ func main() {
 	// Build the inner security pipeline from inside out (innermost first).
 	// Each wrapToggle layer can be switched on/off live via /api/config.
 	inner := middleware.Tarpit(finalHandler, rep)
-	inner = wrapToggle("waf", filter.WAFMiddleware)(inner)
+	inner = wrapToggle("waf", waf.Middleware)(inner)
 	inner = wrapToggle("anomaly", anomaly.Middleware)(inner)
 	inner = wrapToggle("stats", stats.Middleware)(inner)
 	inner = wrapToggle("geoip", geoip.Middleware)(inner)
@@ -245,9 +428,11 @@ func main() {
 
 	// RealIP is the outermost layer — resolves the actual client IP from proxy
 	// headers before any filter or middleware runs. List is updated live.
+	// ASN and country resolution sit inside the logger so every request line
+	// carries them.
 	securityStack := middleware.RealIP(proxyWatcher)(
 		middleware.RequestLogger(
-			middleware.SecurityHeaders(attackChallenge),
+			asn.Middleware(geoip.Enrich(middleware.SecurityHeaders(attackChallenge))),
 		),
 	)
 
@@ -255,8 +440,14 @@ func main() {
 	// Checks if an IP is already known-bad BEFORE entering ANY middleware.
 	// This saves 8 middleware layers of CPU for every blocked request.
 	stack := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract raw IP directly (RealIP middleware hasn't run yet)
+		// Extract raw IP directly (RealIP middleware hasn't run yet), or the
+		// client a trusted balancer's PROXY header names
 		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if h := filter.ProxyHeaderFromContext(r.Context()); h != nil {
+			if addr := h.ClientAddr(nil); addr != nil {
+				host, _, _ = net.SplitHostPort(addr.String())
+			}
+		}
 
 		// Ultra-fast path: If already soft-blocked by fingerprinter, reject instantly
 		if filter.IsSoftBlocked(host) {
@@ -317,13 +508,28 @@ func main() {
 
 		srv := &http.Server{
 			Addr:              addr,
-			Handler:           WithPortInfo(port)(stack),
+			Handler:           WithPortInfo(port)(slow.Middleware(stack)),
 			ReadHeaderTimeout: 2 * time.Second,
 			ReadTimeout:       readTimeout,
 			WriteTimeout:      15 * time.Second,
 			IdleTimeout:       idleTimeout,
 		}
 
+		tracker := connTrackers[port]
+		serveLn := func(ln net.Listener) net.Listener {
+			// Innermost, so a balancer's connections are admitted and judged
+			// as the client its PROXY header names
+			if cfg.ProxyProtocol {
+				ln = filter.ServeProxyProtocol(srv, ln, proxyWatcher.IsTrusted)
+			}
+			ln = slow.Serve(srv, tracker.Serve(srv, ln))
+			if cfg.SendProxyProtocol != 0 {
+				// Close a client's upstream connections along with its own
+				proxy.TrackClientConns(srv)
+			}
+			return ln
+		}
+
 		isHTTPS := (port == 443)
 		var cert, key string
 		if isHTTPS {
@@ -355,10 +561,10 @@ func main() {
 			
 			if isHTTPS {
 				logger.Info("Hot Takeover active (HTTPS/L7 Protection)", "external", port, "internal", internalPort)
-				go srv.ServeTLS(tempLn, cert, key)
+				go srv.ServeTLS(serveLn(tempLn), cert, key)
 			} else {
 				logger.Info("Hot Takeover active (HTTP/L7 Protection)", "external", port, "internal", internalPort)
-				go srv.Serve(tempLn)
+				go srv.Serve(serveLn(tempLn))
 			}
 			servers = append(servers, srv)
 			continue
@@ -370,16 +576,61 @@ func main() {
 		logger.Info("Proxy engine active", "addr", srv.Addr, "https", isHTTPS)
 		servers = append(servers, srv)
 		if isHTTPS {
-			go srv.ServeTLS(ln, cert, key)
+			go srv.ServeTLS(serveLn(ln), cert, key)
 		} else {
-			go srv.Serve(ln)
+			go srv.Serve(serveLn(ln))
+		}
+	}
+
+	// TLS passthrough routers for tcp_ports, by port
+	sniRouters := make(map[int]*filter.SNIRouter)
+	for portStr, pt := range cfg.TLSPassthrough {
+		var pNum int
+		fmt.Sscanf(portStr, "%d", &pNum)
+		if !slices.Contains(cfg.TcpPorts, pNum) {
+			logger.Warn("TLS passthrough port is not in tcp_ports, ignoring", "port", portStr)
+			continue
+		}
+		router, err := filter.NewSNIRouter(pt)
+		if err != nil {
+			logger.Error("Invalid TLS passthrough config", "port", portStr, "err", err)
+			os.Exit(1)
 		}
+		sniRouters[pNum] = router
+		logger.Info("TLS passthrough routing active", "port", pNum, "routes", len(pt.Routes), "default", pt.Default)
+	}
+
+	// Stream routes: upstream pools and protocol sniffing for tcp_ports
+	streamRouters := make(map[int]*filter.StreamRouter)
+	for portStr, rc := range cfg.StreamRoutes {
+		var pNum int
+		fmt.Sscanf(portStr, "%d", &pNum)
+		if !slices.Contains(cfg.TcpPorts, pNum) {
+			logger.Warn("Stream route port is not in tcp_ports, ignoring", "port", portStr)
+			continue
+		}
+		router, err := filter.NewStreamRouter(rc)
+		if err != nil {
+			logger.Error("Invalid stream route", "port", portStr, "err", err)
+			os.Exit(1)
+		}
+		streamRouters[pNum] = router
+		logger.Info("Stream route active", "port", pNum, "upstreams", rc.Upstreams, "balance", rc.Balance, "sniff", rc.Sniff)
 	}
 
 	// Initialize TCP Stream Protection for other ports (SSH, DB, etc.)
 	for _, port := range cfg.TcpPorts {
 		addr := fmt.Sprintf(":%d", port)
-		targetAddr := fmt.Sprintf("127.0.0.1:%d", port)
+		streamCfg := filter.StreamConfig{
+			Target:     fmt.Sprintf("127.0.0.1:%d", port),
+			L4:         l4For(port),
+			Slow:       slow,
+			TrustProxy: proxyWatcher.IsTrusted,
+			SendProxy:  cfg.TCPSendProxyProtocol,
+			SNI:        sniRouters[port],
+			Routes:     streamRouters[port],
+			Port:       port,
+		}
 
 		ln, err := net.Listen("tcp", addr)
 		if err != nil && cfg.HotTakeover {
@@ -398,7 +649,7 @@ func main() {
 			}
 			hijackedPorts[port] = internalPort
 			
-			go filter.StreamProxy(tempLn, targetAddr, l4)
+			go filter.StreamProxy(tempLn, streamCfg)
 			logger.Info("TCP Hot Takeover active (L4 Protection)", "external", port, "internal", internalPort)
 			continue
 		} else if err != nil {
@@ -407,7 +658,7 @@ func main() {
 		}
 
 		logger.Info("TCP Stream Shield active", "port", port)
-		go filter.StreamProxy(ln, targetAddr, l4)
+		go filter.StreamProxy(ln, streamCfg)
 	}
 
 	// Graceful shutdown logic
@@ -424,6 +675,14 @@ func main() {
 
 	// Stop background cleanup loops and refresh goroutines
 	l7.Stop()
+	waf.Stop()
+	feeds.Stop()
+	asn.Stop()
+	geoip.Stop()
+	for _, tracker := range connTrackers {
+		tracker.Stop()
+	}
+	slow.Stop()
 	proxyWatcher.Stop()
 	orchMonitor.Stop()
 	if ls, ok := activeStore.(*store.LocalStore); ok {
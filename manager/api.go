@@ -3,7 +3,8 @@ package manager
 import (
 	"encoding/json"
 	"net/http"
-	//"sync"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,15 +21,28 @@ type LiveToggles struct {
 	Challenge atomic.Bool
 	Anomaly   atomic.Bool
 	Stats     atomic.Bool
+
+	// WAFDetectOnly keeps the WAF inspecting and logging but never blocking.
+	WAFDetectOnly atomic.Bool
+	// ResponseInspection scans upstream responses for leaked data.
+	ResponseInspection atomic.Bool
+	// RateLimitShadow keeps L7 rate limits counting but never enforcing.
+	RateLimitShadow atomic.Bool
+
+	hooksMu sync.RWMutex
+	hooks   map[string][]func(enabled bool)
 }
 
-func NewLiveToggles(waf, geoip, challenge, anomaly, stats bool) *LiveToggles {
+func NewLiveToggles(waf, wafDetectOnly, geoip, challenge, anomaly, stats, responseInspection, rateLimitShadow bool) *LiveToggles {
 	t := &LiveToggles{}
 	t.WAF.Store(waf)
+	t.WAFDetectOnly.Store(wafDetectOnly)
 	t.GeoIP.Store(geoip)
 	t.Challenge.Store(challenge)
 	t.Anomaly.Store(anomaly)
 	t.Stats.Store(stats)
+	t.ResponseInspection.Store(responseInspection)
+	t.RateLimitShadow.Store(rateLimitShadow)
 	return t
 }
 
@@ -36,6 +50,8 @@ func (t *LiveToggles) IsEnabled(feature string) bool {
 	switch feature {
 	case "waf":
 		return t.WAF.Load()
+	case "waf_detect_only":
+		return t.WAFDetectOnly.Load()
 	case "geoip":
 		return t.GeoIP.Load()
 	case "challenge":
@@ -44,14 +60,32 @@ func (t *LiveToggles) IsEnabled(feature string) bool {
 		return t.Anomaly.Load()
 	case "stats":
 		return t.Stats.Load()
+	case "response_inspection":
+		return t.ResponseInspection.Load()
+	case "rate_limit_shadow":
+		return t.RateLimitShadow.Load()
 	}
 	return true
 }
 
+// OnChange registers fn to run with the new state whenever feature is Set,
+// for components that keep their own copy of a toggle.
+func (t *LiveToggles) OnChange(feature string, fn func(enabled bool)) {
+	t.hooksMu.Lock()
+	defer t.hooksMu.Unlock()
+	if t.hooks == nil {
+		t.hooks = make(map[string][]func(enabled bool))
+	}
+	t.hooks[feature] = append(t.hooks[feature], fn)
+}
+
 func (t *LiveToggles) Set(feature string, enabled bool) {
+	defer t.notify(feature, enabled)
 	switch feature {
 	case "waf":
 		t.WAF.Store(enabled)
+	case "waf_detect_only":
+		t.WAFDetectOnly.Store(enabled)
 	case "geoip":
 		t.GeoIP.Store(enabled)
 	case "challenge":
@@ -61,16 +95,32 @@ func (t *LiveToggles) Set(feature string, enabled bool) {
 	case "stats":
 		t.Stats.Store(enabled)
 		filter.SetMetricsEnabled(enabled)
+	case "response_inspection":
+		t.ResponseInspection.Store(enabled)
+	case "rate_limit_shadow":
+		t.RateLimitShadow.Store(enabled)
+	}
+}
+
+func (t *LiveToggles) notify(feature string, enabled bool) {
+	t.hooksMu.RLock()
+	hooks := t.hooks[feature]
+	t.hooksMu.RUnlock()
+	for _, fn := range hooks {
+		fn(enabled)
 	}
 }
 
 func (t *LiveToggles) Snapshot() map[string]bool {
 	return map[string]bool{
-		"waf":       t.WAF.Load(),
-		"geoip":     t.GeoIP.Load(),
-		"challenge": t.Challenge.Load(),
-		"anomaly":   t.Anomaly.Load(),
-		"stats":     t.Stats.Load(),
+		"waf":                 t.WAF.Load(),
+		"waf_detect_only":     t.WAFDetectOnly.Load(),
+		"geoip":               t.GeoIP.Load(),
+		"challenge":           t.Challenge.Load(),
+		"anomaly":             t.Anomaly.Load(),
+		"stats":               t.Stats.Load(),
+		"response_inspection": t.ResponseInspection.Load(),
+		"rate_limit_shadow":   t.RateLimitShadow.Load(),
 	}
 }
 
@@ -79,6 +129,12 @@ type ManagementAPI struct {
 	Store        store.Storer
 	Toggles      *LiveToggles
 	ProxyWatcher *utilpkg.ProxyWatcher
+	WAF          *filter.WAF
+	Feeds        *filter.ThreatFeeds
+	GeoIP        *filter.GeoIPFilter
+	ASN          *filter.ASNFilter
+	L7           *filter.L7Filter
+	Connections  map[int]*filter.ConnTracker // by listen port
 	RequestCount atomic.Uint64
 	StartTime    time.Time
 }
@@ -109,6 +165,13 @@ func (api *ManagementAPI) ServeHTTP(mux *http.ServeMux) {
 	mux.HandleFunc("/api/proxy/reload", api.handleProxyReload)
 	mux.HandleFunc("/api/proxy/add", api.handleProxyAdd)
 	mux.HandleFunc("/api/proxy/remove", api.handleProxyRemove)
+	// WAF rules file — hot reload without restart
+	mux.HandleFunc("/api/waf/reload", api.handleWAFReload)
+	// Threat-intel feeds — status and on-demand refresh
+	mux.HandleFunc("/api/feeds", api.handleFeeds)
+	mux.HandleFunc("/api/feeds/reload", api.handleFeedsReload)
+	// Rate limit shadow mode — would-be rejections by key
+	mux.HandleFunc("/api/ratelimit/shadow", api.handleRateLimitShadow)
 }
 
 func (api *ManagementAPI) handleConfig(w http.ResponseWriter, r *http.Request) {
@@ -146,6 +209,19 @@ func (api *ManagementAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
 	uptimeSeconds := time.Since(api.StartTime).Seconds()
 	avgRps := float64(totalReqs) / uptimeSeconds
 
+	databases := map[string]filter.GeoDBStatus{}
+	if api.GeoIP != nil {
+		databases["country"] = api.GeoIP.DBStatus()
+	}
+	if api.ASN != nil {
+		databases["asn"] = api.ASN.DBStatus()
+	}
+
+	connections := map[string]filter.ConnStats{}
+	for port, tracker := range api.Connections {
+		connections[strconv.Itoa(port)] = tracker.Stats()
+	}
+
 	json.NewEncoder(w).Encode(map[string]any{
 		"status":           "active",
 		"uptime_seconds":   int(uptimeSeconds),
@@ -154,6 +230,8 @@ func (api *ManagementAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
 		"active_blocks":    blocks,
 		"fast_path_blocks": filter.GetSoftBlocks(),
 		"toggles":          api.Toggles.Snapshot(),
+		"geoip_databases":  databases,
+		"connections":      connections,
 		"timestamp":        time.Now(),
 	})
 }
@@ -254,5 +332,101 @@ func (api *ManagementAPI) handleProxyRemove(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(map[string]string{"status": "removed", "entry": entry})
 }
 
+// handleWAFReload re-reads the WAF rules file immediately.
+// POST /api/waf/reload
+func (api *ManagementAPI) handleWAFReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if api.WAF == nil {
+		http.Error(w, "WAF not initialised", http.StatusServiceUnavailable)
+		return
+	}
+	if err := api.WAF.Reload(); err != nil {
+		logger.Error("WAF rules reload via API failed", "err", err)
+		http.Error(w, "Reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	logger.Info("WAF rules reloaded via API")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "reloaded",
+		"rules":      len(api.WAF.Rules()),
+		"exclusions": len(api.WAF.Exclusions()),
+	})
+}
+
+// handleFeeds reports per-feed entry counts and last-update status.
+// GET /api/feeds
+func (api *ManagementAPI) handleFeeds(w http.ResponseWriter, r *http.Request) {
+	if api.Feeds == nil {
+		http.Error(w, "Threat feeds not initialised", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"feeds": api.Feeds.Status(),
+	})
+}
+
+// handleFeedsReload re-fetches one feed, or all of them, immediately.
+// POST /api/feeds/reload?name=spamhaus-drop
+func (api *ManagementAPI) handleFeedsReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if api.Feeds == nil {
+		http.Error(w, "Threat feeds not initialised", http.StatusServiceUnavailable)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if err := api.Feeds.Reload(name); err != nil {
+		logger.Error("Threat feed reload via API failed", "feed", name, "err", err)
+		http.Error(w, "Reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	logger.Info("Threat feeds reloaded via API", "feed", name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "reloaded",
+		"feeds":  api.Feeds.Status(),
+	})
+}
+
+// handleRateLimitShadow reports the top offenders L7 rate limiting would
+// have rejected in shadow mode, or starts a new report.
+// GET /api/ratelimit/shadow?top=20   DELETE /api/ratelimit/shadow
+func (api *ManagementAPI) handleRateLimitShadow(w http.ResponseWriter, r *http.Request) {
+	if api.L7 == nil {
+		http.Error(w, "L7 filter not initialised", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		top := 20
+		if v := r.URL.Query().Get("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "?top= must be a number", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"shadow": api.L7.Shadow(),
+			"report": api.L7.ShadowReport(top),
+		})
+	case http.MethodDelete:
+		api.L7.ResetShadowReport()
+		logger.Info("Rate limit shadow report reset via API")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Use GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
 // Ensure utilpkg is used (ProxyWatcher field references it).
 var _ *utilpkg.ProxyWatcher
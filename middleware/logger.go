@@ -19,6 +19,7 @@ type LogEntry struct {
 	Path         string
 	IntendedPort int
 	IP           string
+	ASN          string
 	Duration     time.Duration
 }
 
@@ -55,6 +56,7 @@ func init() {
 				"path", entry.Path,
 				"intended_port", entry.IntendedPort,
 				"ip", entry.IP,
+				"asn", entry.ASN,
 				"duration", entry.Duration.String(),
 			)
 			// Put back in pool for reuse
@@ -133,6 +135,7 @@ func RequestLogger(next http.Handler) http.Handler {
 		entry.Path = r.URL.Path
 		entry.IntendedPort = intendedPort
 		entry.IP = ip
+		entry.ASN = util.GetASN(r)
 		entry.Duration = duration
 
 		select {
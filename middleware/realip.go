@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sync"
 
+	"aegisedge/filter"
 	"aegisedge/util"
 )
 
@@ -36,7 +37,8 @@ func getIpShard(remoteAddr string) *ipCacheShard {
 }
 
 // RealIP middleware resolves the true client IP from trusted proxy headers.
-// Priority: CF-Connecting-IP → X-Real-IP → X-Forwarded-For → RemoteAddr.
+// Priority: CF-Connecting-IP → X-Real-IP → X-Forwarded-For → RemoteAddr,
+// where RemoteAddr is the PROXY protocol source when the connection had one.
 func RealIP(watcher *util.ProxyWatcher) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -44,6 +46,12 @@ func RealIP(watcher *util.ProxyWatcher) func(http.Handler) http.Handler {
 			if err != nil {
 				remoteHost = r.RemoteAddr
 			}
+			// A trusted balancer's PROXY header names the real peer
+			if h := filter.ProxyHeaderFromContext(r.Context()); h != nil {
+				if addr := h.ClientAddr(nil); addr != nil {
+					remoteHost, _, _ = net.SplitHostPort(addr.String())
+				}
+			}
 
 			shard := getIpShard(remoteHost)
 			shard.mu.RLock()
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"aegisedge/filter"
+)
+
+const (
+	// clientIdleConns bounds the idle upstream connections kept per client.
+	clientIdleConns = 4
+	// maxClientTransports bounds the clients with upstream connections at
+	// once; past it the least recently used client's are closed.
+	maxClientTransports = 4096
+)
+
+// clientTransports keeps a transport per client, so the upstream
+// connections opened with a PROXY header naming one client are only ever
+// reused for that client's requests. A client's transport is closed once
+// the downstream connections it served have all closed (see
+// TrackClientConns), when it has been unused for the idle timeout, or when
+// room is needed for another client.
+type clientTransports struct {
+	base    *http.Transport
+	version int
+
+	mu        sync.Mutex
+	clients   map[clientKey]*list.Element // of *clientTransport
+	lru       *list.List                  // most recently used first
+	lastSweep time.Time
+}
+
+// clientKey is the address pair a PROXY header carries.
+type clientKey struct {
+	src, dst string
+}
+
+type clientTransport struct {
+	*http.Transport
+	key      clientKey
+	lastUsed time.Time
+	conns    int // open downstream connections it has served
+}
+
+func newClientTransports(base *http.Transport, version int) *clientTransports {
+	return &clientTransports{
+		base:      base,
+		version:   version,
+		clients:   make(map[clientKey]*list.Element),
+		lru:       list.New(),
+		lastSweep: time.Now(),
+	}
+}
+
+func (ct *clientTransports) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	src, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	dst, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+	t := ct.get(src, dst)
+	if scope, _ := ctx.Value(connScopeKey{}).(*connScope); scope != nil {
+		scope.add(ct, t)
+	}
+	return t.RoundTrip(r)
+}
+
+func (ct *clientTransports) get(src, dst net.Addr) *clientTransport {
+	key := clientKey{addrString(src), addrString(dst)}
+	now := time.Now()
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.sweep(now)
+	if e := ct.clients[key]; e != nil {
+		ct.lru.MoveToFront(e)
+		t := e.Value.(*clientTransport)
+		t.lastUsed = now
+		return t
+	}
+	if ct.lru.Len() >= maxClientTransports {
+		ct.remove(ct.lru.Back())
+	}
+	t := &clientTransport{Transport: ct.newTransport(src, dst), key: key, lastUsed: now}
+	ct.clients[key] = ct.lru.PushFront(t)
+	return t
+}
+
+// acquire counts a downstream connection t serves.
+func (ct *clientTransports) acquire(t *clientTransport) {
+	ct.mu.Lock()
+	t.conns++
+	ct.mu.Unlock()
+}
+
+// release is called when a downstream connection t served has closed, and
+// closes t once none are left.
+func (ct *clientTransports) release(t *clientTransport) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	t.conns--
+	if t.conns > 0 {
+		return
+	}
+	if e := ct.clients[t.key]; e != nil && e.Value == t {
+		ct.remove(e)
+	} else {
+		t.CloseIdleConnections() // already evicted
+	}
+}
+
+// remove forgets a client and closes its idle upstream connections. Those
+// still serving a response finish on their own. ct.mu must be held.
+func (ct *clientTransports) remove(e *list.Element) {
+	t := ct.lru.Remove(e).(*clientTransport)
+	delete(ct.clients, t.key)
+	t.CloseIdleConnections()
+}
+
+// newTransport clones the base transport with a dialer that opens each
+// connection with a header naming src and dst.
+func (ct *clientTransports) newTransport(src, dst net.Addr) *http.Transport {
+	t := ct.base.Clone()
+	t.MaxIdleConns = clientIdleConns
+	t.MaxIdleConnsPerHost = clientIdleConns
+	dial := ct.base.DialContext
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := filter.WriteProxyHeader(c, ct.version, src, dst); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	return t
+}
+
+// sweep forgets clients unused for longer than the idle timeout, oldest
+// first, for downstream connections whose close was never seen. Without
+// an idle timeout, clients are only dropped when closed or evicted. ct.mu
+// must be held.
+func (ct *clientTransports) sweep(now time.Time) {
+	idle := ct.base.IdleConnTimeout
+	if idle <= 0 || now.Sub(ct.lastSweep) < idle/2 {
+		return
+	}
+	ct.lastSweep = now
+	for e := ct.lru.Back(); e != nil && now.Sub(e.Value.(*clientTransport).lastUsed) > idle; e = ct.lru.Back() {
+		ct.remove(e)
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+// TrackClientConns installs hooks on srv that close the upstream
+// connections a proxy sending PROXY protocol opened for a client once the
+// client's downstream connection closes, rather than leaving them open
+// for the idle timeout. It chains srv's ConnContext and ConnState hooks,
+// so install it after ConnTracker.Serve, which replaces ConnState.
+func TrackClientConns(srv *http.Server) {
+	var scopes sync.Map // net.Conn -> *connScope
+
+	prevCtx := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if prevCtx != nil {
+			ctx = prevCtx(ctx, c)
+		}
+		scope := &connScope{}
+		scopes.Store(c, scope)
+		return context.WithValue(ctx, connScopeKey{}, scope)
+	}
+	prevState := srv.ConnState
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			if scope, ok := scopes.LoadAndDelete(c); ok {
+				scope.(*connScope).close()
+			}
+		}
+		if prevState != nil {
+			prevState(c, state)
+		}
+	}
+}
+
+type connScopeKey struct{}
+
+// connScope records the client transports one downstream connection has
+// used, to release them when it closes.
+type connScope struct {
+	mu     sync.Mutex
+	closed bool
+	used   map[*clientTransport]*clientTransports
+}
+
+// add counts the connection against t the first time it uses it.
+func (s *connScope) add(ct *clientTransports, t *clientTransport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.used[t] != nil {
+		return
+	}
+	if s.used == nil {
+		s.used = make(map[*clientTransport]*clientTransports)
+	}
+	s.used[t] = ct
+	ct.acquire(t)
+}
+
+func (s *connScope) close() {
+	s.mu.Lock()
+	s.closed = true
+	used := s.used
+	s.used = nil
+	s.mu.Unlock()
+	for t, ct := range used {
+		ct.release(t)
+	}
+}
@@ -1,16 +1,21 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"runtime"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	"aegisedge/filter"
 	"aegisedge/logger"
+	"aegisedge/util"
 )
 
 // proxyBufferPool recycles 32KB buffers used by httputil.ReverseProxy.
@@ -33,7 +38,8 @@ func (p *proxyBufferPool) Put(buf []byte) {
 var sharedBufferPool = &proxyBufferPool{}
 
 type ReverseProxy struct {
-	Proxy *httputil.ReverseProxy
+	Proxy     *httputil.ReverseProxy
+	sendProxy bool
 }
 
 func NewReverseProxy(target string) (*ReverseProxy, error) {
@@ -78,6 +84,64 @@ func NewReverseProxy(target string) (*ReverseProxy, error) {
 	return &ReverseProxy{Proxy: proxy}, nil
 }
 
+// SetResponseFilter installs fn as the proxy's ModifyResponse hook. It runs
+// on every upstream response before anything is written to the client;
+// returning an error turns the response into a 502.
+func (p *ReverseProxy) SetResponseFilter(fn func(*http.Response) error) {
+	p.Proxy.ModifyResponse = fn
+}
+
+// StripHeaders removes the named request headers before they reach the
+// upstream, for internal headers it should not see.
+func (p *ReverseProxy) StripHeaders(names ...string) {
+	director := p.Proxy.Director
+	p.Proxy.Director = func(r *http.Request) {
+		director(r)
+		for _, name := range names {
+			r.Header.Del(name)
+		}
+	}
+}
+
+// SendProxyProtocol makes the proxy open every upstream connection with
+// a PROXY protocol header (version 1 or 2) naming the client, for
+// upstreams that log or filter by address. A header describes one client,
+// so upstream connections are pooled per client and reused only for it;
+// install TrackClientConns on the servers to close them with the client's
+// connection. It fails if the proxy already sends PROXY protocol or its
+// transport has been replaced.
+func (p *ReverseProxy) SendProxyProtocol(version int) error {
+	base, ok := p.Proxy.Transport.(*http.Transport)
+	if p.sendProxy || !ok {
+		return errors.New("proxy transport already replaced, cannot send PROXY protocol")
+	}
+	p.Proxy.Transport = newClientTransports(base, version)
+	p.sendProxy = true
+	return nil
+}
+
+type clientAddrKey struct{}
+
+// clientAddr is the resolved client IP, with the client's port when the
+// connection (or its PROXY header) came from the client itself.
+func clientAddr(r *http.Request) net.Addr {
+	ip := util.GetRealIP(r)
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	remote := r.RemoteAddr
+	if h := filter.ProxyHeaderFromContext(r.Context()); h != nil {
+		if src := h.ClientAddr(nil); src != nil {
+			remote = src.String()
+		}
+	}
+	if host, port, err := net.SplitHostPort(remote); err == nil && host == ip {
+		addr.Port, _ = strconv.Atoi(port)
+	}
+	return addr
+}
+
 func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.sendProxy {
+		r = r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, clientAddr(r)))
+	}
 	p.Proxy.ServeHTTP(w, r)
 }
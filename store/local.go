@@ -28,6 +28,7 @@ type storeShard struct {
 	counters map[string]localCounter
 	blocks   map[string]localBlock
 	data     map[string]localData
+	buckets  map[string]time.Time // GCRA theoretical arrival times
 	mu       sync.RWMutex
 }
 
@@ -45,6 +46,7 @@ func NewLocalStore() *LocalStore {
 			counters: make(map[string]localCounter),
 			blocks:   make(map[string]localBlock),
 			data:     make(map[string]localData),
+			buckets:  make(map[string]time.Time),
 		}
 	}
 	go s.cleanupLoop()
@@ -198,6 +200,12 @@ func (s *LocalStore) cleanupLoop() {
 						delete(shard.counters, k)
 					}
 				}
+				// Evict full (idle) rate limit buckets
+				for k, tat := range shard.buckets {
+					if now.After(tat) {
+						delete(shard.buckets, k)
+					}
+				}
 				// Evict expired data entries
 				for k, d := range shard.data {
 					if !d.expiry.IsZero() && now.After(d.expiry) {
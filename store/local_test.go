@@ -60,3 +60,45 @@ func TestLocalStore(t *testing.T) {
 		t.Error("Expected value to be expired and empty")
 	}
 }
+
+func TestLocalStoreRateLimit(t *testing.T) {
+	s := NewLocalStore()
+
+	// 10/s with a burst of 3: three immediate tokens, then one per 100ms
+	for i := 0; i < 3; i++ {
+		res, err := s.RateLimit("rl", 10, 3, 1)
+		if err != nil {
+			t.Fatalf("RateLimit failed: %v", err)
+		}
+		if !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("call %d: got %+v, want allowed with %d remaining", i, res, 2-i)
+		}
+	}
+	res, _ := s.RateLimit("rl", 10, 3, 1)
+	if res.Allowed {
+		t.Fatal("Expected the bucket to be empty")
+	}
+	if res.RetryAfter <= 0 || res.RetryAfter > 100*time.Millisecond {
+		t.Errorf("Expected RetryAfter within one emission interval, got %v", res.RetryAfter)
+	}
+
+	time.Sleep(res.RetryAfter)
+	if res, _ := s.RateLimit("rl", 10, 3, 1); !res.Allowed {
+		t.Error("Expected a token after RetryAfter")
+	}
+
+	// A cost larger than what is left is denied without taking anything
+	if res, _ := s.RateLimit("cost", 10, 3, 2); !res.Allowed || res.Remaining != 1 {
+		t.Fatalf("Expected cost 2 allowed with 1 remaining, got %+v", res)
+	}
+	if res, _ := s.RateLimit("cost", 10, 3, 2); res.Allowed {
+		t.Error("Expected cost 2 to be denied with 1 token left")
+	}
+	if res, _ := s.RateLimit("cost", 10, 3, 1); !res.Allowed {
+		t.Error("Expected the remaining token to still be available")
+	}
+
+	if _, err := s.RateLimit("bad", 0, 3, 1); err == nil {
+		t.Error("Expected an error for a zero rate")
+	}
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The rate limiter is GCRA (the generic cell rate algorithm): a bucket is a
+// single timestamp, the theoretical arrival time (TAT) at which it will be
+// full again. Each token pushes the TAT one emission interval (1/rate) into
+// the future, and a request is allowed while the TAT stays within burst
+// intervals of now. Both stores implement the same arithmetic.
+
+// gcraParams validates a RateLimit call and returns its emission interval
+// and tolerance.
+func gcraParams(rate float64, burst, cost int) (emission, tolerance time.Duration, err error) {
+	if rate <= 0 || burst <= 0 || cost <= 0 {
+		return 0, 0, fmt.Errorf("rate limit needs a positive rate, burst and cost (got %v, %d, %d)", rate, burst, cost)
+	}
+	emission = time.Duration(float64(time.Second) / rate)
+	return emission, emission * time.Duration(burst), nil
+}
+
+// gcra applies one RateLimit call to the bucket whose TAT is tat and
+// returns the new TAT, which is unchanged when the call is denied.
+func gcra(now, tat time.Time, emission, tolerance time.Duration, cost int) (time.Time, RateLimitResult) {
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(emission * time.Duration(cost))
+	allowAt := newTAT.Add(-tolerance)
+
+	if now.Before(allowAt) {
+		return tat, RateLimitResult{
+			Remaining:  max(0, int(now.Sub(tat.Add(-tolerance))/emission)),
+			RetryAfter: allowAt.Sub(now),
+			ResetAfter: tat.Sub(now),
+		}
+	}
+	return newTAT, RateLimitResult{
+		Allowed:    true,
+		Remaining:  int(now.Sub(allowAt) / emission),
+		ResetAfter: newTAT.Sub(now),
+	}
+}
+
+func (s *LocalStore) RateLimit(key string, rate float64, burst int, cost int) (RateLimitResult, error) {
+	emission, tolerance, err := gcraParams(rate, burst, cost)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	shard := s.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	tat, res := gcra(now, shard.buckets[key], emission, tolerance, cost)
+	if res.Allowed {
+		shard.buckets[key] = tat
+	}
+	return res, nil
+}
+
+// gcraScript is gcra() for Redis. It reads the clock from Redis so every
+// node agrees on "now", and keeps the TAT as seconds since the epoch with
+// a TTL of the time until the bucket is full again.
+//
+// KEYS[1] bucket; ARGV: emission interval (s), tolerance (s), cost.
+// Returns {allowed, remaining, retry_after (s), reset_after (s)}; floats
+// are returned as strings because Redis truncates Lua numbers.
+const gcraScript = `
+redis.replicate_commands()
+local emission = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local t = redis.call("TIME")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if not tat or tat < now then
+	tat = now
+end
+local new_tat = tat + emission * cost
+local allow_at = new_tat - tolerance
+
+if now < allow_at then
+	local remaining = math.max(0, math.floor((now - (tat - tolerance)) / emission))
+	return {0, remaining, tostring(allow_at - now), tostring(tat - now)}
+end
+
+local reset_after = new_tat - now
+redis.call("SET", KEYS[1], tostring(new_tat), "PX", math.ceil(reset_after * 1000))
+return {1, math.floor((now - allow_at) / emission), "0", tostring(reset_after)}
+`
+
+var gcraRedisScript = redis.NewScript(gcraScript)
+
+func (s *RedisStore) RateLimit(key string, rate float64, burst int, cost int) (RateLimitResult, error) {
+	emission, tolerance, err := gcraParams(rate, burst, cost)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	vals, err := gcraRedisScript.Run(s.ctx, s.Client, []string{key},
+		emission.Seconds(), tolerance.Seconds(), cost).Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(vals) != 4 {
+		return RateLimitResult{}, fmt.Errorf("rate limit script returned %d values", len(vals))
+	}
+	allowed, _ := vals[0].(int64)
+	remaining, _ := vals[1].(int64)
+	return RateLimitResult{
+		Allowed:    allowed == 1,
+		Remaining:  int(remaining),
+		RetryAfter: parseSeconds(vals[2]),
+		ResetAfter: parseSeconds(vals[3]),
+	}, nil
+}
+
+func parseSeconds(v any) time.Duration {
+	str, _ := v.(string)
+	secs, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs * float64(time.Second))
+}
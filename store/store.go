@@ -13,4 +13,16 @@ type Storer interface {
 	ListBlocks() (map[string]string, error)
 	Get(key string) (string, error)
 	Set(key string, val string, expiration time.Duration) error
+	// RateLimit takes cost tokens from the GCRA bucket at key, which holds
+	// burst tokens and refills at rate tokens per second. Every node sharing
+	// the store sees the same bucket. A denied call takes nothing.
+	RateLimit(key string, rate float64, burst int, cost int) (RateLimitResult, error)
+}
+
+// RateLimitResult is the outcome of a RateLimit call.
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // tokens left in the bucket
+	RetryAfter time.Duration // when denied, until cost tokens are available
+	ResetAfter time.Duration // until the bucket is full again
 }
@@ -22,3 +22,30 @@ func GetRealIP(r *http.Request) string {
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
 	return host
 }
+
+// ASNHeader carries the client's resolved autonomous system ("AS16509")
+// between layers, the same way X-Aegis-Real-IP carries the address.
+const ASNHeader = "X-Aegis-ASN"
+
+// SetASN stores the resolved ASN of the client in the request headers.
+func SetASN(r *http.Request, asn string) {
+	r.Header.Set(ASNHeader, asn)
+}
+
+// GetASN returns the client's ASN, or "" if it wasn't resolved.
+func GetASN(r *http.Request) string {
+	return r.Header.Get(ASNHeader)
+}
+
+// CountryHeader carries the client's resolved ISO country code.
+const CountryHeader = "X-Aegis-Country"
+
+// SetCountry stores the resolved country of the client in the request headers.
+func SetCountry(r *http.Request, country string) {
+	r.Header.Set(CountryHeader, country)
+}
+
+// GetCountry returns the client's country, or "" if it wasn't resolved.
+func GetCountry(r *http.Request) string {
+	return r.Header.Get(CountryHeader)
+}